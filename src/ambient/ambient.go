@@ -0,0 +1,156 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package ambient translates uploads from Ambient Weather stations, e.g. the
+// WS-2902, sent in the AmbientWeather custom server format into Ecowitt form
+// data.
+//
+// The format is close to the Ecowitt protocol: a GET request with the
+// readings in the query string, mostly using the same field names. The
+// station is identified by its MAC address instead of a PASSKEY, a few fields
+// are named differently and battery flags are inverted.
+package ambient
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"hass-ecowitt-proxy/ecowitt"
+)
+
+// FieldMAC identifies Ambient Weather stations.
+const FieldMAC = "MAC"
+
+// field translates a single Ambient Weather field.
+type field struct {
+	ambient string
+	ecowitt string
+	// convert, when set, converts the value into the Ecowitt equivalent.
+	convert func(float64) float64
+}
+
+// invertBattery turns an Ambient battery flag (1 = OK, 0 = low) into an
+// Ecowitt one (0 = OK, 1 = low).
+func invertBattery(v float64) float64 {
+	return 1 - v
+}
+
+// msToSeconds converts Ambient's millisecond timestamps into the Unix seconds
+// Ecowitt uses.
+func msToSeconds(v float64) float64 {
+	return float64(int64(v) / 1000)
+}
+
+// fields is the translation table. Fields that are not listed have the same
+// name and meaning in both formats and are passed through unchanged.
+var fields = []field{
+	{ambient: FieldMAC, ecowitt: ecowitt.FieldPasskey},
+
+	// Ambient reports the rain rate as hourlyrainin.
+	{ambient: "hourlyrainin", ecowitt: "rainratein"},
+
+	{ambient: "battout", ecowitt: "wh65batt", convert: invertBattery},
+	{ambient: "battin", ecowitt: "wh25batt", convert: invertBattery},
+	{ambient: "battlightning", ecowitt: "wh57batt", convert: invertBattery},
+	{ambient: "batt1", ecowitt: "batt1", convert: invertBattery},
+	{ambient: "batt2", ecowitt: "batt2", convert: invertBattery},
+	{ambient: "batt3", ecowitt: "batt3", convert: invertBattery},
+	{ambient: "batt4", ecowitt: "batt4", convert: invertBattery},
+	{ambient: "batt5", ecowitt: "batt5", convert: invertBattery},
+	{ambient: "batt6", ecowitt: "batt6", convert: invertBattery},
+	{ambient: "batt7", ecowitt: "batt7", convert: invertBattery},
+	{ambient: "batt8", ecowitt: "batt8", convert: invertBattery},
+
+	{ambient: "soilhum1", ecowitt: "soilmoisture1"},
+	{ambient: "soilhum2", ecowitt: "soilmoisture2"},
+	{ambient: "soilhum3", ecowitt: "soilmoisture3"},
+	{ambient: "soilhum4", ecowitt: "soilmoisture4"},
+	{ambient: "soilhum5", ecowitt: "soilmoisture5"},
+	{ambient: "soilhum6", ecowitt: "soilmoisture6"},
+	{ambient: "soilhum7", ecowitt: "soilmoisture7"},
+	{ambient: "soilhum8", ecowitt: "soilmoisture8"},
+
+	{ambient: "pm25", ecowitt: "pm25_ch1"},
+	{ambient: "pm25_24h", ecowitt: "pm25_avg_24h_ch1"},
+	{ambient: "batt_25", ecowitt: "pm25batt1", convert: func(v float64) float64 {
+		// Ecowitt reports PM2.5 battery levels from 0 to 5.
+		if v > 0 {
+			return 5
+		}
+		return 1
+	}},
+
+	{ambient: "co2_in_aqin", ecowitt: "co2"},
+	{ambient: "co2_in_24h_aqin", ecowitt: "co2_24h"},
+	{ambient: "pm25_in_aqin", ecowitt: "pm25_co2"},
+	{ambient: "pm25_in_24h_aqin", ecowitt: "pm25_24h_co2"},
+	{ambient: "pm10_in_aqin", ecowitt: "pm10_co2"},
+	{ambient: "pm10_in_24h_aqin", ecowitt: "pm10_24h_co2"},
+	{ambient: "pm_in_temp_aqin", ecowitt: "tf_co2"},
+	{ambient: "pm_in_humidity_aqin", ecowitt: "humi_co2"},
+
+	{ambient: "lightning_day", ecowitt: "lightning_num"},
+	{ambient: "lightning_distance", ecowitt: "lightning"},
+	{ambient: "lightning_time", ecowitt: "lightning_time", convert: msToSeconds},
+}
+
+var fieldsByName = func() map[string]field {
+	m := map[string]field{}
+	for _, f := range fields {
+		m[f.ambient] = f
+	}
+	return m
+}()
+
+// IsAmbient reports whether a query string looks like an Ambient Weather
+// upload.
+func IsAmbient(query url.Values) bool {
+	return query.Has(FieldMAC) && !query.Has(ecowitt.FieldPasskey)
+}
+
+// ParseQuery parses the query string of an Ambient Weather upload. The
+// stations append "?" and their readings to the configured path, so the
+// query often starts with stray "?" or "&" characters.
+func ParseQuery(rawQuery string) (url.Values, error) {
+	return url.ParseQuery(strings.TrimLeft(rawQuery, "?&"))
+}
+
+// Translate converts an Ambient Weather upload into Ecowitt form data.
+// Values that cannot be converted are passed through as they are.
+func Translate(query url.Values) url.Values {
+	values := url.Values{}
+	for name, vals := range query {
+		f, ok := fieldsByName[name]
+		if !ok {
+			values[name] = append([]string(nil), vals...)
+			continue
+		}
+		if len(vals) != 1 || f.convert == nil {
+			values[f.ecowitt] = append([]string(nil), vals...)
+			continue
+		}
+
+		v, err := strconv.ParseFloat(vals[0], 64)
+		if err != nil {
+			values.Set(f.ecowitt, vals[0])
+			continue
+		}
+		values.Set(f.ecowitt, strconv.FormatFloat(f.convert(v), 'f', -1, 64))
+	}
+	return values
+}
@@ -0,0 +1,101 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package ambient
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"hass-ecowitt-proxy/ecowitt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// golden formats form data one field per line, sorted by name.
+func golden(values url.Values) string {
+	lines := []string{}
+	for name, vals := range values {
+		for _, v := range vals {
+			lines = append(lines, fmt.Sprintf("%s=%s", name, v))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestTranslateGolden(t *testing.T) {
+	for _, name := range []string{"ws2902", "malformed"} {
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile("testdata/" + name + ".txt")
+			require.NoError(t, err)
+
+			query, err := ParseQuery(strings.TrimSpace(string(raw)))
+			require.NoError(t, err)
+			assert.True(t, IsAmbient(query))
+
+			got := golden(Translate(query))
+
+			goldenFile := "testdata/" + name + ".golden"
+			if *update {
+				require.NoError(t, os.WriteFile(goldenFile, []byte(got), 0o644))
+			}
+			want, err := os.ReadFile(goldenFile)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), got)
+		})
+	}
+}
+
+func TestTranslationTable(t *testing.T) {
+	seen := map[string]bool{}
+	for _, f := range fields {
+		assert.False(t, seen[f.ambient], "duplicate entry for %s", f.ambient)
+		seen[f.ambient] = true
+
+		assert.True(t, ecowitt.IsKnownField(f.ecowitt), "%s translates to unknown field %s", f.ambient, f.ecowitt)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	translated := Translate(url.Values{
+		"MAC":          {"00:0E:C6:20:3B:1F"},
+		"tempf":        {"45.5"},
+		"hourlyrainin": {"0.12"},
+		"battout":      {"1"},
+	})
+
+	p := ecowitt.Parse(translated)
+	assert.Equal(t, "00:0E:C6:20:3B:1F", p.Station.Passkey)
+	assert.Equal(t, 45.5, *p.Outdoor.TempF)
+	assert.Equal(t, 0.12, *p.Rain.RateInHr)
+	assert.Equal(t, map[string]float64{"wh65batt": 0}, p.Batteries)
+	assert.Empty(t, p.Extra)
+}
+
+func TestIsAmbient(t *testing.T) {
+	assert.True(t, IsAmbient(url.Values{"MAC": {"00:0E:C6:20:3B:1F"}}))
+	assert.False(t, IsAmbient(url.Values{"PASSKEY": {"AAAA"}}))
+	assert.False(t, IsAmbient(url.Values{}))
+}
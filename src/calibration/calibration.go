@@ -0,0 +1,118 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package calibration corrects sensor readings that are known to be off, e.g.
+// a thermometer that reads 0.8°F high or a rain gauge that under-reports.
+// Rules are keyed by Ecowitt field name and applied to the parsed payload
+// before it is forwarded.
+package calibration
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"hass-ecowitt-proxy/ecowitt"
+)
+
+// Rule corrects a single reading. The reading is multiplied by Gain, Offset
+// is added and the result is clamped to Min and Max.
+type Rule struct {
+	Offset float64
+	// Gain scales the reading. Zero means 1, i.e. no scaling.
+	Gain float64
+	Min  *float64
+	Max  *float64
+}
+
+// Validate checks that the clamping range is not empty.
+func (r Rule) Validate() error {
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return fmt.Errorf("min %v is greater than max %v", *r.Min, *r.Max)
+	}
+	return nil
+}
+
+// Correct returns the calibrated value of a reading.
+func (r Rule) Correct(v float64) float64 {
+	if r.Gain != 0 {
+		v *= r.Gain
+	}
+	v += r.Offset
+
+	if r.Min != nil && v < *r.Min {
+		v = *r.Min
+	}
+	if r.Max != nil && v > *r.Max {
+		v = *r.Max
+	}
+	return trim(v)
+}
+
+// trim removes the floating point noise that arithmetic on decimal readings
+// introduces, e.g. 70.1-0.8 = 69.29999999999999, so the corrected value is
+// forwarded as 69.3.
+func trim(v float64) float64 {
+	trimmed, err := strconv.ParseFloat(strconv.FormatFloat(v, 'g', 12, 64), 64)
+	if err != nil {
+		return v
+	}
+	return trimmed
+}
+
+// Rules maps Ecowitt field names, e.g. "temp2f" or "rainratein", to the rule
+// for that reading.
+type Rules map[string]Rule
+
+// Validate checks that every rule applies to a numeric Ecowitt field and has
+// a valid range.
+func (rs Rules) Validate() error {
+	names := make([]string, 0, len(rs))
+	for name := range rs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	unknown := []string{}
+	for _, name := range names {
+		if _, ok := ecowitt.FieldInfo(name); !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if err := rs[name].Validate(); err != nil {
+			return fmt.Errorf("calibration of %s: %w", name, err)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("calibration of unknown fields: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Apply corrects the readings of a payload and reports whether any rule
+// matched. Readings the payload does not have are left alone.
+func (rs Rules) Apply(p *ecowitt.Payload) bool {
+	applied := false
+	for name, r := range rs {
+		if v, ok := p.Get(name); ok {
+			p.Set(name, r.Correct(v))
+			applied = true
+		}
+	}
+	return applied
+}
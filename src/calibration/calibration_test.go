@@ -0,0 +1,120 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package calibration
+
+import (
+	"net/url"
+	"testing"
+
+	"hass-ecowitt-proxy/ecowitt"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func TestCorrect(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		value float64
+		want  float64
+	}{
+		{name: "no rule", value: 70.1, want: 70.1},
+		{name: "offset", rule: Rule{Offset: -0.8}, value: 70.1, want: 69.3},
+		{name: "gain", rule: Rule{Gain: 1.07}, value: 0.12, want: 0.1284},
+		{name: "gain before offset", rule: Rule{Gain: 2, Offset: 1}, value: 3, want: 7},
+		{name: "clamped to max", rule: Rule{Offset: 3, Max: float(100)}, value: 99, want: 100},
+		{name: "clamped to min", rule: Rule{Offset: -0.5, Min: float(0)}, value: 0.2, want: 0},
+		{name: "within range", rule: Rule{Offset: 2, Min: float(0), Max: float(100)}, value: 50, want: 52},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, test.rule.Correct(test.value))
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   Rules
+		wantErr string
+	}{
+		{name: "empty"},
+		{
+			name: "channel and fixed fields",
+			rules: Rules{
+				"temp2f":     {Offset: -0.8},
+				"humidity3":  {Offset: 2, Max: float(100)},
+				"rainratein": {Gain: 1.07},
+			},
+		},
+		{
+			name:    "unknown fields",
+			rules:   Rules{"tempf": {}, "temperature": {}, "PASSKEY": {}},
+			wantErr: "calibration of unknown fields: PASSKEY, temperature",
+		},
+		{
+			name:    "empty range",
+			rules:   Rules{"humidity": {Min: float(100), Max: float(0)}},
+			wantErr: "calibration of humidity: min 100 is greater than max 0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.rules.Validate()
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	rules := Rules{
+		"temp2f":     {Offset: -0.8},
+		"rainratein": {Gain: 1.07},
+		"humidity3":  {Offset: 5, Max: float(100)},
+	}
+
+	p := ecowitt.Parse(url.Values{
+		"PASSKEY":    {"AAAA"},
+		"temp1f":     {"68.4"},
+		"temp2f":     {"70.1"},
+		"humidity3":  {"97"},
+		"rainratein": {"0.12"},
+	})
+	assert.True(t, rules.Apply(p))
+
+	assert.Equal(t, url.Values{
+		"PASSKEY":    {"AAAA"},
+		"temp1f":     {"68.4"},
+		"temp2f":     {"69.3"},
+		"humidity3":  {"100"},
+		"rainratein": {"0.1284"},
+	}, p.Values())
+
+	untouched := ecowitt.Parse(url.Values{"PASSKEY": {"AAAA"}, "tempf": {"45"}})
+	assert.False(t, rules.Apply(untouched))
+}
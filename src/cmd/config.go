@@ -0,0 +1,813 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"hass-ecowitt-proxy/calibration"
+	"hass-ecowitt-proxy/controller"
+	"hass-ecowitt-proxy/influx"
+	"hass-ecowitt-proxy/mqtt"
+	"hass-ecowitt-proxy/outlier"
+	"hass-ecowitt-proxy/redact"
+	"hass-ecowitt-proxy/rewrite"
+	"hass-ecowitt-proxy/tlsconfig"
+	"hass-ecowitt-proxy/units"
+	"hass-ecowitt-proxy/wunderground"
+
+	"github.com/spf13/viper"
+)
+
+// retryConfig is the retry section of a target in the config file. Fields
+// left unset fall back to the hass_retry_* options.
+type retryConfig struct {
+	MaxAttempts int           `mapstructure:"max_attempts"`
+	BaseDelay   time.Duration `mapstructure:"base_delay"`
+	MaxDelay    time.Duration `mapstructure:"max_delay"`
+	Jitter      *float64      `mapstructure:"jitter"`
+	StatusCodes []int         `mapstructure:"status_codes"`
+}
+
+func (rc *retryConfig) apply(base controller.RetryPolicy) controller.RetryPolicy {
+	if rc.MaxAttempts != 0 {
+		base.MaxAttempts = rc.MaxAttempts
+	}
+	if rc.BaseDelay != 0 {
+		base.BaseDelay = rc.BaseDelay
+	}
+	if rc.MaxDelay != 0 {
+		base.MaxDelay = rc.MaxDelay
+	}
+	if rc.Jitter != nil {
+		base.Jitter = *rc.Jitter
+	}
+	if rc.StatusCodes != nil {
+		base.RetryableStatusCodes = rc.StatusCodes
+	}
+	return base
+}
+
+// targetConfig is a single entry of the targets list in the config file:
+//
+//	targets:
+//	  - name: production
+//	    url: https://ha.example.com
+//	    auth_token: ...
+//	    webhook_id: ...
+//	    timeout: 10s
+//	    retry:
+//	      max_attempts: 5
+//	    tls:
+//	      ca_file: /etc/ssl/private-ca.pem
+type targetConfig struct {
+	Name      string           `mapstructure:"name"`
+	URL       string           `mapstructure:"url"`
+	AuthToken string           `mapstructure:"auth_token"`
+	WebhookID string           `mapstructure:"webhook_id"`
+	Timeout   time.Duration    `mapstructure:"timeout"`
+	Retry     *retryConfig     `mapstructure:"retry"`
+	TLS       *tlsClientConfig `mapstructure:"tls"`
+}
+
+// routingConfig is the routing section of the config file:
+//
+//	routing:
+//	  default_targets: [production]
+//	  reject_unknown_stations: false
+//	  routes:
+//	    - field: PASSKEY
+//	      value: 0123456789ABCDEF0123456789ABCDEF
+//	      targets: [production, staging]
+type routingConfig struct {
+	DefaultTargets        []string      `mapstructure:"default_targets"`
+	RejectUnknownStations bool          `mapstructure:"reject_unknown_stations"`
+	Routes                []routeConfig `mapstructure:"routes"`
+}
+
+type routeConfig struct {
+	Field   string   `mapstructure:"field"`
+	Value   string   `mapstructure:"value"`
+	Targets []string `mapstructure:"targets"`
+}
+
+// rewriteConfig is a single entry of the rewrite list in the config file:
+//
+//	rewrite:
+//	  - name: strip leaf wetness
+//	    match: ^leafwetness_ch\d+$
+//	    action: drop
+//	  - field: outtemp
+//	    action: rename
+//	    to: tempf
+//	    passkeys: [0123456789ABCDEF0123456789ABCDEF]
+//	  - field: freq
+//	    action: set
+//	    value: 868M
+type rewriteConfig struct {
+	Name     string   `mapstructure:"name"`
+	Field    string   `mapstructure:"field"`
+	Match    string   `mapstructure:"match"`
+	Action   string   `mapstructure:"action"`
+	To       string   `mapstructure:"to"`
+	Value    string   `mapstructure:"value"`
+	Passkeys []string `mapstructure:"passkeys"`
+}
+
+// calibrationConfig is a single entry of the calibration section of the
+// config file, keyed by Ecowitt field name:
+//
+//	calibration:
+//	  temp2f:
+//	    offset: -0.8
+//	  rainratein:
+//	    gain: 1.07
+//	  humidity3:
+//	    offset: 2
+//	    max: 100
+type calibrationConfig struct {
+	Offset float64  `mapstructure:"offset"`
+	Gain   float64  `mapstructure:"gain"`
+	Min    *float64 `mapstructure:"min"`
+	Max    *float64 `mapstructure:"max"`
+}
+
+// outlierConfig is the outliers section of the config file. Without it, no
+// readings are filtered.
+//
+//	outliers:
+//	  action: last_good
+//	  limits:
+//	    windgustmph:
+//	      max: 120
+//	      max_rate: 30
+//	    tempf:
+//	      max_rate: 2
+//	      action: drop
+type outlierConfig struct {
+	Action string                        `mapstructure:"action"`
+	Limits map[string]outlierLimitConfig `mapstructure:"limits"`
+}
+
+type outlierLimitConfig struct {
+	Min     *float64 `mapstructure:"min"`
+	Max     *float64 `mapstructure:"max"`
+	MaxRate float64  `mapstructure:"max_rate"`
+	Action  string   `mapstructure:"action"`
+}
+
+// tlsClientConfig is a TLS section for outgoing connections.
+type tlsClientConfig struct {
+	CAFile             string `mapstructure:"ca_file"`
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+	ServerName         string `mapstructure:"server_name"`
+	MinVersion         string `mapstructure:"min_version"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+func (tc tlsClientConfig) client() tlsconfig.Client {
+	return tlsconfig.Client{
+		CAFile:             tc.CAFile,
+		CertFile:           tc.CertFile,
+		KeyFile:            tc.KeyFile,
+		ServerName:         tc.ServerName,
+		MinVersion:         tc.MinVersion,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+}
+
+// hassTLSFromConfig returns the TLS settings from the hass_tls_* options.
+func hassTLSFromConfig() tlsconfig.Client {
+	return tlsconfig.Client{
+		CAFile:             viper.GetString(flagHassTLSCAFile),
+		CertFile:           viper.GetString(flagHassTLSCertFile),
+		KeyFile:            viper.GetString(flagHassTLSKeyFile),
+		ServerName:         viper.GetString(flagHassTLSServerName),
+		MinVersion:         viper.GetString(flagHassTLSMinVersion),
+		InsecureSkipVerify: viper.GetBool(flagHassTLSInsecureSkipVerify),
+	}
+}
+
+// mqttConfig is the mqtt section of the config file:
+//
+//	mqtt:
+//	  broker: ssl://mqtt.example.com:8883
+//	  username: ecowitt
+//	  password: ...
+//	  topic_prefix: ecowitt
+//	  discovery_prefix: homeassistant
+//	  qos: 1
+//	  retain: true
+//	  units: metric
+//	  tls:
+//	    ca_file: /etc/ssl/mqtt-ca.pem
+type mqttConfig struct {
+	Broker           string          `mapstructure:"broker"`
+	ClientID         string          `mapstructure:"client_id"`
+	Username         string          `mapstructure:"username"`
+	Password         string          `mapstructure:"password"`
+	TopicPrefix      string          `mapstructure:"topic_prefix"`
+	DiscoveryPrefix  string          `mapstructure:"discovery_prefix"`
+	DisableDiscovery bool            `mapstructure:"disable_discovery"`
+	QoS              byte            `mapstructure:"qos"`
+	Retain           bool            `mapstructure:"retain"`
+	ConnectTimeout   time.Duration   `mapstructure:"connect_timeout"`
+	Units            string          `mapstructure:"units"`
+	TLS              tlsClientConfig `mapstructure:"tls"`
+}
+
+// influxConfig is the influxdb section of the config file:
+//
+//	influxdb:
+//	  url: http://influxdb:8086
+//	  org: home
+//	  bucket: weather
+//	  token: ...
+//	  batch_size: 500
+//	  flush_interval: 10s
+//	  units: metric_wind_ms
+//
+// units is imperial (the default), metric or metric_wind_ms, as in the mqtt
+// section.
+type influxConfig struct {
+	URL           string          `mapstructure:"url"`
+	Org           string          `mapstructure:"org"`
+	Bucket        string          `mapstructure:"bucket"`
+	Token         string          `mapstructure:"token"`
+	BatchSize     int             `mapstructure:"batch_size"`
+	MaxPending    int             `mapstructure:"max_pending"`
+	FlushInterval time.Duration   `mapstructure:"flush_interval"`
+	Timeout       time.Duration   `mapstructure:"timeout"`
+	Units         string          `mapstructure:"units"`
+	TLS           tlsClientConfig `mapstructure:"tls"`
+}
+
+// authConfig is the auth section of the config file. It protects /status,
+// /metrics and /rewrite/dry-run; uploads and /health stay open. Password
+// hashes are bcrypt hashes, e.g. from htpasswd -nbB:
+//
+//	auth:
+//	  basic:
+//	    - username: admin
+//	      password_hash: $2y$10$...
+//	  bearer_tokens:
+//	    - ...
+//	  proxy_header: X-Remote-User
+//	  trusted_proxies:
+//	    - 172.17.0.0/16
+type authConfig struct {
+	Basic []struct {
+		Username     string `mapstructure:"username"`
+		PasswordHash string `mapstructure:"password_hash"`
+	} `mapstructure:"basic"`
+	BearerTokens   []string `mapstructure:"bearer_tokens"`
+	ProxyHeader    string   `mapstructure:"proxy_header"`
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+}
+
+// allowlistConfig is the ingest_allowlist section of the config file. It
+// limits uploads to the listed sources and stations:
+//
+//	ingest_allowlist:
+//	  sources:
+//	    - 192.168.1.20
+//	    - 192.168.10.0/24
+//	  trusted_proxies:
+//	    - 172.17.0.1
+//	  passkeys:
+//	    - 0123456789ABCDEF0123456789ABCDEF
+type allowlistConfig struct {
+	Sources        []string `mapstructure:"sources"`
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	Passkeys       []string `mapstructure:"passkeys"`
+}
+
+// relayConfig is a single entry of the relays list in the config file. The
+// url defaults to the upload endpoint of the named service, wunderground or
+// pwsweather:
+//
+//	relays:
+//	  - name: wunderground
+//	    service: wunderground
+//	    station_id: KXXXXXXX1
+//	    station_key: ...
+//	    passkey: 0123456789ABCDEF0123456789ABCDEF
+type relayConfig struct {
+	Name       string        `mapstructure:"name"`
+	Service    string        `mapstructure:"service"`
+	URL        string        `mapstructure:"url"`
+	StationID  string        `mapstructure:"station_id"`
+	StationKey string        `mapstructure:"station_key"`
+	Passkey    string        `mapstructure:"passkey"`
+	Timeout    time.Duration `mapstructure:"timeout"`
+}
+
+var relayServiceURLs = map[string]string{
+	"wunderground": wunderground.WundergroundURL,
+	"pwsweather":   wunderground.PWSWeatherURL,
+}
+
+func retryPolicyFromConfig() controller.RetryPolicy {
+	return controller.RetryPolicy{
+		MaxAttempts:          viper.GetInt(flagHassRetryMaxAttempts),
+		BaseDelay:            viper.GetDuration(flagHassRetryBaseDelay),
+		MaxDelay:             viper.GetDuration(flagHassRetryMaxDelay),
+		Jitter:               viper.GetFloat64(flagHassRetryJitter),
+		RetryableStatusCodes: viper.GetIntSlice(flagHassRetryStatusCodes),
+	}
+}
+
+// targetsFromConfig builds the list of Home Assistant targets. The hass_url,
+// hass_auth_token and hass_webhook_id options describe a target named
+// "default"; any entries under targets in the config file are added to it.
+// The list may be empty when uploads go to MQTT, InfluxDB or relays instead.
+func targetsFromConfig() ([]controller.Target, error) {
+	targets := []controller.Target{}
+
+	hassURL := viper.GetString(flagHassUrl)
+	hassAuthToken := viper.GetString(flagHassAuthToken)
+	hassWebhookID := viper.GetString(flagHassWebhookId)
+
+	// The flags are only optional when uploads go somewhere else.
+	otherwiseConfigured := viper.IsSet(viperTargets) || viper.IsSet(viperMQTT) || viper.IsSet(viperInfluxDB) ||
+		viper.IsSet(viperRelays)
+	if hassURL != "" || hassAuthToken != "" || hassWebhookID != "" || !otherwiseConfigured {
+		missingOptions := []string{}
+		if hassURL == "" {
+			missingOptions = append(missingOptions, flagHassUrl)
+		}
+		if hassAuthToken == "" {
+			missingOptions = append(missingOptions, flagHassAuthToken)
+		}
+		if hassWebhookID == "" {
+			missingOptions = append(missingOptions, flagHassWebhookId)
+		}
+
+		if len(missingOptions) > 0 {
+			return nil, fmt.Errorf("missing required config options: %s", strings.Join(missingOptions, ", "))
+		}
+
+		targets = append(targets, controller.Target{
+			Name:      controller.DefaultTargetName,
+			URL:       hassURL,
+			AuthToken: hassAuthToken,
+			WebhookID: hassWebhookID,
+			Timeout:   viper.GetDuration(flagHassTimeout),
+			TLS:       hassTLSFromConfig(),
+		})
+	}
+
+	var configured []targetConfig
+	if err := viper.UnmarshalKey(viperTargets, &configured); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", viperTargets, err)
+	}
+
+	defaultPolicy := retryPolicyFromConfig()
+	for _, tc := range configured {
+		t := controller.Target{
+			Name:      tc.Name,
+			URL:       tc.URL,
+			AuthToken: tc.AuthToken,
+			WebhookID: tc.WebhookID,
+			Timeout:   tc.Timeout,
+		}
+		if t.Timeout == 0 {
+			t.Timeout = viper.GetDuration(flagHassTimeout)
+		}
+		if tc.Retry != nil {
+			policy := tc.Retry.apply(defaultPolicy)
+			t.RetryPolicy = &policy
+		}
+		if tc.TLS != nil {
+			t.TLS = tc.TLS.client()
+		} else {
+			t.TLS = hassTLSFromConfig()
+		}
+		targets = append(targets, t)
+	}
+
+	if err := controller.ValidateTargets(targets); err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+// routingFromConfig builds the routing table and checks it against targets.
+func routingFromConfig(targets []controller.Target) (controller.RoutingConfig, error) {
+	var rc routingConfig
+	if err := viper.UnmarshalKey(viperRouting, &rc); err != nil {
+		return controller.RoutingConfig{}, fmt.Errorf("error parsing %s: %w", viperRouting, err)
+	}
+
+	routing := controller.RoutingConfig{
+		DefaultTargets: rc.DefaultTargets,
+		RejectUnknown:  rc.RejectUnknownStations,
+	}
+	for _, r := range rc.Routes {
+		field := r.Field
+		if field == "" {
+			field = controller.RouteFieldPasskey
+		}
+		routing.Routes = append(routing.Routes, controller.Route{
+			Field:   field,
+			Value:   r.Value,
+			Targets: r.Targets,
+		})
+	}
+
+	if err := routing.Validate(targets); err != nil {
+		return controller.RoutingConfig{}, fmt.Errorf("invalid %s: %w", viperRouting, err)
+	}
+
+	return routing, nil
+}
+
+// rewriterFromConfig compiles the rewrite rules, or returns nil when the
+// config file has none.
+func rewriterFromConfig() (*rewrite.Rewriter, error) {
+	var rc []rewriteConfig
+	if err := viper.UnmarshalKey(viperRewrite, &rc); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", viperRewrite, err)
+	}
+	if len(rc) == 0 {
+		return nil, nil
+	}
+
+	rules := make([]rewrite.Rule, 0, len(rc))
+	for _, r := range rc {
+		action, err := rewrite.ActionFromStr(r.Action)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", viperRewrite, err)
+		}
+		rules = append(rules, rewrite.Rule{
+			Name:     r.Name,
+			Field:    r.Field,
+			Match:    r.Match,
+			Action:   action,
+			To:       r.To,
+			Value:    r.Value,
+			Passkeys: r.Passkeys,
+		})
+	}
+
+	rw, err := rewrite.New(rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperRewrite, err)
+	}
+	return rw, nil
+}
+
+// calibrationFromConfig returns the calibration rules, or nil when the config
+// file has no calibration section.
+func calibrationFromConfig() (calibration.Rules, error) {
+	if !viper.IsSet(viperCalibration) {
+		return nil, nil
+	}
+
+	var cc map[string]calibrationConfig
+	if err := viper.UnmarshalKey(viperCalibration, &cc); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", viperCalibration, err)
+	}
+
+	rules := calibration.Rules{}
+	for name, c := range cc {
+		rules[name] = calibration.Rule{Offset: c.Offset, Gain: c.Gain, Min: c.Min, Max: c.Max}
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperCalibration, err)
+	}
+
+	return rules, nil
+}
+
+// outlierFromConfig returns the outlier filter settings, or nil when the
+// config file has no outliers section.
+func outlierFromConfig() (*outlier.Config, error) {
+	if !viper.IsSet(viperOutliers) {
+		return nil, nil
+	}
+
+	var oc outlierConfig
+	if err := viper.UnmarshalKey(viperOutliers, &oc); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", viperOutliers, err)
+	}
+
+	action, err := outlier.ActionFromStr(oc.Action)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperOutliers, err)
+	}
+	cfg := &outlier.Config{Action: action, Limits: map[string]outlier.Limit{}}
+	for name, l := range oc.Limits {
+		action, err := outlier.ActionFromStr(l.Action)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s limit of %s: %w", viperOutliers, name, err)
+		}
+		cfg.Limits[name] = outlier.Limit{Min: l.Min, Max: l.Max, MaxRate: l.MaxRate, Action: action}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperOutliers, err)
+	}
+
+	return cfg, nil
+}
+
+// mqttFromConfig returns the MQTT publisher settings, or nil when the config
+// file has no mqtt section.
+func mqttFromConfig() (*mqtt.Config, error) {
+	if !viper.IsSet(viperMQTT) {
+		return nil, nil
+	}
+
+	var mc mqttConfig
+	if err := viper.UnmarshalKey(viperMQTT, &mc); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", viperMQTT, err)
+	}
+
+	cfg := mqtt.DefaultConfig()
+	cfg.Broker = mc.Broker
+	cfg.Username = mc.Username
+	cfg.Password = mc.Password
+	cfg.QoS = mc.QoS
+	cfg.Retain = mc.Retain
+	cfg.TLS = mc.TLS.client()
+	if mc.ClientID != "" {
+		cfg.ClientID = mc.ClientID
+	}
+	if mc.TopicPrefix != "" {
+		cfg.TopicPrefix = mc.TopicPrefix
+	}
+	if mc.DiscoveryPrefix != "" {
+		cfg.DiscoveryPrefix = mc.DiscoveryPrefix
+	}
+	if mc.DisableDiscovery {
+		cfg.DiscoveryPrefix = ""
+	}
+	if mc.ConnectTimeout != 0 {
+		cfg.ConnectTimeout = mc.ConnectTimeout
+	}
+	system, err := units.SystemFromStr(mc.Units)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperMQTT, err)
+	}
+	cfg.Units = system
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperMQTT, err)
+	}
+	return &cfg, nil
+}
+
+// influxFromConfig returns the InfluxDB writer settings, or nil when the
+// config file has no influxdb section.
+func influxFromConfig() (*influx.Config, error) {
+	if !viper.IsSet(viperInfluxDB) {
+		return nil, nil
+	}
+
+	var ic influxConfig
+	if err := viper.UnmarshalKey(viperInfluxDB, &ic); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", viperInfluxDB, err)
+	}
+
+	cfg := influx.DefaultConfig()
+	cfg.URL = ic.URL
+	cfg.Org = ic.Org
+	cfg.Bucket = ic.Bucket
+	cfg.Token = ic.Token
+	cfg.TLS = ic.TLS.client()
+	if ic.BatchSize != 0 {
+		cfg.BatchSize = ic.BatchSize
+	}
+	if ic.MaxPending != 0 {
+		cfg.MaxPending = ic.MaxPending
+	}
+	if ic.FlushInterval != 0 {
+		cfg.FlushInterval = ic.FlushInterval
+	}
+	if ic.Timeout != 0 {
+		cfg.Timeout = ic.Timeout
+	}
+	system, err := units.SystemFromStr(ic.Units)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperInfluxDB, err)
+	}
+	cfg.Units = system
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperInfluxDB, err)
+	}
+	return &cfg, nil
+}
+
+// relaysFromConfig builds the Weather Underground compatible services that
+// uploads are relayed to.
+func relaysFromConfig() ([]wunderground.Service, error) {
+	var configured []relayConfig
+	if err := viper.UnmarshalKey(viperRelays, &configured); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", viperRelays, err)
+	}
+
+	services := []wunderground.Service{}
+	for _, rc := range configured {
+		s := wunderground.Service{
+			Name:       rc.Name,
+			URL:        rc.URL,
+			StationID:  rc.StationID,
+			StationKey: rc.StationKey,
+			Passkey:    rc.Passkey,
+			Timeout:    rc.Timeout,
+		}
+		if s.URL == "" && rc.Service != "" {
+			url, ok := relayServiceURLs[strings.ToLower(rc.Service)]
+			if !ok {
+				return nil, fmt.Errorf("relay %q has unknown service %q", rc.Name, rc.Service)
+			}
+			s.URL = url
+		}
+		services = append(services, s)
+	}
+
+	if err := wunderground.ValidateServices(services); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperRelays, err)
+	}
+	return services, nil
+}
+
+// authFromConfig returns the authentication settings of the admin endpoints,
+// or nil when the config file has no auth section.
+func authFromConfig() (*controller.AuthConfig, error) {
+	if !viper.IsSet(viperAuth) {
+		return nil, nil
+	}
+
+	var ac authConfig
+	if err := viper.UnmarshalKey(viperAuth, &ac); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", viperAuth, err)
+	}
+
+	cfg := controller.AuthConfig{
+		BearerTokens: ac.BearerTokens,
+		ProxyHeader:  ac.ProxyHeader,
+	}
+	if len(ac.Basic) > 0 {
+		cfg.BasicUsers = make(map[string]string, len(ac.Basic))
+		for _, u := range ac.Basic {
+			if _, ok := cfg.BasicUsers[u.Username]; ok {
+				return nil, fmt.Errorf("invalid %s: duplicate basic user %q", viperAuth, u.Username)
+			}
+			cfg.BasicUsers[u.Username] = u.PasswordHash
+		}
+	}
+	proxies, err := parsePrefixes(ac.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s trusted_proxies: %w", viperAuth, err)
+	}
+	cfg.TrustedProxies = proxies
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperAuth, err)
+	}
+	return &cfg, nil
+}
+
+// allowlistFromConfig returns the ingest allowlist, or nil when the config
+// file has no ingest_allowlist section.
+func allowlistFromConfig() (*controller.IngestAllowlist, error) {
+	if !viper.IsSet(viperAllowlist) {
+		return nil, nil
+	}
+
+	var ac allowlistConfig
+	if err := viper.UnmarshalKey(viperAllowlist, &ac); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", viperAllowlist, err)
+	}
+
+	sources, err := parsePrefixes(ac.Sources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s sources: %w", viperAllowlist, err)
+	}
+	proxies, err := parsePrefixes(ac.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s trusted_proxies: %w", viperAllowlist, err)
+	}
+
+	cfg := controller.IngestAllowlist{
+		Sources:        sources,
+		TrustedProxies: proxies,
+		Passkeys:       ac.Passkeys,
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", viperAllowlist, err)
+	}
+	return &cfg, nil
+}
+
+// parsePrefixes parses a list of IP addresses and CIDR ranges. A single
+// address is a range of one.
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or range %q", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// adminTLSFromConfig returns the settings of the admin listener, or nil when
+// it is disabled.
+func adminTLSFromConfig() (*tlsconfig.Server, error) {
+	port := viper.GetInt(flagAdminPort)
+	if port == 0 {
+		return nil, nil
+	}
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid %s %d", flagAdminPort, port)
+	}
+	if port == viper.GetInt(viperListenPort) {
+		return nil, fmt.Errorf("%s must differ from the gateway port", flagAdminPort)
+	}
+
+	server := &tlsconfig.Server{
+		CertFile:     viper.GetString(flagAdminTLSCertFile),
+		KeyFile:      viper.GetString(flagAdminTLSKeyFile),
+		ClientCAFile: viper.GetString(flagAdminTLSClientCAFile),
+	}
+	if err := server.Validate(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// stationIDKeyFromConfig returns the key for station IDs and where it came
+// from: the configured key, or the contents of the key file, which is created
+// with a new key on first start.
+func stationIDKeyFromConfig() ([]byte, string, error) {
+	if key := viper.GetString(flagStationIDKey); key != "" {
+		return []byte(key), flagStationIDKey, nil
+	}
+
+	path, err := stationIDKeyPath()
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := redact.LoadKey(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("error loading station ID key, set %s or point %s at a writable "+
+			"location: %w", flagStationIDKey, flagStationIDKeyFile, err)
+	}
+	return key, path, nil
+}
+
+// stationIDKeyPath returns the station ID key file: the configured one, or
+// station_id.key in the queue directory, next to the config file or in the
+// user's config directory, in that order.
+func stationIDKeyPath() (string, error) {
+	if path := viper.GetString(flagStationIDKeyFile); path != "" {
+		return path, nil
+	}
+
+	dir := viper.GetString(flagQueueDir)
+	if dir == "" && viper.ConfigFileUsed() != "" {
+		dir = filepath.Dir(viper.ConfigFileUsed())
+	}
+	if dir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("no location for the station ID key, set %s or %s: %w",
+				flagStationIDKey, flagStationIDKeyFile, err)
+		}
+		dir = filepath.Join(configDir, "hass-ecowitt-proxy")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("error creating directory for the station ID key %q: %w", dir, err)
+	}
+	return filepath.Join(dir, stationIDKeyFile), nil
+}
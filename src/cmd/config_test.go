@@ -0,0 +1,59 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStationIDKeyFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("hass_url: http://127.0.0.1:1\n"), 0o600))
+	viper.SetConfigFile(file)
+	require.NoError(t, viper.ReadInConfig())
+	t.Cleanup(func() { viper.SetConfigFile("") })
+
+	// Without any configuration, the key is kept next to the config file and
+	// is the same on the next start.
+	key, source, err := stationIDKeyFromConfig()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, stationIDKeyFile), source)
+
+	again, _, err := stationIDKeyFromConfig()
+	require.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	// A key file that cannot be created fails startup.
+	viper.Set(flagStationIDKeyFile, filepath.Join(dir, "missing", "station_id.key"))
+	t.Cleanup(func() { viper.Set(flagStationIDKeyFile, "") })
+	_, _, err = stationIDKeyFromConfig()
+	assert.Error(t, err)
+
+	viper.Set(flagStationIDKey, "configured-station-key")
+	t.Cleanup(func() { viper.Set(flagStationIDKey, "") })
+	key, source, err = stationIDKeyFromConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("configured-station-key"), key)
+	assert.Equal(t, flagStationIDKey, source)
+}
@@ -10,10 +10,57 @@ const (
 	flagListenAddress = "listen_address"
 	flagListenPort    = "port"
 
+	flagShutdownTimeout = "shutdown_timeout"
+
+	flagAdminPort            = "admin_port"
+	flagAdminTLSCertFile     = "admin_tls_cert_file"
+	flagAdminTLSKeyFile      = "admin_tls_key_file"
+	flagAdminTLSClientCAFile = "admin_tls_client_ca_file"
+
 	flagHassUrl       = "hass_url"
 	flagHassAuthToken = "hass_auth_token"
 	flagHassWebhookId = "hass_webhook_id"
+	flagHassTimeout   = "hass_timeout"
+
+	flagHassTLSCAFile             = "hass_tls_ca_file"
+	flagHassTLSCertFile           = "hass_tls_cert_file"
+	flagHassTLSKeyFile            = "hass_tls_key_file"
+	flagHassTLSServerName         = "hass_tls_server_name"
+	flagHassTLSMinVersion         = "hass_tls_min_version"
+	flagHassTLSInsecureSkipVerify = "hass_tls_insecure_skip_verify"
+
+	flagHassRetryMaxAttempts = "hass_retry_max_attempts"
+	flagHassRetryBaseDelay   = "hass_retry_base_delay"
+	flagHassRetryMaxDelay    = "hass_retry_max_delay"
+	flagHassRetryJitter      = "hass_retry_jitter"
+	flagHassRetryStatusCodes = "hass_retry_status_codes"
+
+	flagAsync             = "async"
+	flagAsyncWorkers      = "async_workers"
+	flagAsyncQueueSize    = "async_queue_size"
+	flagAsyncBackpressure = "async_backpressure"
+
+	flagDerivedMetrics = "derived_metrics"
+
+	flagQueueDir           = "queue_dir"
+	flagQueueMaxSize       = "queue_max_size"
+	flagQueueMaxAge        = "queue_max_age"
+	flagQueueEviction      = "queue_eviction"
+	flagQueueRetryInterval = "queue_retry_interval"
+
+	flagStationIDKey     = "station_id_key"
+	flagStationIDKeyFile = "station_id_key_file"
 
 	viperListenAddress = "listen"
 	viperListenPort    = "port"
+	viperTargets       = "targets"
+	viperRouting       = "routing"
+	viperRewrite       = "rewrite"
+	viperCalibration   = "calibration"
+	viperOutliers      = "outliers"
+	viperMQTT          = "mqtt"
+	viperInfluxDB      = "influxdb"
+	viperRelays        = "relays"
+	viperAuth          = "auth"
+	viperAllowlist     = "ingest_allowlist"
 )
@@ -0,0 +1,150 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"hass-ecowitt-proxy/controller"
+	"hass-ecowitt-proxy/logging"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// configReloader re-reads the config file and applies the targets, routing,
+// rewrite rules, calibration and log level to the running controller. Other
+// settings need a restart. Reloads must only be triggered from run.
+type configReloader struct {
+	ctrl     *controller.Controller
+	logLevel zap.AtomicLevel
+	logger   *zap.SugaredLogger
+}
+
+func (r *configReloader) reload(reason string) {
+	r.logger.Infof("Reloading configuration: %s", reason)
+
+	var level logging.LogLevel
+	err := r.ctrl.Reload(func() (controller.ReloadConfig, error) {
+		if viper.ConfigFileUsed() != "" {
+			if err := viper.ReadInConfig(); err != nil {
+				return controller.ReloadConfig{}, fmt.Errorf("error reading config file: %w", err)
+			}
+		}
+
+		var err error
+		level, err = logging.LogLevelFromStr(viper.GetString(flagLogLevel))
+		if err != nil {
+			return controller.ReloadConfig{}, err
+		}
+
+		targets, err := targetsFromConfig()
+		if err != nil {
+			return controller.ReloadConfig{}, err
+		}
+		routing, err := routingFromConfig(targets)
+		if err != nil {
+			return controller.ReloadConfig{}, err
+		}
+
+		rewriter, err := rewriterFromConfig()
+		if err != nil {
+			return controller.ReloadConfig{}, err
+		}
+		rules, err := calibrationFromConfig()
+		if err != nil {
+			return controller.ReloadConfig{}, err
+		}
+
+		return controller.ReloadConfig{
+			Targets:     targets,
+			Routing:     routing,
+			Rewriter:    rewriter,
+			Calibration: rules,
+			LogLevel:    level,
+		}, nil
+	})
+	if err == nil {
+		r.logLevel.SetLevel(level.ToZap())
+	}
+}
+
+// watch reloads the configuration on SIGHUP and, when a config file is in
+// use, whenever the file changes. It returns when ctx is done.
+func (r *configReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	r.run(ctx, hup)
+}
+
+// run reloads the configuration for every signal on hup and every change of
+// the config file. Both are handled by this one goroutine because viper is
+// not safe for concurrent use; viper.WatchConfig is not used since it
+// re-reads the file on a goroutine of its own.
+func (r *configReloader) run(ctx context.Context, hup <-chan os.Signal) {
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+
+	file := viper.ConfigFileUsed()
+	if file != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			r.logger.Errorf("Not watching %s for changes: %s", file, err)
+		} else {
+			defer watcher.Close()
+
+			// Watch the directory rather than the file, so that editors
+			// that replace the file and symlinked config maps are noticed.
+			file = filepath.Clean(file)
+			if err := watcher.Add(filepath.Dir(file)); err != nil {
+				r.logger.Errorf("Not watching %s for changes: %s", file, err)
+			} else {
+				events, errs = watcher.Events, watcher.Errors
+				r.logger.Infof("Watching %s for changes to the reloadable settings", file)
+			}
+		}
+	}
+	realFile, _ := filepath.EvalSymlinks(file)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reload("received SIGHUP")
+		case e := <-events:
+			changed := filepath.Clean(e.Name) == file && (e.Has(fsnotify.Write) || e.Has(fsnotify.Create))
+			if target, _ := filepath.EvalSymlinks(file); target != "" && target != realFile {
+				realFile = target
+				changed = true
+			}
+			if changed {
+				r.reload(fmt.Sprintf("%s changed", file))
+			}
+		case err := <-errs:
+			r.logger.Warnf("Error watching %s for changes: %s", file, err)
+		}
+	}
+}
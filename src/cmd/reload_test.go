@@ -0,0 +1,97 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"hass-ecowitt-proxy/controller"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestConfigReloader(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+
+	// Written via rename, so that a reload never sees a half written file.
+	writeConfig := func(level string) {
+		t.Helper()
+		cfg := fmt.Sprintf("hass_url: http://127.0.0.1:1\nhass_auth_token: secret-auth-token\n"+
+			"hass_webhook_id: secret-webhook-id\n%s: %s\n", flagLogLevel, level)
+		tmp := filepath.Join(dir, "config.tmp")
+		require.NoError(t, os.WriteFile(tmp, []byte(cfg), 0o600))
+		require.NoError(t, os.Rename(tmp, file))
+	}
+
+	writeConfig("info")
+	viper.SetConfigFile(file)
+	require.NoError(t, viper.ReadInConfig())
+	t.Cleanup(func() { viper.SetConfigFile("") })
+
+	targets, err := targetsFromConfig()
+	require.NoError(t, err)
+
+	core, logs := observer.New(zap.DebugLevel)
+	logger := zap.New(core)
+	ctrl := controller.New("", "", "", logger, controller.WithTargets(targets...))
+	defer ctrl.Close()
+
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	r := &configReloader{ctrl: ctrl, logLevel: level, logger: logger.Sugar()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hup := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.run(ctx, hup)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	require.Eventually(t, func() bool {
+		return logs.FilterMessageSnippet("Watching").Len() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// SIGHUPs arriving while the file changes are reloaded one at a time.
+	// Run with -race to check that viper is never used concurrently.
+	for i := range 10 {
+		writeConfig([]string{"info", "warn"}[i%2])
+		hup <- syscall.SIGHUP
+	}
+	writeConfig("debug")
+
+	assert.Eventually(t, func() bool { return level.Level() == zapcore.DebugLevel },
+		5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 10, logs.FilterMessage("Reloading configuration: received SIGHUP").Len())
+	assert.GreaterOrEqual(t, ctrl.GetReloadStatus().Count, uint32(11))
+	assert.Equal(t, uint32(0), ctrl.GetReloadStatus().Failures)
+}
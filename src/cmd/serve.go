@@ -17,12 +17,22 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"html/template"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"hass-ecowitt-proxy/controller"
+	"hass-ecowitt-proxy/influx"
 	"hass-ecowitt-proxy/logging"
+	"hass-ecowitt-proxy/mqtt"
+	"hass-ecowitt-proxy/outlier"
+	"hass-ecowitt-proxy/queue"
+	"hass-ecowitt-proxy/redact"
+	"hass-ecowitt-proxy/wunderground"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -35,9 +45,54 @@ const (
 	envListenAddress = "ECOWITT_PROXY_ADDRESS"
 	envListenPort    = "ECOWITT_PROXY_PORT"
 
+	envShutdownTimeout = "ECOWITT_PROXY_SHUTDOWN_TIMEOUT"
+
+	envAdminPort            = "ECOWITT_PROXY_ADMIN_PORT"
+	envAdminTLSCertFile     = "ECOWITT_PROXY_ADMIN_TLS_CERT_FILE"
+	envAdminTLSKeyFile      = "ECOWITT_PROXY_ADMIN_TLS_KEY_FILE"
+	envAdminTLSClientCAFile = "ECOWITT_PROXY_ADMIN_TLS_CLIENT_CA_FILE"
+
 	envHassURL       = "ECOWITT_PROXY_HASS_URL"
 	envHassAuthToken = "ECOWITT_PROXY_HASS_AUTH_TOKEN"
 	envHassWebhookID = "ECOWITT_PROXY_HASS_WEBHOOK_ID"
+	envHassTimeout   = "ECOWITT_PROXY_HASS_TIMEOUT"
+
+	envHassTLSCAFile             = "ECOWITT_PROXY_HASS_TLS_CA_FILE"
+	envHassTLSCertFile           = "ECOWITT_PROXY_HASS_TLS_CERT_FILE"
+	envHassTLSKeyFile            = "ECOWITT_PROXY_HASS_TLS_KEY_FILE"
+	envHassTLSServerName         = "ECOWITT_PROXY_HASS_TLS_SERVER_NAME"
+	envHassTLSMinVersion         = "ECOWITT_PROXY_HASS_TLS_MIN_VERSION"
+	envHassTLSInsecureSkipVerify = "ECOWITT_PROXY_HASS_TLS_INSECURE_SKIP_VERIFY"
+
+	envHassRetryMaxAttempts = "ECOWITT_PROXY_HASS_RETRY_MAX_ATTEMPTS"
+	envHassRetryBaseDelay   = "ECOWITT_PROXY_HASS_RETRY_BASE_DELAY"
+	envHassRetryMaxDelay    = "ECOWITT_PROXY_HASS_RETRY_MAX_DELAY"
+	envHassRetryJitter      = "ECOWITT_PROXY_HASS_RETRY_JITTER"
+	envHassRetryStatusCodes = "ECOWITT_PROXY_HASS_RETRY_STATUS_CODES"
+
+	envAsync             = "ECOWITT_PROXY_ASYNC"
+	envAsyncWorkers      = "ECOWITT_PROXY_ASYNC_WORKERS"
+	envAsyncQueueSize    = "ECOWITT_PROXY_ASYNC_QUEUE_SIZE"
+	envAsyncBackpressure = "ECOWITT_PROXY_ASYNC_BACKPRESSURE"
+
+	envDerivedMetrics = "ECOWITT_PROXY_DERIVED_METRICS"
+
+	envQueueDir           = "ECOWITT_PROXY_QUEUE_DIR"
+	envQueueMaxSize       = "ECOWITT_PROXY_QUEUE_MAX_SIZE"
+	envQueueMaxAge        = "ECOWITT_PROXY_QUEUE_MAX_AGE"
+	envQueueEviction      = "ECOWITT_PROXY_QUEUE_EVICTION"
+	envQueueRetryInterval = "ECOWITT_PROXY_QUEUE_RETRY_INTERVAL"
+
+	envStationIDKey     = "ECOWITT_PROXY_STATION_ID_KEY"
+	envStationIDKeyFile = "ECOWITT_PROXY_STATION_ID_KEY_FILE"
+
+	// stationIDKeyFile is the name of the key file created when neither a
+	// key nor a key file is configured.
+	stationIDKeyFile = "station_id.key"
+
+	defaultShutdownTimeout    = 30 * time.Second
+	defaultHassTimeout        = 30 * time.Second
+	defaultQueueRetryInterval = 30 * time.Second
 )
 
 // serveCmd represents the serve command
@@ -45,7 +100,12 @@ var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Listen for HTTP messages",
 	Long: `Start server mode to listen for incoming HTTP messages. Does not
-exit until it receives a SIGTERM.`,
+exit until it receives a SIGTERM or SIGINT. It then stops accepting uploads
+and waits up to shutdown_timeout for pending deliveries before exiting.
+
+Targets, routing, rewrite rules, calibration and the log level are
+reloaded when the config file changes or on SIGHUP. Other settings require a
+restart.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return runServeCmd(cmd, args)
 	},
@@ -62,6 +122,34 @@ func init() {
 	viper.BindPFlag(viperListenPort, serveCmd.Flags().Lookup(flagListenPort))
 	viper.BindEnv(viperListenPort, "SERVER_PORT", envListenPort)
 
+	serveCmd.Flags().Duration(flagShutdownTimeout, defaultShutdownTimeout, fmt.Sprintf("How long to wait "+
+		"for pending deliveries on shutdown. Queued uploads that are still pending are kept for the next "+
+		"start. (%s)", envShutdownTimeout))
+	viper.BindPFlag(flagShutdownTimeout, serveCmd.Flags().Lookup(flagShutdownTimeout))
+	viper.BindEnv(flagShutdownTimeout, envShutdownTimeout)
+
+	serveCmd.Flags().Int(flagAdminPort, 0, fmt.Sprintf("TCP port for the HTTPS admin listener serving "+
+		"/status and /metrics. When set, those endpoints are no longer served on the gateway port. 0 "+
+		"disables the admin listener. (%s)", envAdminPort))
+	viper.BindPFlag(flagAdminPort, serveCmd.Flags().Lookup(flagAdminPort))
+	viper.BindEnv(flagAdminPort, envAdminPort)
+
+	serveCmd.Flags().String(flagAdminTLSCertFile, "", fmt.Sprintf("Certificate file for the admin "+
+		"listener. Reloaded when it changes. (%s)", envAdminTLSCertFile))
+	viper.BindPFlag(flagAdminTLSCertFile, serveCmd.Flags().Lookup(flagAdminTLSCertFile))
+	viper.BindEnv(flagAdminTLSCertFile, envAdminTLSCertFile)
+
+	serveCmd.Flags().String(flagAdminTLSKeyFile, "", fmt.Sprintf("Key file for the admin listener. "+
+		"Reloaded when it changes. (%s)", envAdminTLSKeyFile))
+	viper.BindPFlag(flagAdminTLSKeyFile, serveCmd.Flags().Lookup(flagAdminTLSKeyFile))
+	viper.BindEnv(flagAdminTLSKeyFile, envAdminTLSKeyFile)
+
+	serveCmd.Flags().String(flagAdminTLSClientCAFile, "", fmt.Sprintf("CA bundle for client certificates. "+
+		"When set, clients of the admin listener must present a certificate signed by one of these CAs. "+
+		"(%s)", envAdminTLSClientCAFile))
+	viper.BindPFlag(flagAdminTLSClientCAFile, serveCmd.Flags().Lookup(flagAdminTLSClientCAFile))
+	viper.BindEnv(flagAdminTLSClientCAFile, envAdminTLSClientCAFile)
+
 	serveCmd.Flags().StringP(flagHassUrl, "u", "", fmt.Sprintf("Base URL for Home Assistant. (%s)", envHassURL))
 	viper.BindPFlag(flagHassUrl, serveCmd.Flags().Lookup(flagHassUrl))
 	viper.BindEnv(flagHassUrl, "HASS_URL", envHassURL)
@@ -76,24 +164,197 @@ func init() {
 	viper.BindPFlag(flagHassWebhookId, serveCmd.Flags().Lookup(flagHassWebhookId))
 	viper.BindEnv(flagHassWebhookId, "HASS_WEBHOOK_ID", envHassWebhookID)
 
+	serveCmd.Flags().Duration(flagHassTimeout, defaultHassTimeout, fmt.Sprintf("Timeout for delivering "+
+		"each upload to Home Assistant, including retries. 0 means no timeout. (%s)", envHassTimeout))
+	viper.BindPFlag(flagHassTimeout, serveCmd.Flags().Lookup(flagHassTimeout))
+	viper.BindEnv(flagHassTimeout, envHassTimeout)
+
+	serveCmd.Flags().String(flagHassTLSCAFile, "", fmt.Sprintf("PEM bundle of certificate authorities "+
+		"trusted for Home Assistant in addition to the system roots. (%s)", envHassTLSCAFile))
+	viper.BindPFlag(flagHassTLSCAFile, serveCmd.Flags().Lookup(flagHassTLSCAFile))
+	viper.BindEnv(flagHassTLSCAFile, envHassTLSCAFile)
+
+	serveCmd.Flags().String(flagHassTLSCertFile, "", fmt.Sprintf("Client certificate presented to "+
+		"Home Assistant. (%s)", envHassTLSCertFile))
+	viper.BindPFlag(flagHassTLSCertFile, serveCmd.Flags().Lookup(flagHassTLSCertFile))
+	viper.BindEnv(flagHassTLSCertFile, envHassTLSCertFile)
+
+	serveCmd.Flags().String(flagHassTLSKeyFile, "", fmt.Sprintf("Key of the client certificate "+
+		"presented to Home Assistant. (%s)", envHassTLSKeyFile))
+	viper.BindPFlag(flagHassTLSKeyFile, serveCmd.Flags().Lookup(flagHassTLSKeyFile))
+	viper.BindEnv(flagHassTLSKeyFile, envHassTLSKeyFile)
+
+	serveCmd.Flags().String(flagHassTLSServerName, "", fmt.Sprintf("Server name used for SNI and "+
+		"certificate verification instead of the host in hass_url. (%s)", envHassTLSServerName))
+	viper.BindPFlag(flagHassTLSServerName, serveCmd.Flags().Lookup(flagHassTLSServerName))
+	viper.BindEnv(flagHassTLSServerName, envHassTLSServerName)
+
+	serveCmd.Flags().String(flagHassTLSMinVersion, "", fmt.Sprintf("Minimum TLS version for Home "+
+		"Assistant. One of: 1.0, 1.1, 1.2, 1.3 (%s)", envHassTLSMinVersion))
+	viper.BindPFlag(flagHassTLSMinVersion, serveCmd.Flags().Lookup(flagHassTLSMinVersion))
+	viper.BindEnv(flagHassTLSMinVersion, envHassTLSMinVersion)
+
+	serveCmd.Flags().Bool(flagHassTLSInsecureSkipVerify, false, fmt.Sprintf("Do not verify the "+
+		"certificate of Home Assistant. Insecure, only use it for testing. (%s)", envHassTLSInsecureSkipVerify))
+	viper.BindPFlag(flagHassTLSInsecureSkipVerify, serveCmd.Flags().Lookup(flagHassTLSInsecureSkipVerify))
+	viper.BindEnv(flagHassTLSInsecureSkipVerify, envHassTLSInsecureSkipVerify)
+
+	defaultRetry := controller.DefaultRetryPolicy()
+
+	serveCmd.Flags().Int(flagHassRetryMaxAttempts, defaultRetry.MaxAttempts, fmt.Sprintf("Maximum number "+
+		"of attempts to deliver each upload to Home Assistant, including the first. (%s)", envHassRetryMaxAttempts))
+	viper.BindPFlag(flagHassRetryMaxAttempts, serveCmd.Flags().Lookup(flagHassRetryMaxAttempts))
+	viper.BindEnv(flagHassRetryMaxAttempts, envHassRetryMaxAttempts)
+
+	serveCmd.Flags().Duration(flagHassRetryBaseDelay, defaultRetry.BaseDelay, fmt.Sprintf("Delay before the "+
+		"first retry. Doubles for each following retry. (%s)", envHassRetryBaseDelay))
+	viper.BindPFlag(flagHassRetryBaseDelay, serveCmd.Flags().Lookup(flagHassRetryBaseDelay))
+	viper.BindEnv(flagHassRetryBaseDelay, envHassRetryBaseDelay)
+
+	serveCmd.Flags().Duration(flagHassRetryMaxDelay, defaultRetry.MaxDelay, fmt.Sprintf("Maximum delay "+
+		"between retries, including delays requested via Retry-After. (%s)", envHassRetryMaxDelay))
+	viper.BindPFlag(flagHassRetryMaxDelay, serveCmd.Flags().Lookup(flagHassRetryMaxDelay))
+	viper.BindEnv(flagHassRetryMaxDelay, envHassRetryMaxDelay)
+
+	serveCmd.Flags().Float64(flagHassRetryJitter, defaultRetry.Jitter, fmt.Sprintf("Fraction of each retry "+
+		"delay to randomize, between 0 and 1. (%s)", envHassRetryJitter))
+	viper.BindPFlag(flagHassRetryJitter, serveCmd.Flags().Lookup(flagHassRetryJitter))
+	viper.BindEnv(flagHassRetryJitter, envHassRetryJitter)
+
+	serveCmd.Flags().IntSlice(flagHassRetryStatusCodes, defaultRetry.RetryableStatusCodes, fmt.Sprintf(
+		"HTTP status codes from Home Assistant that are retried. (%s)", envHassRetryStatusCodes))
+	viper.BindPFlag(flagHassRetryStatusCodes, serveCmd.Flags().Lookup(flagHassRetryStatusCodes))
+	viper.BindEnv(flagHassRetryStatusCodes, envHassRetryStatusCodes)
+
+	defaultAsync := controller.DefaultAsyncConfig()
+
+	serveCmd.Flags().Bool(flagAsync, false, fmt.Sprintf("Reply to gateways immediately and deliver uploads "+
+		"to Home Assistant in the background. (%s)", envAsync))
+	viper.BindPFlag(flagAsync, serveCmd.Flags().Lookup(flagAsync))
+	viper.BindEnv(flagAsync, envAsync)
+
+	serveCmd.Flags().Int(flagAsyncWorkers, defaultAsync.Workers, fmt.Sprintf("Number of background "+
+		"delivery workers in async mode. (%s)", envAsyncWorkers))
+	viper.BindPFlag(flagAsyncWorkers, serveCmd.Flags().Lookup(flagAsyncWorkers))
+	viper.BindEnv(flagAsyncWorkers, envAsyncWorkers)
+
+	serveCmd.Flags().Int(flagAsyncQueueSize, defaultAsync.QueueSize, fmt.Sprintf("Number of uploads that "+
+		"may wait for a worker in async mode. (%s)", envAsyncQueueSize))
+	viper.BindPFlag(flagAsyncQueueSize, serveCmd.Flags().Lookup(flagAsyncQueueSize))
+	viper.BindEnv(flagAsyncQueueSize, envAsyncQueueSize)
+
+	serveCmd.Flags().String(flagAsyncBackpressure, defaultAsync.Backpressure.String(), fmt.Sprintf(
+		"What to do when all async workers are busy and the queue is full. One of: %s (%s)",
+		strings.Join(controller.BackpressurePolicyNames(), ", "), envAsyncBackpressure))
+	viper.BindPFlag(flagAsyncBackpressure, serveCmd.Flags().Lookup(flagAsyncBackpressure))
+	viper.BindEnv(flagAsyncBackpressure, envAsyncBackpressure)
+
+	serveCmd.Flags().String(flagDerivedMetrics, controller.DerivedMetricsOff.String(), fmt.Sprintf(
+		"Compute dew point, heat index, wind chill, feels-like temperature, absolute humidity and vapor "+
+			"pressure deficit for every upload. \"sinks\" adds them for MQTT, InfluxDB, relays and metrics "+
+			"only, \"all\" also forwards them to Home Assistant. One of: %s (%s)",
+		strings.Join(controller.DerivedMetricsModeNames(), ", "), envDerivedMetrics))
+	viper.BindPFlag(flagDerivedMetrics, serveCmd.Flags().Lookup(flagDerivedMetrics))
+	viper.BindEnv(flagDerivedMetrics, envDerivedMetrics)
+
+	serveCmd.Flags().String(flagQueueDir, "", fmt.Sprintf("Directory for the durable forward queue. "+
+		"Uploads that cannot be delivered to Home Assistant are stored here and retried. Disabled when "+
+		"empty. (%s)", envQueueDir))
+	viper.BindPFlag(flagQueueDir, serveCmd.Flags().Lookup(flagQueueDir))
+	viper.BindEnv(flagQueueDir, envQueueDir)
+
+	serveCmd.Flags().Int(flagQueueMaxSize, queue.DefaultMaxSize, fmt.Sprintf("Maximum number of queued "+
+		"uploads. 0 means unbounded. (%s)", envQueueMaxSize))
+	viper.BindPFlag(flagQueueMaxSize, serveCmd.Flags().Lookup(flagQueueMaxSize))
+	viper.BindEnv(flagQueueMaxSize, envQueueMaxSize)
+
+	serveCmd.Flags().Duration(flagQueueMaxAge, queue.DefaultMaxAge, fmt.Sprintf("Maximum time an upload "+
+		"may wait in the queue before it is discarded. 0 disables expiry. (%s)", envQueueMaxAge))
+	viper.BindPFlag(flagQueueMaxAge, serveCmd.Flags().Lookup(flagQueueMaxAge))
+	viper.BindEnv(flagQueueMaxAge, envQueueMaxAge)
+
+	serveCmd.Flags().String(flagQueueEviction, queue.DropOldest.String(), fmt.Sprintf("What to do when "+
+		"the queue is full. One of: %s (%s)", strings.Join(queue.EvictionPolicyNames(), ", "), envQueueEviction))
+	viper.BindPFlag(flagQueueEviction, serveCmd.Flags().Lookup(flagQueueEviction))
+	viper.BindEnv(flagQueueEviction, envQueueEviction)
+
+	serveCmd.Flags().Duration(flagQueueRetryInterval, defaultQueueRetryInterval, fmt.Sprintf("How often "+
+		"to retry delivering queued uploads. (%s)", envQueueRetryInterval))
+	viper.BindPFlag(flagQueueRetryInterval, serveCmd.Flags().Lookup(flagQueueRetryInterval))
+	viper.BindEnv(flagQueueRetryInterval, envQueueRetryInterval)
+
+	serveCmd.Flags().String(flagStationIDKey, "", fmt.Sprintf("Secret that keys the station IDs derived "+
+		"from PASSKEYs for logs, metrics, MQTT topics and InfluxDB tags. At least %d characters. (%s)",
+		redact.MinKeyLen, envStationIDKey))
+	viper.BindPFlag(flagStationIDKey, serveCmd.Flags().Lookup(flagStationIDKey))
+	viper.BindEnv(flagStationIDKey, envStationIDKey)
+
+	serveCmd.Flags().String(flagStationIDKeyFile, "", fmt.Sprintf("File holding the %s. Created with a "+
+		"random key if it does not exist. Defaults to %s in %s, next to the config file or in the user's "+
+		"config directory. (%s)", flagStationIDKey, stationIDKeyFile, flagQueueDir, envStationIDKeyFile))
+	viper.BindPFlag(flagStationIDKeyFile, serveCmd.Flags().Lookup(flagStationIDKeyFile))
+	viper.BindEnv(flagStationIDKeyFile, envStationIDKeyFile)
+
 	serveCmd.PreRunE = func(cmd *cobra.Command, args []string) error {
-		hassURL := viper.GetString(flagHassUrl)
-		hassAuthToken := viper.GetString(flagHassAuthToken)
-		hassWebhookID := viper.GetString(flagHassWebhookId)
+		targets, err := targetsFromConfig()
+		if err != nil {
+			return err
+		}
+		if _, err := routingFromConfig(targets); err != nil {
+			return err
+		}
+		if _, err := rewriterFromConfig(); err != nil {
+			return err
+		}
+		if _, err := calibrationFromConfig(); err != nil {
+			return err
+		}
+		if _, err := outlierFromConfig(); err != nil {
+			return err
+		}
+		if _, err := mqttFromConfig(); err != nil {
+			return err
+		}
+		if _, err := influxFromConfig(); err != nil {
+			return err
+		}
+		if _, err := relaysFromConfig(); err != nil {
+			return err
+		}
+
+		if _, err := adminTLSFromConfig(); err != nil {
+			return err
+		}
+		if _, err := authFromConfig(); err != nil {
+			return err
+		}
+		if _, err := allowlistFromConfig(); err != nil {
+			return err
+		}
 
-		missingOptions := []string{}
-		if hassURL == "" {
-			missingOptions = append(missingOptions, flagHassUrl)
+		if err := retryPolicyFromConfig().Validate(); err != nil {
+			return err
 		}
-		if hassAuthToken == "" {
-			missingOptions = append(missingOptions, flagHassAuthToken)
+
+		if _, err := controller.BackpressurePolicyFromStr(viper.GetString(flagAsyncBackpressure)); err != nil {
+			return err
 		}
-		if hassWebhookID == "" {
-			missingOptions = append(missingOptions, flagHassWebhookId)
+
+		if _, err := controller.DerivedMetricsModeFromStr(viper.GetString(flagDerivedMetrics)); err != nil {
+			return err
 		}
 
-		if len(missingOptions) > 0 {
-			return fmt.Errorf("missing required config options: %s", strings.Join(missingOptions, ", "))
+		if _, err := queue.EvictionPolicyFromStr(viper.GetString(flagQueueEviction)); err != nil {
+			return err
+		}
+		if viper.GetDuration(flagQueueRetryInterval) <= 0 {
+			return fmt.Errorf("%s must be positive", flagQueueRetryInterval)
+		}
+		if viper.GetDuration(flagShutdownTimeout) <= 0 {
+			return fmt.Errorf("%s must be positive", flagShutdownTimeout)
+		}
+		if key := viper.GetString(flagStationIDKey); key != "" && len(key) < redact.MinKeyLen {
+			return fmt.Errorf("%s must be at least %d characters long", flagStationIDKey, redact.MinKeyLen)
 		}
 
 		return nil
@@ -107,10 +368,12 @@ func runServeCmd(_ *cobra.Command, _ []string) error {
 		return fmt.Errorf("error running serve command: %w", err)
 	}
 
-	// Setup Zap logging
+	// Setup Zap logging. Secrets are registered with the redactor as they
+	// become known and never show up in the logs.
+	redactor := redact.New()
 	logConfig := zap.NewDevelopmentConfig()
 	logConfig.Level = zap.NewAtomicLevelAt(logLevel.ToZap())
-	logger, err := logConfig.Build()
+	logger, err := logConfig.Build(zap.WrapCore(redactor.Core))
 	if err != nil {
 		return fmt.Errorf("failed to create Zap logger: %w", err)
 	}
@@ -119,17 +382,244 @@ func runServeCmd(_ *cobra.Command, _ []string) error {
 	zapUndoRedirect := zap.RedirectStdLog(logger)
 	defer zapUndoRedirect()
 
-	hassURL := viper.GetString(flagHassUrl)
-	hassAuthToken := viper.GetString(flagHassAuthToken)
-	hassWebhookID := viper.GetString(flagHassWebhookId)
+	// Station IDs must be keyed before the first upload is logged. They name
+	// MQTT topics and entities, metric series and InfluxDB tags, so the key
+	// has to stay the same across restarts.
+	stationKey, keySource, err := stationIDKeyFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	redactor.AddToken(string(stationKey))
+	if err := redact.SetKey(stationKey); err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	logger.Sugar().Infof("Station IDs are keyed with %s", keySource)
+
+	targets, err := targetsFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+
+	for _, t := range targets {
+		if t.TLS.InsecureSkipVerify {
+			logger.Sugar().Warnf("Certificate verification is disabled for target %s", t.Name)
+		}
+	}
+
+	routing, err := routingFromConfig(targets)
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
 
-	ctrl := controller.New(hassURL, hassAuthToken, hassWebhookID, logger,
+	opts := []controller.Option{
+		controller.WithTargets(targets...),
+		controller.WithRouting(routing),
 		controller.WithLogLevel(logLevel),
-		controller.WithTemplates(template.Must(template.ParseGlob("html/*.html"))))
-	defer ctrl.Close()
+		controller.WithRedactor(redactor),
+		controller.WithTemplates(template.Must(template.ParseGlob("html/*.html"))),
+		controller.WithForwardRetryPolicy(retryPolicyFromConfig()),
+	}
+
+	rewriter, err := rewriterFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	if rewriter != nil {
+		opts = append(opts, controller.WithRewriter(rewriter))
+	}
+
+	rules, err := calibrationFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	if len(rules) > 0 {
+		logger.Sugar().Infof("Calibrating %d readings", len(rules))
+		opts = append(opts, controller.WithCalibration(rules))
+	}
+
+	outlierConfig, err := outlierFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	if outlierConfig != nil {
+		outlierConfig.MaxStations = controller.MaxStations
+		filter, err := outlier.New(*outlierConfig)
+		if err != nil {
+			return fmt.Errorf("error running serve command: %w", err)
+		}
+		logger.Sugar().Infof("Filtering outliers with %d configured limits", len(outlierConfig.Limits))
+		opts = append(opts, controller.WithOutlierFilter(filter))
+	}
+
+	derivedMetrics, err := controller.DerivedMetricsModeFromStr(viper.GetString(flagDerivedMetrics))
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	if derivedMetrics != controller.DerivedMetricsOff {
+		logger.Sugar().Infof("Computing derived readings (%s=%s)", flagDerivedMetrics, derivedMetrics)
+		opts = append(opts, controller.WithDerivedMetrics(derivedMetrics))
+	}
+
+	if viper.GetBool(flagAsync) {
+		backpressure, err := controller.BackpressurePolicyFromStr(viper.GetString(flagAsyncBackpressure))
+		if err != nil {
+			return fmt.Errorf("error running serve command: %w", err)
+		}
+
+		opts = append(opts, controller.WithAsync(controller.AsyncConfig{
+			Workers:      viper.GetInt(flagAsyncWorkers),
+			QueueSize:    viper.GetInt(flagAsyncQueueSize),
+			Backpressure: backpressure,
+		}))
+	}
+
+	if queueDir := viper.GetString(flagQueueDir); queueDir != "" {
+		eviction, err := queue.EvictionPolicyFromStr(viper.GetString(flagQueueEviction))
+		if err != nil {
+			return fmt.Errorf("error running serve command: %w", err)
+		}
+
+		q, err := queue.Open(queueDir,
+			queue.WithMaxSize(viper.GetInt(flagQueueMaxSize)),
+			queue.WithMaxAge(viper.GetDuration(flagQueueMaxAge)),
+			queue.WithEvictionPolicy(eviction))
+		if err != nil {
+			return fmt.Errorf("failed to open forward queue: %w", err)
+		}
+		defer q.Close()
+
+		logger.Sugar().Infof("Forward queue enabled in %s with %d pending uploads", queueDir, q.Len())
+		opts = append(opts,
+			controller.WithQueue(q),
+			controller.WithDrainInterval(viper.GetDuration(flagQueueRetryInterval)))
+	}
+
+	mqttConfig, err := mqttFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	if mqttConfig != nil {
+		redactor.AddToken(mqttConfig.Password)
+		publisher, err := mqtt.New(*mqttConfig, mqtt.WithLogger(logger.Sugar()))
+		if err != nil {
+			return fmt.Errorf("failed to connect to MQTT broker: %w", err)
+		}
+		defer publisher.Close()
+
+		logger.Sugar().Infof("Publishing uploads to MQTT broker %s", mqttConfig.Broker)
+		opts = append(opts, controller.WithSinks(publisher))
+	}
+
+	influxConfig, err := influxFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	if influxConfig != nil {
+		redactor.AddToken(influxConfig.Token)
+		writer, err := influx.New(*influxConfig, influx.WithLogger(logger.Sugar()))
+		if err != nil {
+			return fmt.Errorf("failed to set up InfluxDB writer: %w", err)
+		}
+		defer writer.Close()
+
+		logger.Sugar().Infof("Writing uploads to InfluxDB bucket %s at %s", influxConfig.Bucket, influxConfig.URL)
+		opts = append(opts, controller.WithSinks(writer))
+	}
+
+	services, err := relaysFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	for _, service := range services {
+		redactor.AddToken(service.StationKey)
+		redactor.AddPasskey(service.Passkey)
+		relay, err := wunderground.NewRelay(service)
+		if err != nil {
+			return fmt.Errorf("error running serve command: %w", err)
+		}
+
+		logger.Sugar().Infof("Relaying uploads to %s as station %s", service.Name, service.StationID)
+		opts = append(opts, controller.WithSinks(relay))
+	}
 
 	serveAddress := viper.GetString(viperListenAddress)
+
+	adminTLS, err := adminTLSFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	if adminTLS != nil {
+		tlsConfig, err := adminTLS.Config(func(err error) {
+			logger.Sugar().Errorf("Keeping the previous admin certificate: %s", err)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set up admin listener: %w", err)
+		}
+
+		adminAddr := fmt.Sprintf("%s:%d", serveAddress, viper.GetInt(flagAdminPort))
+		logger.Sugar().Infof("Serving /status and /metrics over HTTPS on %s", adminAddr)
+		opts = append(opts, controller.WithAdminListener(adminAddr, tlsConfig))
+	}
+
+	auth, err := authFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	if auth != nil {
+		redactor.AddToken(auth.BearerTokens...)
+		logger.Sugar().Info("Authentication required for /status, /metrics and /rewrite/dry-run")
+		opts = append(opts, controller.WithAuth(*auth))
+	}
+
+	allowlist, err := allowlistFromConfig()
+	if err != nil {
+		return fmt.Errorf("error running serve command: %w", err)
+	}
+	if allowlist != nil {
+		for _, passkey := range allowlist.Passkeys {
+			redactor.AddPasskey(passkey)
+		}
+		logger.Sugar().Infof("Ingest allowlist enabled with %d sources and %d stations",
+			len(allowlist.Sources), len(allowlist.Passkeys))
+		opts = append(opts, controller.WithIngestAllowlist(*allowlist))
+	}
+
+	ctrl := controller.New("", "", "", logger, opts...)
+	defer ctrl.Close()
+
 	servePort := viper.GetInt(viperListenPort)
 	addr := fmt.Sprintf("%s:%d", serveAddress, servePort)
-	return ctrl.Serve(addr)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	reloader := &configReloader{ctrl: ctrl, logLevel: logConfig.Level, logger: logger.Sugar()}
+	go reloader.watch(ctx)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ctrl.Serve(addr)
+	}()
+
+	select {
+	case err := <-served:
+		return fmt.Errorf("error running serve command: %w", err)
+	case <-ctx.Done():
+	}
+
+	// A second signal terminates immediately.
+	stop()
+
+	timeout := viper.GetDuration(flagShutdownTimeout)
+	logger.Sugar().Infof("Shutting down, waiting up to %s for pending deliveries", timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ctrl.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("unclean shutdown: %w", err)
+	}
+	<-served
+
+	logger.Sugar().Info("Shutdown complete")
+	return nil
 }
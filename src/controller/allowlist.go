@@ -0,0 +1,140 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Reasons an upload is denied by the ingest allowlist.
+const (
+	DenySource  = "source"
+	DenyPasskey = "passkey"
+)
+
+// IngestAllowlist limits who may upload. Denied uploads get a 403 and are
+// counted separately from rejected uploads and delivery errors.
+type IngestAllowlist struct {
+	// Sources are the addresses and ranges uploads are accepted from. Empty
+	// accepts any source.
+	Sources []netip.Prefix
+	// TrustedProxies may report the client address in X-Forwarded-For. The
+	// client is the rightmost address in the header that is not a trusted
+	// proxy itself.
+	TrustedProxies []netip.Prefix
+	// Passkeys are the stations uploads are accepted from, compared
+	// case-insensitively. Weather Underground uploads are matched by station
+	// ID and Ambient Weather uploads by MAC address. Empty accepts any
+	// station.
+	Passkeys []string
+}
+
+func (a IngestAllowlist) Validate() error {
+	if len(a.Sources) == 0 && len(a.Passkeys) == 0 {
+		return errors.New("ingest allowlist needs sources or passkeys")
+	}
+	if len(a.TrustedProxies) > 0 && len(a.Sources) == 0 {
+		return errors.New("ingest allowlist trusted proxies need sources")
+	}
+	if slices.Contains(a.Passkeys, "") {
+		return errors.New("ingest allowlist passkeys may not be empty")
+	}
+	return nil
+}
+
+// WithIngestAllowlist only accepts uploads from the sources and stations in
+// the allowlist.
+func WithIngestAllowlist(a IngestAllowlist) Option {
+	return func(c *Controller) {
+		c.allowlist = &a
+	}
+}
+
+// clientAddr returns the address of the client that sent req, following
+// X-Forwarded-For through trusted proxies.
+func (a *IngestAllowlist) clientAddr(req *http.Request) netip.Addr {
+	addr := remoteAddr(req)
+	if !containsAddr(a.TrustedProxies, addr) {
+		return addr
+	}
+
+	hops := []string{}
+	for _, h := range req.Header.Values(echo.HeaderXForwardedFor) {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// A proxy we trust would not have written this; stop at the
+			// last address we know.
+			return addr
+		}
+		addr = hop.Unmap()
+		if !containsAddr(a.TrustedProxies, addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+func (a *IngestAllowlist) allowsPasskey(passkey string) bool {
+	if len(a.Passkeys) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(a.Passkeys, func(p string) bool {
+		return strings.EqualFold(p, passkey)
+	})
+}
+
+// allowSources is the echo middleware of the ingest routes that enforces the
+// source part of the allowlist.
+func (c *Controller) allowSources(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if c.allowlist == nil || len(c.allowlist.Sources) == 0 {
+			return next(ctx)
+		}
+
+		addr := c.allowlist.clientAddr(ctx.Request())
+		if containsAddr(c.allowlist.Sources, addr) {
+			return next(ctx)
+		}
+		c.deny(DenySource)
+		ctx.Logger().Warnf("Denying upload from %s: source not allowed", addr)
+		return ctx.JSON(http.StatusForbidden, c.NewErrorResponse("Upload denied", errors.New("source not allowed")))
+	}
+}
+
+func (c *Controller) deny(reason string) {
+	switch reason {
+	case DenySource:
+		c.deniedSource.Add(1)
+	case DenyPasskey:
+		c.deniedPasskey.Add(1)
+	}
+}
+
+// GetDeniedCount returns the number of uploads refused by the ingest
+// allowlist.
+func (c *Controller) GetDeniedCount() uint32 {
+	return c.deniedSource.Load() + c.deniedPasskey.Load()
+}
@@ -0,0 +1,246 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	errAsyncFull   = errors.New("asynchronous delivery queue is full")
+	errAsyncClosed = errors.New("asynchronous delivery is shutting down")
+)
+
+type BackpressurePolicy uint8
+
+const (
+	// DropOldestPolicy discards the oldest pending upload to make room.
+	DropOldestPolicy BackpressurePolicy = iota
+	// DropNewestPolicy rejects the incoming upload.
+	DropNewestPolicy
+	// BlockPolicy makes the handler wait until a worker frees up a slot.
+	BlockPolicy
+	InvalidBackpressurePolicy
+)
+
+var backpressurePolicyNames = map[BackpressurePolicy]string{
+	DropOldestPolicy: "drop_oldest",
+	DropNewestPolicy: "drop_newest",
+	BlockPolicy:      "block",
+}
+
+func (p BackpressurePolicy) String() string {
+	return backpressurePolicyNames[p]
+}
+
+func BackpressurePolicyNames() []string {
+	return []string{DropOldestPolicy.String(), DropNewestPolicy.String(), BlockPolicy.String()}
+}
+
+func BackpressurePolicyFromStr(name string) (BackpressurePolicy, error) {
+	switch strings.ToLower(name) {
+	case "drop_oldest":
+		return DropOldestPolicy, nil
+	case "drop_newest":
+		return DropNewestPolicy, nil
+	case "block":
+		return BlockPolicy, nil
+	default:
+		return InvalidBackpressurePolicy, fmt.Errorf("invalid backpressure policy %q", name)
+	}
+}
+
+// AsyncConfig configures asynchronous forwarding, where HandleEventPost
+// replies to the gateway immediately and a pool of workers delivers the
+// upload in the background.
+type AsyncConfig struct {
+	Workers      int
+	QueueSize    int
+	Backpressure BackpressurePolicy
+}
+
+func DefaultAsyncConfig() AsyncConfig {
+	return AsyncConfig{
+		Workers:      2,
+		QueueSize:    100,
+		Backpressure: DropOldestPolicy,
+	}
+}
+
+// WithAsync enables asynchronous forwarding.
+func WithAsync(cfg AsyncConfig) Option {
+	return func(c *Controller) {
+		c.asyncConfig = &cfg
+	}
+}
+
+type asyncJob struct {
+	targets    []*target
+	receivedAt time.Time
+	values     url.Values
+}
+
+// targetNames lists the targets of the job for log messages.
+func (j asyncJob) targetNames() string {
+	names := make([]string, len(j.targets))
+	for i, t := range j.targets {
+		names[i] = strconv.Quote(t.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+type asyncForwarder struct {
+	cfg    AsyncConfig
+	jobs   chan asyncJob
+	logger *zap.SugaredLogger
+
+	// mu guards closed and, together with it, sends on jobs so that the
+	// channel is never closed while a submitter is sending.
+	mu     sync.RWMutex
+	closed bool
+
+	// dropped counts uploads discarded because the queue was full or the
+	// controller was closed before they were delivered.
+	dropped atomic.Uint32
+
+	// wg tracks the workers.
+	wg sync.WaitGroup
+}
+
+func newAsyncForwarder(cfg AsyncConfig, logger *zap.SugaredLogger) *asyncForwarder {
+	return &asyncForwarder{
+		cfg:    cfg,
+		jobs:   make(chan asyncJob, max(cfg.QueueSize, 1)),
+		logger: logger,
+	}
+}
+
+func (a *asyncForwarder) submit(ctx context.Context, job asyncJob) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		return errAsyncClosed
+	}
+
+	switch a.cfg.Backpressure {
+	case BlockPolicy:
+		select {
+		case a.jobs <- job:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	case DropNewestPolicy:
+		select {
+		case a.jobs <- job:
+			return nil
+		default:
+			a.dropped.Add(1)
+			return errAsyncFull
+		}
+	default:
+		for {
+			select {
+			case a.jobs <- job:
+				return nil
+			default:
+			}
+
+			select {
+			case old := <-a.jobs:
+				a.dropped.Add(1)
+				a.logger.Warnf("Dropping upload for target %s received %s ago, asynchronous delivery queue is full",
+					old.targetNames(), time.Since(old.receivedAt).Round(time.Millisecond))
+			default:
+			}
+		}
+	}
+}
+
+// close stops accepting new jobs. Workers finish whatever is already pending.
+// wait blocks until they are done.
+func (a *asyncForwarder) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.closed {
+		a.closed = true
+		close(a.jobs)
+	}
+}
+
+// wait waits for the workers to finish the pending jobs. It gives up when ctx
+// is done.
+func (a *asyncForwarder) wait(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d asynchronous deliveries still pending: %w", len(a.jobs), ctx.Err())
+	}
+}
+
+func (c *Controller) startAsync(cfg AsyncConfig) {
+	c.async = newAsyncForwarder(cfg, c.logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-c.done
+		cancel()
+	}()
+
+	for range max(cfg.Workers, 1) {
+		c.async.wg.Add(1)
+		go c.asyncWorker(ctx)
+	}
+}
+
+func (c *Controller) asyncWorker(ctx context.Context) {
+	defer c.async.wg.Done()
+
+	for job := range c.async.jobs {
+		// Once the controller is closed, deliveries would only fail. Without
+		// a forward queue to persist them in, pending jobs are dropped.
+		if ctx.Err() != nil && c.queue == nil {
+			c.async.dropped.Add(1)
+			c.logger.Warnf("Dropping upload for target %s received at %s, shutting down before it was delivered",
+				job.targetNames(), job.receivedAt.Format(time.RFC3339))
+			continue
+		}
+
+		if _, err := c.dispatch(ctx, job.targets, job.receivedAt, job.values); err != nil {
+			c.logger.Errorf("Asynchronous delivery failed: %s", err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authRealm is the realm of the basic auth challenge.
+const authRealm = "hass-ecowitt-proxy"
+
+// AuthConfig protects the admin endpoints, /status, /metrics and
+// /rewrite/dry-run. A request is let through when any of the configured
+// methods accepts it. The ingest routes and /health are always open, so that
+// gateways and health checks do not need credentials.
+type AuthConfig struct {
+	// BasicUsers maps user names to bcrypt hashes of their passwords.
+	BasicUsers map[string]string
+	// BearerTokens are accepted in an "Authorization: Bearer" header.
+	BearerTokens []string
+	// ProxyHeader is set by an authenticating reverse proxy to the name of
+	// the user, e.g. X-Remote-User. It is only trusted on requests that come
+	// directly from TrustedProxies.
+	ProxyHeader    string
+	TrustedProxies []netip.Prefix
+}
+
+func (a AuthConfig) Validate() error {
+	if len(a.BasicUsers) == 0 && len(a.BearerTokens) == 0 && a.ProxyHeader == "" {
+		return errors.New("auth needs at least one of basic users, bearer tokens or a proxy header")
+	}
+	for user, hash := range a.BasicUsers {
+		if user == "" {
+			return errors.New("auth basic user name may not be empty")
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("auth basic user %q: invalid bcrypt hash: %w", user, err)
+		}
+	}
+	for _, token := range a.BearerTokens {
+		if token == "" {
+			return errors.New("auth bearer tokens may not be empty")
+		}
+	}
+	if a.ProxyHeader != "" && len(a.TrustedProxies) == 0 {
+		return errors.New("auth proxy header needs trusted proxies")
+	}
+	return nil
+}
+
+// WithAuth requires authentication for the admin endpoints.
+func WithAuth(cfg AuthConfig) Option {
+	return func(c *Controller) {
+		c.auth = &cfg
+	}
+}
+
+// requireAuth is the echo middleware that enforces c.auth. It lets every
+// request through when authentication is not configured.
+func (c *Controller) requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if c.auth == nil || c.auth.authenticate(ctx.Request()) {
+			return next(ctx)
+		}
+
+		if len(c.auth.BasicUsers) > 0 {
+			ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="`+authRealm+`"`)
+		}
+		return ctx.JSON(http.StatusUnauthorized, struct{ Message string }{Message: "Unauthorized"})
+	}
+}
+
+func (a *AuthConfig) authenticate(req *http.Request) bool {
+	if user, password, ok := req.BasicAuth(); ok {
+		if hash, ok := a.BasicUsers[user]; ok &&
+			bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true
+		}
+	}
+
+	if token, ok := strings.CutPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+		for _, t := range a.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return true
+			}
+		}
+	}
+
+	if a.ProxyHeader != "" && req.Header.Get(a.ProxyHeader) != "" {
+		return containsAddr(a.TrustedProxies, remoteAddr(req))
+	}
+	return false
+}
+
+// remoteAddr returns the address of the peer that sent req, ignoring any
+// forwarding headers.
+func remoteAddr(req *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
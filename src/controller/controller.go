@@ -17,13 +17,28 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package controller
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"hass-ecowitt-proxy/ambient"
+	"hass-ecowitt-proxy/calibration"
+	"hass-ecowitt-proxy/derived"
+	"hass-ecowitt-proxy/ecowitt"
 	"hass-ecowitt-proxy/logging"
+	"hass-ecowitt-proxy/outlier"
+	"hass-ecowitt-proxy/queue"
+	"hass-ecowitt-proxy/redact"
+	"hass-ecowitt-proxy/rewrite"
+	"hass-ecowitt-proxy/wunderground"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -33,24 +48,69 @@ import (
 func New(url string, authToken string, webhookID string, logger *zap.Logger, opts ...Option) *Controller {
 	c := &Controller{
 		echoSrv:       echo.New(),
-		logger:        logger.Sugar(),
 		logLevel:      logging.InfoLevel,
-		hassURL:       url,
-		hassAuthToken: authToken,
-		webhookID:     webhookID,
+		retryPolicy:   RetryPolicy{MaxAttempts: 1},
+		drainInterval: defaultDrainInterval,
+		drainKick:     make(chan struct{}, 1),
+		undeleted:     map[string]uint64{},
+		done:          make(chan struct{}),
 	}
 
 	for _, opt := range opts {
 		opt(c)
 	}
 
-	// Setup request logging
-	c.echoSrv.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
-		LogURI:    true,
-		LogStatus: true,
-		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
-			logger.Info("request",
-				zap.String("URI", v.URI),
+	if c.redactor == nil {
+		c.redactor = redact.New()
+	}
+	c.logger = logger.WithOptions(zap.WrapCore(c.redactor.Core)).Sugar()
+
+	if c.targetConfigs == nil && url != "" {
+		c.targetConfigs = []Target{{
+			Name:      DefaultTargetName,
+			URL:       url,
+			AuthToken: authToken,
+			WebhookID: webhookID,
+		}}
+	}
+	c.state.Store(c.newState(ReloadConfig{
+		Targets:     c.targetConfigs,
+		Routing:     c.routingConfig,
+		Rewriter:    c.rewriter,
+		Calibration: c.calibration,
+	}, nil))
+
+	c.metrics = newMetrics(c, MaxStations)
+
+	if c.queue != nil {
+		c.wg.Add(1)
+		go c.drainLoop()
+	}
+
+	if c.asyncConfig != nil {
+		c.startAsync(*c.asyncConfig)
+	}
+
+	c.setupEcho(c.echoSrv)
+	if c.adminSrv != nil {
+		c.setupEcho(c.adminSrv)
+	}
+	c.logger.Info("Request logging middleware for Echo enabled.")
+
+	return c
+}
+
+// setupEcho installs the middleware, renderer and error handler shared by
+// the gateway and admin listeners.
+func (c *Controller) setupEcho(e *echo.Echo) {
+	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogURIPath: true,
+		LogStatus:  true,
+		LogValuesFunc: func(_ echo.Context, v middleware.RequestLoggerValues) error {
+			c.logger.Desugar().Info("request",
+				// Only the path: Weather Underground uploads carry the
+				// station password in the query string.
+				zap.String("URI", v.URIPath),
 				zap.Int("status", v.Status),
 				zap.String("host", v.Host),
 				zap.String("protocol", v.Protocol),
@@ -60,13 +120,12 @@ func New(url string, authToken string, webhookID string, logger *zap.Logger, opt
 			return nil
 		},
 	}))
-	c.logger.Info("Request logging middleware for Echo enabled.")
+	e.Use(c.metrics.middleware)
 
-	c.echoSrv.Logger.SetLevel(c.logLevel.ToGommon())
-	c.echoSrv.Renderer = c
-	c.echoSrv.HTTPErrorHandler = customHTTPErrorHandler
-
-	return c
+	e.Logger.SetLevel(c.logLevel.ToGommon())
+	e.Logger.SetOutput(c.redactor.Writer(e.Logger.Output()))
+	e.Renderer = c
+	e.HTTPErrorHandler = customHTTPErrorHandler
 }
 
 type Option func(*Controller)
@@ -83,28 +142,167 @@ func WithEchoServer(echoSrv *echo.Echo) Option {
 	}
 }
 
+// WithAdminListener serves the admin endpoints, /status and /metrics, over
+// TLS on a separate address instead of on the gateway listener.
+func WithAdminListener(addr string, tlsConfig *tls.Config) Option {
+	return func(c *Controller) {
+		c.adminSrv = echo.New()
+		c.adminSrv.HideBanner = true
+		c.adminSrv.TLSServer.Addr = addr
+		c.adminSrv.TLSServer.TLSConfig = tlsConfig
+	}
+}
+
+// WithRedactor sets the redactor for the controller's logs, status page and
+// responses. It is shared with the rest of the program, which registers the
+// configured secrets; secrets that arrive with uploads are never registered.
+// By default the controller uses its own.
+func WithRedactor(r *redact.Redactor) Option {
+	return func(c *Controller) {
+		c.redactor = r
+	}
+}
+
 func WithLogLevel(level logging.LogLevel) Option {
 	return func(c *Controller) {
 		c.logLevel = level
 	}
 }
 
+// WithForwardRetryPolicy sets the retry policy used for deliveries to targets
+// that do not have their own.
+func WithForwardRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Controller) {
+		c.retryPolicy = policy
+	}
+}
+
+// WithQueue enables store-and-forward: uploads that cannot be delivered to
+// Home Assistant are persisted to q and retried in the background.
+func WithQueue(q *queue.Queue) Option {
+	return func(c *Controller) {
+		c.queue = q
+	}
+}
+
+// WithDrainInterval sets how often the controller retries delivering queued
+// uploads while Home Assistant is unreachable.
+func WithDrainInterval(interval time.Duration) Option {
+	return func(c *Controller) {
+		c.drainInterval = interval
+	}
+}
+
 type Controller struct {
 	echoSrv   *echo.Echo
+	adminSrv  *echo.Echo
 	templates *template.Template
 
 	logLevel logging.LogLevel
 	logger   *zap.SugaredLogger
+	redactor *redact.Redactor
+
+	auth      *AuthConfig
+	allowlist *IngestAllowlist
+
+	targetConfigs []Target
+	routingConfig RoutingConfig
+	rewriter      *rewrite.Rewriter
+	calibration   calibration.Rules
+	retryPolicy   RetryPolicy
+
+	// state holds the targets, routing, rewrite rules and calibration, which
+	// Reload replaces.
+	state atomic.Pointer[state]
+
+	reloadMu     sync.Mutex
+	reloadStatus ReloadStatus
 
-	hassURL       string
-	hassAuthToken string
-	webhookID     string
+	sinks []*sink
 
-	eventCount atomic.Uint32
-	errorCount atomic.Uint32
+	outliers       *outlier.Filter
+	derivedMetrics DerivedMetricsMode
+
+	metrics *metrics
+
+	queue         forwardQueue
+	drainInterval time.Duration
+	drainKick     chan struct{}
+	drainMu       sync.Mutex
+	// undeleted maps a target name to the queued upload that was delivered
+	// to it but is still in the queue. It is guarded by drainMu.
+	undeleted map[string]uint64
+
+	asyncConfig *AsyncConfig
+	async       *asyncForwarder
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	eventCount  atomic.Uint32
+	errorCount  atomic.Uint32
+	queuedCount atomic.Uint32
+
+	rejectedCount atomic.Uint32
+	deniedSource  atomic.Uint32
+	deniedPasskey atomic.Uint32
+
+	attemptCount atomic.Uint32
+	retryCount   atomic.Uint32
+}
+
+// Close stops background work right away. Deliveries in progress are
+// cancelled; with a queue they are retried on the next start. Use Shutdown to
+// let them finish first.
+func (c *Controller) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.async != nil {
+			c.async.close()
+			c.async.wg.Wait()
+		}
+		c.wg.Wait()
+
+		for _, t := range c.current().targets {
+			t.client.Close()
+		}
+	})
 }
 
-func (c *Controller) Close() {}
+// Shutdown stops the listeners, waits for uploads in flight and gives
+// pending asynchronous deliveries and queued uploads a last chance to be
+// delivered before closing the controller. When ctx is done first, the
+// remaining deliveries are cancelled and an error is returned.
+func (c *Controller) Shutdown(ctx context.Context) error {
+	defer c.Close()
+
+	errs := []error{}
+	for _, e := range []*echo.Echo{c.echoSrv, c.adminSrv} {
+		if e == nil {
+			continue
+		}
+		if err := e.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("error stopping listener: %w", err))
+		}
+	}
+
+	if c.async != nil {
+		c.async.close()
+		if err := c.async.wait(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.queue != nil && ctx.Err() == nil {
+		c.flushQueue(ctx)
+		if n := c.queue.Len(); n > 0 {
+			c.logger.Infof("%d queued uploads will be retried on the next start", n)
+		}
+	}
+
+	return errors.Join(errs...)
+}
 
 func (c *Controller) GetEventCount() uint32 {
 	return c.eventCount.Load()
@@ -114,6 +312,26 @@ func (c *Controller) GetErrorCount() uint32 {
 	return c.errorCount.Load()
 }
 
+func (c *Controller) GetQueuedCount() uint32 {
+	return c.queuedCount.Load()
+}
+
+// GetRejectedCount returns the number of uploads refused before any delivery
+// was attempted.
+func (c *Controller) GetRejectedCount() uint32 {
+	return c.rejectedCount.Load()
+}
+
+// GetAttemptCount returns the number of individual delivery attempts made to
+// Home Assistant, including retries.
+func (c *Controller) GetAttemptCount() uint32 {
+	return c.attemptCount.Load()
+}
+
+func (c *Controller) GetRetryCount() uint32 {
+	return c.retryCount.Load()
+}
+
 func (c *Controller) makeEventResponse(status string) EventResponse {
 	return EventResponse{
 		Status:     status,
@@ -123,6 +341,10 @@ func (c *Controller) makeEventResponse(status string) EventResponse {
 }
 
 func (c *Controller) HandleEventGet(ctx echo.Context) error {
+	// Ambient Weather stations upload with GET requests.
+	if query, err := ambient.ParseQuery(ctx.Request().URL.RawQuery); err == nil && ambient.IsAmbient(query) {
+		return c.HandleAmbientGet(ctx)
+	}
 	return ctx.JSON(http.StatusOK, c.makeEventResponse("OK"))
 }
 
@@ -135,19 +357,109 @@ func (c *Controller) HandleEventPost(ctx echo.Context) error {
 			c.NewErrorResponse("Error retrieving form parameters", err))
 	}
 
-	forwardUrl := fmt.Sprintf("%s/api/webhook/%s", c.hassURL, c.webhookID)
-	ctx.Logger().Infof("Forwarding Ecowitt event data to %s", forwardUrl)
-	ctx.Logger().Debugf("Ecowitt event data: %v", values)
+	ctx.Logger().Debugf("Ecowitt event data: %v", redact.Values(values))
+
+	code, resp := c.handleUpload(ctx, time.Now(), values)
+	return ctx.JSON(code, resp)
+}
 
-	haClient := NewHassClient(forwardUrl, c.hassAuthToken, values)
-	if err := haClient.PostData(ctx.Request().Context()); err != nil {
+// HandleWundergroundGet accepts uploads in the Weather Underground protocol
+// and handles them like Ecowitt uploads.
+func (c *Controller) HandleWundergroundGet(ctx echo.Context) error {
+	receivedAt := time.Now()
+	values := wunderground.ToEcowitt(ctx.QueryParams(), receivedAt)
+	ctx.Logger().Debugf("Weather Underground event data for station %s: %v",
+		ctx.QueryParam(wunderground.ParamID), redact.Values(values))
+
+	code, resp := c.handleUpload(ctx, receivedAt, values)
+	if code != http.StatusOK {
+		return ctx.JSON(code, resp)
+	}
+	// Weather Underground clients look for this reply.
+	return ctx.String(http.StatusOK, "success\n")
+}
+
+// HandleAmbientGet accepts uploads in the AmbientWeather custom server format
+// and handles them like Ecowitt uploads.
+func (c *Controller) HandleAmbientGet(ctx echo.Context) error {
+	query, err := ambient.ParseQuery(ctx.Request().URL.RawQuery)
+	if err != nil {
 		c.errorCount.Add(1)
-		ctx.Logger().Errorf("Error posting event data to Home Assistant: %s", err)
-		return ctx.JSON(http.StatusInternalServerError, c.NewErrorResponse(forwardUrl, err))
+		ctx.Logger().Errorf("Error parsing Ambient Weather query: %s", err)
+		return ctx.JSON(http.StatusBadRequest,
+			c.NewErrorResponse("Error parsing Ambient Weather query", err))
 	}
 
-	c.eventCount.Add(1)
-	return ctx.JSON(http.StatusOK, c.makeEventResponse("OK"))
+	values := ambient.Translate(query)
+	ctx.Logger().Debugf("Ambient Weather event data: %v", redact.Values(values))
+
+	code, resp := c.handleUpload(ctx, time.Now(), values)
+	return ctx.JSON(code, resp)
+}
+
+// handleUpload routes and delivers an upload in Ecowitt form. It returns the
+// HTTP status code and the response body to reply with.
+func (c *Controller) handleUpload(ctx echo.Context, receivedAt time.Time, values url.Values) (int, any) {
+	passkey := values.Get(ecowitt.FieldPasskey)
+	if c.allowlist != nil && !c.allowlist.allowsPasskey(passkey) {
+		c.deny(DenyPasskey)
+		err := fmt.Errorf("station %s not allowed", redact.Passkey(passkey))
+		ctx.Logger().Warnf("Denying upload: %s", err)
+		return http.StatusForbidden, c.NewErrorResponse("Upload denied", err)
+	}
+
+	s := c.current()
+	targets, err := s.route(values)
+	if err != nil {
+		c.rejectedCount.Add(1)
+		ctx.Logger().Warnf("Rejecting upload: %s", err)
+		return http.StatusForbidden, c.NewErrorResponse("Upload rejected", err)
+	}
+
+	values = c.rewrite(ctx, s, values)
+
+	// Calibrated and filtered readings replace the original ones for every
+	// consumer.
+	payload := ecowitt.Parse(values)
+	modified := s.calibration.Apply(payload)
+	if c.outliers != nil {
+		filtered, err := c.outliers.Apply(payload, payload.Station.ID(), receivedAt)
+		if err != nil {
+			c.rejectedCount.Add(1)
+			ctx.Logger().Warnf("Rejecting upload: %s", err)
+			return http.StatusUnprocessableEntity, c.NewErrorResponse("Upload rejected", err)
+		}
+		modified = modified || filtered
+	}
+	if modified {
+		values = payload.Values()
+	}
+	// Derived readings are only forwarded to Home Assistant in
+	// DerivedMetricsAll mode, so values are taken before enriching.
+	if c.derivedMetrics != DerivedMetricsOff {
+		derived.Enrich(payload)
+	}
+	if c.derivedMetrics == DerivedMetricsAll {
+		values = payload.Values()
+	}
+	c.metrics.recordReadings(receivedAt, payload)
+
+	if c.async != nil {
+		job := asyncJob{targets: targets, receivedAt: receivedAt, values: values}
+		if err := c.async.submit(ctx.Request().Context(), job); err != nil {
+			ctx.Logger().Errorf("Error accepting event data for asynchronous delivery: %s", err)
+			return http.StatusServiceUnavailable, c.NewErrorResponse("Upload not accepted", err)
+		}
+		return http.StatusOK, c.makeEventResponse("ACCEPTED")
+	}
+
+	status, err := c.dispatch(ctx.Request().Context(), targets, receivedAt, values)
+	if err != nil {
+		return http.StatusInternalServerError,
+			c.NewErrorResponse("Error forwarding event data to Home Assistant", err)
+	}
+
+	return http.StatusOK, c.makeEventResponse(status)
 }
 
 func (c *Controller) HandleHealth(ctx echo.Context) error {
@@ -158,19 +470,57 @@ func (c *Controller) HandleStatus(ctx echo.Context, addr string) error {
 	data := struct {
 		Address string
 
-		HassURL       string
-		HassAuthToken string
-		WebhookID     string
+		Targets []TargetStatus
+		Sinks   []SinkStatus
+
+		EventCount    uint32
+		ErrorCount    uint32
+		QueuedCount   uint32
+		RejectedCount uint32
+		DeniedCount   uint32
 
-		EventCount uint32
-		ErrorCount uint32
+		AttemptCount uint32
+		RetryCount   uint32
+
+		QueueEnabled bool
+		QueueLength  int
+		QueueEvicted uint64
+
+		AsyncEnabled       bool
+		AsyncWorkers       int
+		AsyncBackpressure  string
+		AsyncQueueLength   int
+		AsyncQueueCapacity int
+		AsyncDropped       uint32
+
+		Reload ReloadStatus
 	}{
 		Address:       addr,
-		HassURL:       c.hassURL,
-		HassAuthToken: c.hassAuthToken,
-		WebhookID:     c.webhookID,
+		Targets:       c.targetStatuses(),
+		Sinks:         c.sinkStatuses(),
 		EventCount:    c.GetEventCount(),
 		ErrorCount:    c.GetErrorCount(),
+		QueuedCount:   c.GetQueuedCount(),
+		RejectedCount: c.GetRejectedCount(),
+		DeniedCount:   c.GetDeniedCount(),
+		AttemptCount:  c.GetAttemptCount(),
+		RetryCount:    c.GetRetryCount(),
+		QueueEnabled:  c.queue != nil,
+		Reload:        c.GetReloadStatus(),
+	}
+
+	if c.queue != nil {
+		data.QueueLength = c.queue.Len()
+		data.QueueEvicted = c.queue.Evicted()
+	}
+
+	if c.async != nil {
+		data.AsyncEnabled = true
+		data.AsyncWorkers = max(c.async.cfg.Workers, 1)
+		data.AsyncBackpressure = c.async.cfg.Backpressure.String()
+		data.AsyncQueueLength = len(c.async.jobs)
+		data.AsyncQueueCapacity = cap(c.async.jobs)
+		data.AsyncDropped = c.async.dropped.Load()
 	}
 
 	if c.templates != nil {
@@ -184,7 +534,7 @@ func (c *Controller) NewErrorResponse(msg string, err error) ErrorResponse {
 	return ErrorResponse{
 		Status:     "ERROR",
 		Message:    msg,
-		Error:      fmt.Sprint(err),
+		Error:      c.redactor.String(fmt.Sprint(err)),
 		EventCount: c.eventCount.Load(),
 		ErrorCount: c.errorCount.Load(),
 	}
@@ -195,15 +545,49 @@ func (c *Controller) Render(w io.Writer, name string, data interface{}, ctx echo
 }
 
 func (c *Controller) Serve(addr string) error {
-	c.echoSrv.GET("/event", c.HandleEventGet)
-	c.echoSrv.POST("/event", c.HandleEventPost)
+	c.echoSrv.GET("/event", c.HandleEventGet, c.allowSources)
+	c.echoSrv.POST("/event", c.HandleEventPost, c.allowSources)
+	c.echoSrv.GET("/weatherstation/updateweatherstation.php", c.HandleWundergroundGet, c.allowSources)
+	c.echoSrv.GET("/ambient", c.HandleAmbientGet, c.allowSources)
+	c.echoSrv.GET("/ambient/", c.HandleAmbientGet, c.allowSources)
 	c.echoSrv.GET("/health", c.HandleHealth)
 
-	c.echoSrv.GET("/status", func(ctx echo.Context) error {
+	status := func(ctx echo.Context) error {
 		return c.HandleStatus(ctx, addr)
-	})
+	}
 
-	return c.echoSrv.Start(addr)
+	if c.adminSrv == nil {
+		c.echoSrv.GET("/metrics", c.HandleMetrics, c.requireAuth)
+		c.echoSrv.GET("/status", status, c.requireAuth)
+		c.echoSrv.POST("/rewrite/dry-run", c.HandleRewriteDryRun, c.requireAuth)
+		return c.echoSrv.Start(addr)
+	}
+
+	c.adminSrv.GET("/health", c.HandleHealth)
+	c.adminSrv.GET("/metrics", c.HandleMetrics, c.requireAuth)
+	c.adminSrv.GET("/status", status, c.requireAuth)
+	c.adminSrv.POST("/rewrite/dry-run", c.HandleRewriteDryRun, c.requireAuth)
+
+	// Run both listeners until either of them stops.
+	errs := make(chan error, 2)
+	go func() {
+		errs <- c.echoSrv.Start(addr)
+	}()
+	go func() {
+		errs <- c.adminSrv.StartServer(c.adminSrv.TLSServer)
+	}()
+
+	// When one listener fails, stop the other one as well. On shutdown,
+	// Shutdown stops both.
+	err := <-errs
+	if !errors.Is(err, http.ErrServerClosed) {
+		c.echoSrv.Close()
+		c.adminSrv.Close()
+		<-errs
+		return fmt.Errorf("listener failed: %w", err)
+	}
+	<-errs
+	return err
 }
 
 func customHTTPErrorHandler(err error, ctx echo.Context) {
@@ -212,7 +596,7 @@ func customHTTPErrorHandler(err error, ctx echo.Context) {
 		code = he.Code
 	}
 	if code == http.StatusNotFound {
-		ctx.Logger().Errorf("%s: %q", err, ctx.Request().URL)
+		ctx.Logger().Errorf("%s: %q", err, redact.URL(ctx.Request().URL))
 	} else {
 		ctx.Logger().Error(err)
 	}
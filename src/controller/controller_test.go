@@ -17,18 +17,42 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package controller
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"hass-ecowitt-proxy/calibration"
+	"hass-ecowitt-proxy/ecowitt"
+	"hass-ecowitt-proxy/logging"
+	"hass-ecowitt-proxy/outlier"
+	"hass-ecowitt-proxy/queue"
+	"hass-ecowitt-proxy/redact"
+	"hass-ecowitt-proxy/rewrite"
+	"hass-ecowitt-proxy/tlsconfig"
+	"hass-ecowitt-proxy/wunderground"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func makeZapLogger(t *testing.T) *zap.Logger {
@@ -153,6 +177,1038 @@ func TestHandleEventPost(t *testing.T) {
 	}
 }
 
+func TestHandleEventPostFanOut(t *testing.T) {
+	logger := makeZapLogger(t)
+
+	newServer := func(statusCode int, got *url.Values, gotToken *string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			*got = r.PostForm
+			*gotToken = r.Header.Get("Authorization")
+			w.WriteHeader(statusCode)
+		}))
+	}
+
+	var prodValues, stagingValues url.Values
+	var prodToken, stagingToken string
+	prod := newServer(http.StatusOK, &prodValues, &prodToken)
+	defer prod.Close()
+	staging := newServer(http.StatusInternalServerError, &stagingValues, &stagingToken)
+	defer staging.Close()
+
+	ctrl := New("", "", "", logger, WithTargets(
+		Target{Name: "production", URL: prod.URL, AuthToken: "prod-token", WebhookID: "prod-hook"},
+		Target{Name: "staging", URL: staging.URL, AuthToken: "staging-token", WebhookID: "staging-hook"},
+	))
+	defer ctrl.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("tempf=70.1"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+
+	assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	assert.Equal(t, url.Values{"tempf": {"70.1"}}, prodValues)
+	assert.Equal(t, url.Values{"tempf": {"70.1"}}, stagingValues)
+	assert.Equal(t, "Bearer prod-token", prodToken)
+	assert.Equal(t, "Bearer staging-token", stagingToken)
+
+	statuses := ctrl.targetStatuses()
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, "production", statuses[0].Name)
+	assert.Equal(t, uint32(1), statuses[0].EventCount)
+	assert.Equal(t, uint32(0), statuses[0].ErrorCount)
+	assert.Equal(t, "staging", statuses[1].Name)
+	assert.Equal(t, uint32(0), statuses[1].EventCount)
+	assert.Equal(t, uint32(1), statuses[1].ErrorCount)
+}
+
+func TestFanOutCountsUploadOnce(t *testing.T) {
+	var got atomic.Int32
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.Add(1)
+	}))
+	defer ha.Close()
+
+	ctrl := New("", "", "", makeZapLogger(t), WithTargets(
+		Target{Name: "garden", URL: ha.URL, AuthToken: "t", WebhookID: "garden"},
+		Target{Name: "roof", URL: ha.URL, AuthToken: "t", WebhookID: "roof"},
+		Target{Name: "lab", URL: ha.URL, AuthToken: "t", WebhookID: "lab"},
+	))
+	defer ctrl.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("tempf=70.1"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, int32(3), got.Load())
+	assert.Equal(t, uint32(1), ctrl.GetEventCount())
+	for _, ts := range ctrl.targetStatuses() {
+		assert.Equal(t, uint32(1), ts.EventCount, ts.Name)
+	}
+}
+
+func TestTargetTLS(t *testing.T) {
+	ha := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ha.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ha.Certificate().Raw}), 0o600))
+
+	tests := []struct {
+		name    string
+		tls     tlsconfig.Client
+		wantErr bool
+	}{
+		{name: "untrusted certificate", wantErr: true},
+		{name: "custom CA", tls: tlsconfig.Client{CAFile: caFile, MinVersion: "1.2"}},
+		{name: "verification disabled", tls: tlsconfig.Client{InsecureSkipVerify: true}},
+		{name: "unsupported version", tls: tlsconfig.Client{CAFile: caFile, MinVersion: "1.4"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := Target{Name: "tls", URL: ha.URL, AuthToken: "token", WebhookID: "hook", TLS: test.tls}
+			ctrl := New("", "", "", makeZapLogger(t), WithTargets(target))
+			defer ctrl.Close()
+
+			err := ctrl.forward(context.Background(), ctrl.current().targets[0], url.Values{"tempf": {"70.1"}})
+			if test.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	assert.Error(t, Target{Name: "tls", URL: ha.URL, AuthToken: "token", WebhookID: "hook",
+		TLS: tlsconfig.Client{CAFile: "missing.pem"}}.Validate())
+}
+
+func TestHandleWundergroundGet(t *testing.T) {
+	var got url.Values
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ha.Close()
+
+	ctrl := New(ha.URL, "token", "hook", makeZapLogger(t))
+	defer ctrl.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/weatherstation/updateweatherstation.php?"+
+		"ID=KSTATION1&PASSWORD=secret&action=updateraw&dateutc=2024-03-01+17%3A03%3A22&tempf=45.5&baromin=29.858", nil)
+	rec := httptest.NewRecorder()
+
+	assert.Nil(t, ctrl.HandleWundergroundGet(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "success\n", rec.Body.String())
+
+	assert.Equal(t, url.Values{
+		"PASSKEY":    {"KSTATION1"},
+		"dateutc":    {"2024-03-01 17:03:22"},
+		"tempf":      {"45.5"},
+		"baromrelin": {"29.858"},
+	}, got)
+	assert.Equal(t, uint32(1), ctrl.GetEventCount())
+}
+
+func TestHandleAmbientGet(t *testing.T) {
+	var got url.Values
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ha.Close()
+
+	e := echo.New()
+	ctrl := New(ha.URL, "token", "hook", makeZapLogger(t), WithEchoServer(e))
+	defer ctrl.Close()
+	e.GET("/event", ctrl.HandleEventGet)
+	e.GET("/ambient", ctrl.HandleAmbientGet)
+
+	for _, target := range []string{
+		"/ambient??MAC=00:0E:C6:20:3B:1F&tempf=45.5&battout=1",
+		"/event?&MAC=00:0E:C6:20:3B:1F&tempf=45.5&battout=1",
+	} {
+		got = nil
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, target)
+		assert.Equal(t, url.Values{
+			"PASSKEY":  {"00:0E:C6:20:3B:1F"},
+			"tempf":    {"45.5"},
+			"wh65batt": {"0"},
+		}, got, target)
+	}
+	assert.Equal(t, uint32(2), ctrl.GetEventCount())
+}
+
+type fakeSink struct {
+	name string
+	err  error
+
+	mu       sync.Mutex
+	payloads []*ecowitt.Payload
+}
+
+func (s *fakeSink) Name() string {
+	return s.name
+}
+
+func (s *fakeSink) Publish(_ context.Context, _ time.Time, p *ecowitt.Payload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads = append(s.payloads, p)
+	return s.err
+}
+
+func TestHandleEventPostSinks(t *testing.T) {
+	var delivered atomic.Int32
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered.Add(1)
+	}))
+	defer ha.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	tests := []struct {
+		name          string
+		webhook       bool
+		sink          func(t *testing.T) Sink
+		wantDelivered int32
+		wantStatus    SinkStatus
+	}{
+		{
+			name:       "published without webhook targets",
+			sink:       func(*testing.T) Sink { return &fakeSink{name: "fake"} },
+			wantStatus: SinkStatus{Name: "fake", EventCount: 1},
+		},
+		{
+			name:    "failing MQTT sink does not fail delivery",
+			webhook: true,
+			sink: func(*testing.T) Sink {
+				return &fakeSink{name: "mqtt", err: errors.New("broker unavailable")}
+			},
+			wantDelivered: 1,
+			wantStatus:    SinkStatus{Name: "mqtt", ErrorCount: 1},
+		},
+		{
+			name:    "failing relay does not fail delivery",
+			webhook: true,
+			sink: func(t *testing.T) Sink {
+				relay, err := wunderground.NewRelay(wunderground.Service{
+					Name: "wunderground", URL: down.URL, StationID: "KXXX1", StationKey: "key",
+				})
+				require.NoError(t, err)
+				return relay
+			},
+			wantDelivered: 1,
+			wantStatus:    SinkStatus{Name: "relay/wunderground", ErrorCount: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delivered.Store(0)
+
+			hassURL := ""
+			if test.webhook {
+				hassURL = ha.URL
+			}
+			s := test.sink(t)
+			ctrl := New(hassURL, "token", "hook", makeZapLogger(t), WithSinks(s))
+			defer ctrl.Close()
+
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("tempf=70.1&PASSKEY=AAAA"))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			rec := httptest.NewRecorder()
+
+			assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, test.wantDelivered, delivered.Load())
+			assert.Equal(t, uint32(0), ctrl.GetErrorCount())
+			assert.Equal(t, []SinkStatus{test.wantStatus}, ctrl.sinkStatuses())
+
+			if fs, ok := s.(*fakeSink); ok {
+				require.Len(t, fs.payloads, 1)
+				assert.Equal(t, "AAAA", fs.payloads[0].Station.Passkey)
+				v, ok := fs.payloads[0].Get("tempf")
+				assert.True(t, ok)
+				assert.Equal(t, 70.1, v)
+			}
+		})
+	}
+}
+
+func TestDerivedMetrics(t *testing.T) {
+	const upload = "PASSKEY=AAAA&tempinf=68&humidityin=50"
+
+	tests := []struct {
+		name        string
+		mode        DerivedMetricsMode
+		wantSink    bool
+		wantWebhook bool
+	}{
+		{name: "off", mode: DerivedMetricsOff},
+		{name: "sinks", mode: DerivedMetricsSinks, wantSink: true},
+		{name: "all", mode: DerivedMetricsAll, wantSink: true, wantWebhook: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got url.Values
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				got = r.PostForm
+			}))
+			defer srv.Close()
+
+			s := &fakeSink{name: "fake"}
+			ctrl := New(srv.URL, "", "", makeZapLogger(t), WithSinks(s), WithDerivedMetrics(test.mode))
+			defer ctrl.Close()
+
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader(upload))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			rec := httptest.NewRecorder()
+
+			assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			require.Len(t, s.payloads, 1)
+			dewPoint, ok := s.payloads[0].Get("dewpointinf")
+			assert.Equal(t, test.wantSink, ok)
+			if ok {
+				assert.Equal(t, 48.7, dewPoint)
+			}
+
+			if test.wantWebhook {
+				assert.Equal(t, "48.7", got.Get("dewpointinf"))
+				assert.Equal(t, "8.62", got.Get("abshumidityin"))
+			} else {
+				want, _ := url.ParseQuery(upload)
+				assert.Equal(t, want, got)
+			}
+		})
+	}
+
+	_, err := DerivedMetricsModeFromStr("sometimes")
+	assert.Error(t, err)
+}
+
+func TestCalibration(t *testing.T) {
+	maxHumidity := 100.0
+
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+	}))
+	defer srv.Close()
+
+	s := &fakeSink{name: "fake"}
+	ctrl := New(srv.URL, "token", "hook", makeZapLogger(t), WithSinks(s), WithDerivedMetrics(DerivedMetricsAll),
+		WithCalibration(calibration.Rules{
+			"temp2f":     {Offset: -0.8},
+			"humidity2":  {Offset: 5, Max: &maxHumidity},
+			"rainratein": {Gain: 1.07},
+		}))
+	defer ctrl.Close()
+
+	post := func() {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/event",
+			strings.NewReader("PASSKEY=AAAA&temp2f=70.1&humidity2=97&rainratein=0.12&tempf=45.5"))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+
+		assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	post()
+	assert.Equal(t, "69.3", got.Get("temp2f"))
+	assert.Equal(t, "100", got.Get("humidity2"))
+	assert.Equal(t, "0.1284", got.Get("rainratein"))
+	assert.Equal(t, "45.5", got.Get("tempf"))
+	// Derived readings use the calibrated values.
+	assert.Equal(t, "69.3", got.Get("dewpoint2f"))
+
+	require.Len(t, s.payloads, 1)
+	assert.Equal(t, 69.3, *s.payloads[0].TempHumidityChannels[2].TempF)
+
+	require.NoError(t, ctrl.Reload(func() (ReloadConfig, error) {
+		return ReloadConfig{
+			Targets:     ctrl.targetConfigs,
+			Calibration: calibration.Rules{"tempf": {Offset: 1}},
+		}, nil
+	}))
+	post()
+	assert.Equal(t, "70.1", got.Get("temp2f"))
+	assert.Equal(t, "46.5", got.Get("tempf"))
+
+	assert.Error(t, ctrl.Reload(func() (ReloadConfig, error) {
+		return ReloadConfig{Targets: ctrl.targetConfigs, Calibration: calibration.Rules{"bogus": {}}}, nil
+	}))
+}
+
+func TestCalibrationWithDerivedMetricsForSinks(t *testing.T) {
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+	}))
+	defer srv.Close()
+
+	s := &fakeSink{name: "fake"}
+	ctrl := New(srv.URL, "token", "hook", makeZapLogger(t), WithSinks(s), WithDerivedMetrics(DerivedMetricsSinks),
+		WithCalibration(calibration.Rules{"tempinf": {Offset: -1}}))
+	defer ctrl.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("PASSKEY=AAAA&tempinf=69&humidityin=50"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+
+	assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Home Assistant gets the calibrated readings without derived ones.
+	assert.Equal(t, url.Values{"PASSKEY": {"AAAA"}, "tempinf": {"68"}, "humidityin": {"50"}}, got)
+
+	require.Len(t, s.payloads, 1)
+	dewPoint, ok := s.payloads[0].Get("dewpointinf")
+	assert.True(t, ok)
+	assert.Equal(t, 48.7, dewPoint)
+}
+
+func TestOutlierFilter(t *testing.T) {
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+	}))
+	defer srv.Close()
+
+	filter, err := outlier.New(outlier.Config{
+		Limits: map[string]outlier.Limit{"tempf": {MaxRate: 2, Action: outlier.RejectAction}},
+	})
+	require.NoError(t, err)
+
+	e := echo.New()
+	ctrl := New(srv.URL, "token", "hook", makeZapLogger(t), WithEchoServer(e), WithOutlierFilter(filter))
+	defer ctrl.Close()
+	e.POST("/event", ctrl.HandleEventPost)
+	e.GET("/metrics", ctrl.HandleMetrics)
+
+	post := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("PASSKEY=AAAA&tempf=45.5&windgustmph=201.3&windspeedmph=3.2"))
+	assert.Equal(t, url.Values{"PASSKEY": {"AAAA"}, "tempf": {"45.5"}, "windspeedmph": {"3.2"}}, got)
+
+	got = nil
+	assert.Equal(t, http.StatusUnprocessableEntity, post("PASSKEY=AAAA&tempf=-20"))
+	assert.Nil(t, got)
+	assert.Equal(t, uint32(1), ctrl.GetRejectedCount())
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, `ecowitt_proxy_readings_filtered_total{action="drop",field="windgustmph",reason="range"} 1`)
+	assert.Contains(t, body, `ecowitt_proxy_readings_filtered_total{action="reject",field="tempf",reason="rate"} 1`)
+	assert.Contains(t, body, `ecowitt_proxy_rejected_total 1`)
+}
+
+func TestRewrite(t *testing.T) {
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+	}))
+	defer srv.Close()
+
+	rw, err := rewrite.New([]rewrite.Rule{
+		{Name: "strip leaf wetness", Match: "^leafwetness_ch\\d+$", Action: rewrite.DropAction},
+		{Field: "outtemp", Action: rewrite.RenameAction, To: "tempf", Passkeys: []string{"AAAA"}},
+	})
+	require.NoError(t, err)
+
+	e := echo.New()
+	ctrl := New(srv.URL, "token", "hook", makeZapLogger(t), WithEchoServer(e), WithRewriter(rw))
+	defer ctrl.Close()
+	e.POST("/event", ctrl.HandleEventPost)
+	e.POST("/rewrite/dry-run", ctrl.HandleRewriteDryRun)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	const upload = "PASSKEY=AAAA&outtemp=45.5&leafwetness_ch1=12"
+	assert.Equal(t, http.StatusOK, post("/event", upload).Code)
+	assert.Equal(t, url.Values{"PASSKEY": {"AAAA"}, "tempf": {"45.5"}}, got)
+
+	assert.Equal(t, http.StatusOK, post("/event", "PASSKEY=BBBB&outtemp=45.5").Code)
+	assert.Equal(t, url.Values{"PASSKEY": {"BBBB"}, "outtemp": {"45.5"}}, got)
+
+	// The PASSKEY is redacted in the dry-run output.
+	passkeyID := redact.Passkey("AAAA")
+	got = nil
+	rec := post("/rewrite/dry-run", upload)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Nil(t, got)
+	assert.JSONEq(t, fmt.Sprintf(`{
+		"Input": {"PASSKEY": [%[1]q], "outtemp": ["45.5"], "leafwetness_ch1": ["12"]},
+		"Output": {"PASSKEY": [%[1]q], "tempf": ["45.5"]},
+		"Applied": ["strip leaf wetness", "rule 2"]
+	}`, passkeyID), rec.Body.String())
+
+	// The dry run uses the rules of the current configuration.
+	require.NoError(t, ctrl.Reload(func() (ReloadConfig, error) {
+		return ReloadConfig{Targets: ctrl.targetConfigs}, nil
+	}))
+	rec = post("/rewrite/dry-run", upload)
+	assert.JSONEq(t, fmt.Sprintf(`{
+		"Input": {"PASSKEY": [%[1]q], "outtemp": ["45.5"], "leafwetness_ch1": ["12"]},
+		"Output": {"PASSKEY": [%[1]q], "outtemp": ["45.5"], "leafwetness_ch1": ["12"]},
+		"Applied": []
+	}`, passkeyID), rec.Body.String())
+}
+
+func TestRouting(t *testing.T) {
+	logger := makeZapLogger(t)
+
+	targets := []Target{
+		{Name: "garden", URL: "http://garden", AuthToken: "t", WebhookID: "w"},
+		{Name: "roof", URL: "http://roof", AuthToken: "t", WebhookID: "w"},
+		{Name: "lab", URL: "http://lab", AuthToken: "t", WebhookID: "w"},
+	}
+	routes := []Route{
+		{Field: RouteFieldPasskey, Value: "AAAA", Targets: []string{"garden"}},
+		{Field: RouteFieldModel, Value: "GW2000A", Targets: []string{"roof", "lab"}},
+	}
+
+	tests := []struct {
+		name        string
+		routing     RoutingConfig
+		values      url.Values
+		wantTargets []string
+		wantErr     bool
+	}{
+		{
+			name:        "matches passkey case insensitively",
+			routing:     RoutingConfig{Routes: routes},
+			values:      url.Values{"PASSKEY": {"aaaa"}, "model": {"GW2000A"}},
+			wantTargets: []string{"garden"},
+		},
+		{
+			name:        "matches model",
+			routing:     RoutingConfig{Routes: routes},
+			values:      url.Values{"PASSKEY": {"BBBB"}, "model": {"GW2000A"}},
+			wantTargets: []string{"roof", "lab"},
+		},
+		{
+			name:        "unknown station uses default route",
+			routing:     RoutingConfig{Routes: routes, DefaultTargets: []string{"lab"}},
+			values:      url.Values{"PASSKEY": {"CCCC"}},
+			wantTargets: []string{"lab"},
+		},
+		{
+			name:        "unknown station without default goes everywhere",
+			routing:     RoutingConfig{Routes: routes},
+			values:      url.Values{"PASSKEY": {"CCCC"}},
+			wantTargets: []string{"garden", "roof", "lab"},
+		},
+		{
+			name:    "unknown station rejected",
+			routing: RoutingConfig{Routes: routes, RejectUnknown: true},
+			values:  url.Values{"PASSKEY": {"CCCC"}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.NoError(t, test.routing.Validate(targets))
+
+			ctrl := New("", "", "", logger, WithTargets(targets...), WithRouting(test.routing))
+			defer ctrl.Close()
+
+			got, err := ctrl.route(test.values)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			var names []string
+			for _, t := range got {
+				names = append(names, t.Name)
+			}
+			assert.Equal(t, test.wantTargets, names)
+		})
+	}
+
+	t.Run("rejected upload returns 403", func(t *testing.T) {
+		ctrl := New("", "", "", logger, WithTargets(targets...),
+			WithRouting(RoutingConfig{Routes: routes, RejectUnknown: true}))
+		defer ctrl.Close()
+
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("PASSKEY=CCCC"))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+
+		assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, uint32(1), ctrl.GetRejectedCount())
+		assert.Equal(t, uint32(0), ctrl.GetErrorCount())
+	})
+
+	t.Run("invalid routing", func(t *testing.T) {
+		assert.Error(t, RoutingConfig{Routes: []Route{{Field: "tempf", Value: "1", Targets: []string{"lab"}}}}.Validate(targets))
+		assert.Error(t, RoutingConfig{Routes: []Route{{Field: "model", Value: "x", Targets: []string{"nope"}}}}.Validate(targets))
+		assert.Error(t, RoutingConfig{DefaultTargets: []string{"nope"}}.Validate(targets))
+	})
+}
+
+func TestReload(t *testing.T) {
+	newServer := func(got *atomic.Int32, gotToken *atomic.Value) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got.Add(1)
+			gotToken.Store(r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+
+	var oldCount, newCount atomic.Int32
+	var oldToken, newToken atomic.Value
+	oldSvr := newServer(&oldCount, &oldToken)
+	defer oldSvr.Close()
+	newSvr := newServer(&newCount, &newToken)
+	defer newSvr.Close()
+
+	e := echo.New()
+	ctrl := New(oldSvr.URL, "old-token", "hook", makeZapLogger(t), WithEchoServer(e),
+		WithTemplates(template.Must(template.ParseFiles("testdata/status.html"))))
+	defer ctrl.Close()
+	e.POST("/event", ctrl.HandleEventPost)
+
+	post := func() {
+		req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("tempf=70.1"))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	post()
+	assert.Equal(t, int32(1), oldCount.Load())
+
+	target := Target{Name: DefaultTargetName, URL: newSvr.URL, AuthToken: "new-token", WebhookID: "hook"}
+	require.NoError(t, ctrl.Reload(func() (ReloadConfig, error) {
+		return ReloadConfig{Targets: []Target{target}, LogLevel: logging.DebugLevel}, nil
+	}))
+
+	post()
+	assert.Equal(t, int32(1), oldCount.Load())
+	assert.Equal(t, int32(1), newCount.Load())
+	assert.Equal(t, "Bearer new-token", newToken.Load())
+
+	// Counters survive the reload of a target with the same name.
+	statuses := ctrl.targetStatuses()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, uint32(2), statuses[0].EventCount)
+
+	// Invalid configurations are not applied.
+	assert.Error(t, ctrl.Reload(func() (ReloadConfig, error) {
+		return ReloadConfig{
+			Targets: []Target{target},
+			Routing: RoutingConfig{DefaultTargets: []string{"missing"}},
+		}, nil
+	}))
+	assert.Error(t, ctrl.Reload(func() (ReloadConfig, error) {
+		return ReloadConfig{}, errors.New("broken config file")
+	}))
+
+	post()
+	assert.Equal(t, int32(2), newCount.Load())
+
+	status := ctrl.GetReloadStatus()
+	assert.Equal(t, uint32(3), status.Count)
+	assert.Equal(t, uint32(2), status.Failures)
+	assert.Equal(t, "broken config file", status.Error)
+
+	rec := httptest.NewRecorder()
+	require.NoError(t, ctrl.HandleStatus(e.NewContext(httptest.NewRequest(http.MethodGet, "/status", nil), rec), "addr"))
+	assert.Contains(t, rec.Body.String(), "Reloads=3")
+	assert.Contains(t, rec.Body.String(), "Last Error=broken config file")
+}
+
+func TestValidateTargets(t *testing.T) {
+	valid := Target{Name: "a", URL: "http://ha", AuthToken: "t", WebhookID: "w"}
+
+	assert.NoError(t, ValidateTargets([]Target{valid}))
+	assert.Error(t, ValidateTargets([]Target{valid, valid}))
+	assert.Error(t, ValidateTargets([]Target{{Name: "b", URL: "http://ha"}}))
+	assert.Error(t, ValidateTargets([]Target{{URL: "http://ha", AuthToken: "t", WebhookID: "w"}}))
+}
+
+func TestHandleEventPostQueued(t *testing.T) {
+	logger := makeZapLogger(t)
+
+	var available atomic.Bool
+	var delivered atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	q, err := queue.Open(t.TempDir())
+	assert.Nil(t, err)
+	defer q.Close()
+
+	ctrl := New(svr.URL, "test-token", "test-webhook-id", logger,
+		WithQueue(q), WithDrainInterval(10*time.Millisecond))
+	defer ctrl.Close()
+
+	post := func() EventResponse {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("tempf=70.1"))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+
+		assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var got EventResponse
+		json.Unmarshal(rec.Body.Bytes(), &got)
+		return got
+	}
+
+	assert.Equal(t, "QUEUED", post().Status)
+	assert.Equal(t, "QUEUED", post().Status)
+	assert.Equal(t, uint32(2), ctrl.GetQueuedCount())
+	assert.Equal(t, uint32(0), ctrl.GetErrorCount())
+
+	available.Store(true)
+	assert.Eventually(t, func() bool { return q.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), delivered.Load())
+	assert.Equal(t, uint32(2), ctrl.GetEventCount())
+}
+
+func TestQueuedFanOutCountsUploadOnce(t *testing.T) {
+	var available atomic.Bool
+	var delivered atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered.Add(1)
+	}))
+	defer svr.Close()
+
+	q, err := queue.Open(t.TempDir())
+	require.NoError(t, err)
+	defer q.Close()
+
+	ctrl := New("", "", "", makeZapLogger(t), WithQueue(q), WithDrainInterval(10*time.Millisecond),
+		WithTargets(
+			Target{Name: "garden", URL: svr.URL, AuthToken: "t", WebhookID: "garden"},
+			Target{Name: "roof", URL: svr.URL, AuthToken: "t", WebhookID: "roof"},
+		))
+	defer ctrl.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("tempf=70.1"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 2, q.Len())
+
+	available.Store(true)
+	assert.Eventually(t, func() bool { return q.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), delivered.Load())
+	assert.Equal(t, uint32(1), ctrl.GetEventCount())
+	for _, ts := range ctrl.targetStatuses() {
+		assert.Equal(t, uint32(1), ts.EventCount, ts.Name)
+	}
+}
+
+// failingRemoveQueue is a queue whose items cannot be removed while fail is
+// set.
+type failingRemoveQueue struct {
+	*queue.Queue
+	fail atomic.Bool
+}
+
+func (q *failingRemoveQueue) Remove(id uint64) error {
+	if q.fail.Load() {
+		return errors.New("read-only file system")
+	}
+	return q.Queue.Remove(id)
+}
+
+func TestQueuedEventNotRedeliveredWhenRemoveFails(t *testing.T) {
+	var available atomic.Bool
+	var delivered atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered.Add(1)
+	}))
+	defer svr.Close()
+
+	q, err := queue.Open(t.TempDir())
+	require.NoError(t, err)
+	defer q.Close()
+	fq := &failingRemoveQueue{Queue: q}
+	fq.fail.Store(true)
+
+	ctrl := New(svr.URL, "test-token", "test-webhook-id", makeZapLogger(t),
+		func(c *Controller) { c.queue = fq }, WithDrainInterval(10*time.Millisecond))
+	defer ctrl.Close()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("tempf=70.1"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, q.Len())
+
+	available.Store(true)
+	assert.Eventually(t, func() bool { return delivered.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Let the drain loop run a few more times while the item is stuck.
+	for range 5 {
+		ctrl.drainQueue()
+	}
+	assert.Equal(t, int32(1), delivered.Load())
+	assert.Equal(t, 1, q.Len())
+
+	fq.fail.Store(false)
+	assert.Eventually(t, func() bool { return q.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), delivered.Load())
+	assert.Equal(t, uint32(1), ctrl.GetEventCount())
+}
+
+func TestHandleEventPostAsync(t *testing.T) {
+	logger := makeZapLogger(t)
+
+	release := make(chan struct{})
+	var delivered atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		delivered.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	ctrl := New(svr.URL, "test-token", "test-webhook-id", logger,
+		WithAsync(AsyncConfig{Workers: 1, QueueSize: 4, Backpressure: DropOldestPolicy}))
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("tempf=70.1"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+
+	// The handler must reply before Home Assistant has answered.
+	assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var got EventResponse
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	assert.Equal(t, "ACCEPTED", got.Status)
+	assert.Equal(t, int32(0), delivered.Load())
+
+	close(release)
+	assert.Eventually(t, func() bool { return ctrl.GetEventCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+	ctrl.Close()
+	assert.Equal(t, int32(1), delivered.Load())
+}
+
+func TestShutdown(t *testing.T) {
+	post := func(t *testing.T, ctrl *Controller) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("tempf=70.1"))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+
+		assert.Nil(t, ctrl.HandleEventPost(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	t.Run("pending deliveries finish", func(t *testing.T) {
+		var delivered atomic.Int32
+		svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			delivered.Add(1)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer svr.Close()
+
+		ctrl := New(svr.URL, "test-token", "test-webhook-id", makeZapLogger(t),
+			WithAsync(AsyncConfig{Workers: 1, QueueSize: 4, Backpressure: BlockPolicy}))
+
+		for range 3 {
+			post(t, ctrl)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, ctrl.Shutdown(ctx))
+		assert.Equal(t, int32(3), delivered.Load())
+	})
+
+	t.Run("deadline persists pending deliveries", func(t *testing.T) {
+		release := make(chan struct{})
+		svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}))
+		defer svr.Close()
+		defer close(release)
+
+		q, err := queue.Open(t.TempDir())
+		require.NoError(t, err)
+		defer q.Close()
+
+		ctrl := New(svr.URL, "test-token", "test-webhook-id", makeZapLogger(t),
+			WithQueue(q), WithAsync(AsyncConfig{Workers: 1, QueueSize: 4, Backpressure: BlockPolicy}))
+
+		for range 3 {
+			post(t, ctrl)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, ctrl.Shutdown(ctx), context.DeadlineExceeded)
+		assert.Equal(t, 3, q.Len())
+	})
+
+	t.Run("close drops pending deliveries", func(t *testing.T) {
+		started := make(chan struct{}, 3)
+		release := make(chan struct{})
+		svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}))
+		defer svr.Close()
+		defer close(release)
+
+		core, logs := observer.New(zap.DebugLevel)
+		ctrl := New(svr.URL, "test-token", "test-webhook-id", zap.New(core),
+			WithAsync(AsyncConfig{Workers: 1, QueueSize: 4, Backpressure: BlockPolicy}))
+
+		for range 3 {
+			post(t, ctrl)
+		}
+		<-started
+
+		ctrl.Close()
+		assert.Equal(t, uint32(2), ctrl.async.dropped.Load())
+		assert.Equal(t, 2, logs.FilterMessageSnippet("shutting down before it was delivered").Len())
+		assert.Len(t, started, 0)
+	})
+}
+
+func TestAsyncBackpressure(t *testing.T) {
+	garden := &target{Target: Target{Name: "garden"}}
+	job := func(v string) asyncJob {
+		return asyncJob{targets: []*target{garden}, receivedAt: time.Now(), values: url.Values{"tempf": {v}}}
+	}
+
+	tests := []struct {
+		name        string
+		policy      BackpressurePolicy
+		wantErr     error
+		wantPending []string
+		wantLogs    int
+	}{
+		{
+			name:        "drop oldest",
+			policy:      DropOldestPolicy,
+			wantPending: []string{"2", "3"},
+			wantLogs:    1,
+		},
+		{
+			name:        "drop newest",
+			policy:      DropNewestPolicy,
+			wantErr:     errAsyncFull,
+			wantPending: []string{"1", "2"},
+		},
+		{
+			name:        "block",
+			policy:      BlockPolicy,
+			wantErr:     context.DeadlineExceeded,
+			wantPending: []string{"1", "2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			core, logs := observer.New(zap.DebugLevel)
+			a := newAsyncForwarder(AsyncConfig{QueueSize: 2, Backpressure: test.policy}, zap.New(core).Sugar())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			assert.NoError(t, a.submit(ctx, job("1")))
+			assert.NoError(t, a.submit(ctx, job("2")))
+			assert.ErrorIs(t, a.submit(ctx, job("3")), test.wantErr)
+			assert.Equal(t, test.wantLogs, logs.FilterMessageSnippet(`Dropping upload for target "garden" received`).Len())
+
+			a.close()
+			var pending []string
+			for j := range a.jobs {
+				pending = append(pending, j.values.Get("tempf"))
+			}
+			assert.Equal(t, test.wantPending, pending)
+			assert.ErrorIs(t, a.submit(ctx, job("4")), errAsyncClosed)
+		})
+	}
+}
+
 func TestWebhookClient(t *testing.T) {
 	const token = "test-token"
 
@@ -182,11 +1238,10 @@ func TestWebhookClient(t *testing.T) {
 			}))
 			defer svr.Close()
 
-			client := NewHassClient(svr.URL, token, test.data, WithOpenClientFn(func() *http.Client {
-				return svr.Client()
-			}))
+			client := NewHassClient(svr.URL, token, WithHTTPClient(svr.Client()))
+			defer client.Close()
 
-			if err := client.PostData(context.Background()); err != nil {
+			if err := client.PostData(context.Background(), test.data); err != nil {
 				t.Errorf("unexpected error making Hass Client PostData call: %s", err)
 			}
 			assert.Equal(t, test.data, gotValues)
@@ -194,6 +1249,534 @@ func TestWebhookClient(t *testing.T) {
 	}
 }
 
+func TestWebhookClientRetry(t *testing.T) {
+	const token = "test-token"
+
+	policy := RetryPolicy{
+		MaxAttempts:          3,
+		BaseDelay:            100 * time.Millisecond,
+		MaxDelay:             time.Second,
+		RetryableStatusCodes: []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+	}
+
+	tests := []struct {
+		name         string
+		responses    []int
+		retryAfter   string
+		noMaxDelay   bool
+		wantErr      bool
+		wantRequests int
+		wantDelays   []time.Duration
+	}{
+		{
+			name:         "succeeds after transient failures",
+			responses:    []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK},
+			wantRequests: 3,
+			wantDelays:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+		},
+		{
+			name:         "gives up after max attempts",
+			responses:    []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			wantErr:      true,
+			wantRequests: 3,
+			wantDelays:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+		},
+		{
+			name:         "does not retry non-retryable status",
+			responses:    []int{http.StatusUnauthorized},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "honors Retry-After capped at max delay",
+			responses:    []int{http.StatusServiceUnavailable, http.StatusOK},
+			retryAfter:   "30",
+			wantRequests: 2,
+			wantDelays:   []time.Duration{time.Second},
+		},
+		{
+			name:         "caps Retry-After without max delay",
+			responses:    []int{http.StatusServiceUnavailable, http.StatusOK},
+			retryAfter:   "86400",
+			noMaxDelay:   true,
+			wantRequests: 2,
+			wantDelays:   []time.Duration{maxRetryAfter},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests atomic.Int32
+			svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(requests.Add(1)) - 1
+				if test.retryAfter != "" {
+					w.Header().Set("Retry-After", test.retryAfter)
+				}
+				w.WriteHeader(test.responses[n])
+			}))
+			defer svr.Close()
+
+			policy := policy
+			if test.noMaxDelay {
+				policy.MaxDelay = 0
+			}
+
+			var attempts []Attempt
+			var delays []time.Duration
+			client := NewHassClient(svr.URL, token,
+				WithHTTPClient(svr.Client()),
+				WithRetryPolicy(policy),
+				WithAttemptHook(func(a Attempt) { attempts = append(attempts, a) }))
+			client.sleepFn = func(_ context.Context, d time.Duration) error {
+				delays = append(delays, d)
+				return nil
+			}
+
+			err := client.PostData(context.Background(), url.Values{"k": {"v"}})
+			if test.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, test.wantRequests, int(requests.Load()))
+			assert.Len(t, attempts, test.wantRequests)
+			assert.Equal(t, test.wantDelays, delays)
+		})
+	}
+
+	t.Run("retries connection refused", func(t *testing.T) {
+		svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		addr := svr.URL
+		svr.Close()
+
+		var attempts int
+		client := NewHassClient(addr, token, WithRetryPolicy(policy),
+			WithAttemptHook(func(Attempt) { attempts++ }))
+		client.sleepFn = func(context.Context, time.Duration) error { return nil }
+
+		assert.Error(t, client.PostData(context.Background(), url.Values{}))
+		assert.Equal(t, policy.MaxAttempts, attempts)
+	})
+}
+
+func TestWebhookClientReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A body that must be drained before the connection can be reused.
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, strings.Repeat("ok", 1024))
+	}))
+	svr.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	svr.Start()
+	defer svr.Close()
+
+	client := NewHassClient(svr.URL, "token")
+	defer client.Close()
+
+	for range 5 {
+		require.NoError(t, client.PostData(context.Background(), url.Values{"k": {"v"}}))
+	}
+	assert.Equal(t, int32(1), conns.Load())
+}
+
+func TestWebhookClientRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer svr.Close()
+	defer close(release)
+
+	client := NewHassClient(svr.URL, "token", WithRequestTimeout(50*time.Millisecond))
+	defer client.Close()
+
+	err := client.PostData(context.Background(), url.Values{"k": {"v"}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// BenchmarkWebhookClient compares a long-lived client with building a new
+// client and transport for every upload, which is what the proxy used to do.
+func BenchmarkWebhookClient(b *testing.B) {
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	tlsConfig := svr.Client().Transport.(*http.Transport).TLSClientConfig
+	values := url.Values{"PASSKEY": {"AAAA"}, "tempf": {"45.5"}, "humidity": {"61"}}
+
+	b.Run("shared", func(b *testing.B) {
+		client := NewHassClient(svr.URL, "token", WithHTTPClient(&http.Client{Transport: NewTransport(tlsConfig)}))
+		defer client.Close()
+
+		for b.Loop() {
+			if err := client.PostData(context.Background(), values); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("per_upload", func(b *testing.B) {
+		for b.Loop() {
+			client := NewHassClient(svr.URL, "token", WithHTTPClient(&http.Client{Transport: NewTransport(tlsConfig)}))
+			if err := client.PostData(context.Background(), values); err != nil {
+				b.Fatal(err)
+			}
+			client.Close()
+		}
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5", now))
+	assert.Equal(t, 10*time.Second, parseRetryAfter(now.Add(10*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
+func TestHandleMetrics(t *testing.T) {
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ha.Close()
+
+	e := echo.New()
+	ctrl := New(ha.URL, "token", "hook", makeZapLogger(t), WithEchoServer(e))
+	defer ctrl.Close()
+	e.POST("/event", ctrl.HandleEventPost)
+	e.GET("/metrics", ctrl.HandleMetrics)
+
+	req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("PASSKEY=AAAA&model=GW2000A&tempf=45.5"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing/123", nil))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	station := ecowitt.Station{Passkey: "AAAA"}.ID()
+	body := rec.Body.String()
+	for _, want := range []string{
+		`ecowitt_proxy_http_requests_total{code="200",method="POST",route="/event"} 1`,
+		`ecowitt_proxy_http_requests_total{code="404",method="GET",route="other"} 1`,
+		`ecowitt_proxy_forward_duration_seconds_count{result="success",target="default"} 1`,
+		`ecowitt_proxy_forwarded_total{target="default"} 1`,
+		`ecowitt_proxy_forward_attempts_total{target="default"} 1`,
+		`ecowitt_proxy_rejected_total 0`,
+		`ecowitt_sensor_value{field="tempf",group="outdoor",kind="temperature",station="` + station + `",unit="°F"} 45.5`,
+		`ecowitt_last_upload_timestamp_seconds{model="GW2000A",station="` + station + `"}`,
+	} {
+		assert.Contains(t, body, want)
+	}
+	assert.NotContains(t, body, "AAAA")
+}
+
+func TestMetricsSinkNames(t *testing.T) {
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ha.Close()
+
+	relay, err := wunderground.NewRelay(wunderground.Service{
+		Name: "mqtt", URL: ha.URL, StationID: "KXXX1", StationKey: "key",
+	})
+	require.NoError(t, err)
+
+	e := echo.New()
+	ctrl := New(ha.URL, "token", "hook", makeZapLogger(t), WithEchoServer(e),
+		WithSinks(&fakeSink{name: "mqtt"}, relay))
+	defer ctrl.Close()
+	e.POST("/event", ctrl.HandleEventPost)
+	e.GET("/metrics", ctrl.HandleMetrics)
+
+	req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("PASSKEY=AAAA&tempf=45.5"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	// A relay named like another sink must not break the scrape.
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `ecowitt_proxy_sink_published_total{sink="mqtt"} 1`)
+	assert.Contains(t, rec.Body.String(), `ecowitt_proxy_sink_published_total{sink="relay/mqtt"} 1`)
+}
+
+func TestMetricsStationLimit(t *testing.T) {
+	ctrl := New("", "", "", makeZapLogger(t))
+	defer ctrl.Close()
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := range MaxStations + 5 {
+		payload := ecowitt.Parse(url.Values{"PASSKEY": {fmt.Sprintf("STATION%d", i)}, "tempf": {"45.5"}})
+		ctrl.metrics.recordReadings(start.Add(time.Duration(i)*time.Minute), payload)
+	}
+
+	rec := httptest.NewRecorder()
+	ctrl.HandleMetrics(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/metrics", nil), rec))
+	body := rec.Body.String()
+
+	assert.Equal(t, MaxStations, strings.Count(body, "ecowitt_last_upload_timestamp_seconds{"))
+	assert.Equal(t, MaxStations, strings.Count(body, "ecowitt_sensor_value{"))
+	for i := range 5 {
+		assert.NotContains(t, body, ecowitt.Station{Passkey: fmt.Sprintf("STATION%d", i)}.ID())
+	}
+	assert.Contains(t, body, ecowitt.Station{Passkey: fmt.Sprintf("STATION%d", MaxStations+4)}.ID())
+}
+
+func TestServeAdminListener(t *testing.T) {
+	// Borrow the test certificate and a client that trusts it.
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certSrv.Close()
+
+	ctrl := New("", "", "", makeZapLogger(t),
+		WithAdminListener("127.0.0.1:0", certSrv.TLS.Clone()))
+	defer ctrl.Close()
+	ctrl.echoSrv.HideBanner = true
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ctrl.Serve("127.0.0.1:0")
+	}()
+
+	require.Eventually(t, func() bool {
+		return ctrl.echoSrv.ListenerAddr() != nil && ctrl.adminSrv.TLSListenerAddr() != nil
+	}, time.Second, 10*time.Millisecond)
+	gateway := "http://" + ctrl.echoSrv.ListenerAddr().String()
+	admin := "https://" + ctrl.adminSrv.TLSListenerAddr().String()
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{url: admin + "/metrics", want: http.StatusOK},
+		{url: admin + "/health", want: http.StatusOK},
+		{url: gateway + "/health", want: http.StatusOK},
+		{url: gateway + "/metrics", want: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		resp, err := certSrv.Client().Get(test.url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, test.want, resp.StatusCode, test.url)
+	}
+
+	require.NoError(t, ctrl.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-served, http.ErrServerClosed)
+}
+
+func TestAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("admin-password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ha.Close()
+
+	ctrl := New(ha.URL, "token", "hook", makeZapLogger(t), WithAuth(AuthConfig{
+		BasicUsers:     map[string]string{"admin": string(hash)},
+		BearerTokens:   []string{"scrape-token"},
+		ProxyHeader:    "X-Remote-User",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}))
+	defer ctrl.Close()
+	ctrl.echoSrv.HideBanner = true
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ctrl.Serve("127.0.0.1:0")
+	}()
+	require.Eventually(t, func() bool {
+		return ctrl.echoSrv.ListenerAddr() != nil
+	}, time.Second, 10*time.Millisecond)
+	base := "http://" + ctrl.echoSrv.ListenerAddr().String()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		user   string
+		pass   string
+		want   int
+	}{
+		{name: "no credentials", path: "/status", want: http.StatusUnauthorized},
+		{name: "basic", path: "/status", user: "admin", pass: "admin-password", want: http.StatusOK},
+		{name: "wrong password", path: "/status", user: "admin", pass: "wrong", want: http.StatusUnauthorized},
+		{name: "unknown user", path: "/status", user: "root", pass: "admin-password", want: http.StatusUnauthorized},
+		{name: "bearer", path: "/metrics", header: http.Header{"Authorization": {"Bearer scrape-token"}}, want: http.StatusOK},
+		{name: "wrong bearer", path: "/metrics", header: http.Header{"Authorization": {"Bearer other"}}, want: http.StatusUnauthorized},
+		{name: "trusted proxy", path: "/status", header: http.Header{"X-Remote-User": {"alice"}}, want: http.StatusOK},
+		{name: "dry run", method: http.MethodPost, path: "/rewrite/dry-run", want: http.StatusUnauthorized},
+		{name: "health is open", path: "/health", want: http.StatusOK},
+		{name: "ingest is open", method: http.MethodPost, path: "/event", want: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, err := http.NewRequest(method, base+test.path, strings.NewReader("tempf=45.5"))
+			require.NoError(t, err)
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			for k, v := range test.header {
+				req.Header[k] = v
+			}
+			if test.user != "" {
+				req.SetBasicAuth(test.user, test.pass)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, test.want, resp.StatusCode)
+			if test.want == http.StatusUnauthorized {
+				assert.Equal(t, `Basic realm="hass-ecowitt-proxy"`, resp.Header.Get(echo.HeaderWWWAuthenticate))
+			}
+		})
+	}
+
+	require.NoError(t, ctrl.Shutdown(context.Background()))
+	assert.ErrorIs(t, <-served, http.ErrServerClosed)
+}
+
+func TestAuthUntrustedProxy(t *testing.T) {
+	auth := AuthConfig{
+		ProxyHeader:    "X-Remote-User",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	require.NoError(t, auth.Validate())
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.Header.Set("X-Remote-User", "alice")
+	assert.False(t, auth.authenticate(req))
+
+	req.RemoteAddr = "10.1.2.3:4567"
+	assert.True(t, auth.authenticate(req))
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    AuthConfig
+		wantErr string
+	}{
+		{name: "empty", wantErr: "auth needs at least one of"},
+		{name: "bearer", auth: AuthConfig{BearerTokens: []string{"t"}}},
+		{name: "empty bearer", auth: AuthConfig{BearerTokens: []string{""}}, wantErr: "bearer tokens may not be empty"},
+		{name: "plain password", auth: AuthConfig{BasicUsers: map[string]string{"admin": "secret"}},
+			wantErr: `auth basic user "admin": invalid bcrypt hash`},
+		{name: "untrusted proxy", auth: AuthConfig{ProxyHeader: "X-Remote-User"}, wantErr: "needs trusted proxies"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.auth.Validate()
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestIngestAllowlist(t *testing.T) {
+	var forwarded atomic.Int32
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+	}))
+	defer ha.Close()
+
+	allowlist := IngestAllowlist{
+		Sources:        []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+		Passkeys:       []string{"AAAA"},
+	}
+	require.NoError(t, allowlist.Validate())
+
+	e := echo.New()
+	ctrl := New(ha.URL, "token", "hook", makeZapLogger(t), WithEchoServer(e), WithIngestAllowlist(allowlist))
+	defer ctrl.Close()
+	e.POST("/event", ctrl.HandleEventPost, ctrl.allowSources)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		passkey    string
+		want       int
+	}{
+		{name: "allowed", remoteAddr: "192.0.2.10:4567", passkey: "AAAA", want: http.StatusOK},
+		{name: "passkey case", remoteAddr: "192.0.2.10:4567", passkey: "aaaa", want: http.StatusOK},
+		{name: "source denied", remoteAddr: "198.51.100.7:4567", passkey: "AAAA", want: http.StatusForbidden},
+		{name: "passkey denied", remoteAddr: "192.0.2.10:4567", passkey: "BBBB", want: http.StatusForbidden},
+		{name: "via trusted proxy", remoteAddr: "10.0.0.1:4567", xff: "192.0.2.10", passkey: "AAAA", want: http.StatusOK},
+		{name: "denied via trusted proxy", remoteAddr: "10.0.0.1:4567", xff: "198.51.100.7", passkey: "AAAA",
+			want: http.StatusForbidden},
+		{name: "spoofed by client", remoteAddr: "10.0.0.1:4567", xff: "192.0.2.10, 198.51.100.7", passkey: "AAAA",
+			want: http.StatusForbidden},
+		{name: "untrusted proxy", remoteAddr: "198.51.100.7:4567", xff: "192.0.2.10", passkey: "AAAA",
+			want: http.StatusForbidden},
+		{name: "proxy itself", remoteAddr: "10.0.0.1:4567", passkey: "AAAA", want: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("tempf=45.5&PASSKEY="+test.passkey))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			req.RemoteAddr = test.remoteAddr
+			if test.xff != "" {
+				req.Header.Set(echo.HeaderXForwardedFor, test.xff)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			assert.Equal(t, test.want, rec.Code)
+		})
+	}
+
+	// Denied uploads never reach Home Assistant and are neither errors nor
+	// rejections.
+	assert.Equal(t, int32(3), forwarded.Load())
+	assert.Equal(t, uint32(6), ctrl.GetDeniedCount())
+	assert.Equal(t, uint32(0), ctrl.GetErrorCount())
+	assert.Equal(t, uint32(0), ctrl.GetRejectedCount())
+
+	rec := httptest.NewRecorder()
+	ctrl.HandleMetrics(e.NewContext(httptest.NewRequest(http.MethodGet, "/metrics", nil), rec))
+	assert.Contains(t, rec.Body.String(), `ecowitt_proxy_ingest_denied_total{reason="source"} 5`)
+	assert.Contains(t, rec.Body.String(), `ecowitt_proxy_ingest_denied_total{reason="passkey"} 1`)
+}
+
+func TestIngestAllowlistValidate(t *testing.T) {
+	sources := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	tests := []struct {
+		name      string
+		allowlist IngestAllowlist
+		wantErr   string
+	}{
+		{name: "sources", allowlist: IngestAllowlist{Sources: sources}},
+		{name: "passkeys", allowlist: IngestAllowlist{Passkeys: []string{"AAAA"}}},
+		{name: "empty", wantErr: "needs sources or passkeys"},
+		{name: "proxies only", allowlist: IngestAllowlist{Passkeys: []string{"AAAA"}, TrustedProxies: sources},
+			wantErr: "trusted proxies need sources"},
+		{name: "empty passkey", allowlist: IngestAllowlist{Passkeys: []string{""}}, wantErr: "may not be empty"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.allowlist.Validate()
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.wantErr)
+			}
+		})
+	}
+}
+
 func TestHandleStatus(t *testing.T) {
 	const defaultAddr = "127.0.0.1:8181"
 	const hassUrl = "http://ha.example.com/ecowitt"
@@ -239,3 +1822,136 @@ func TestHandleStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestRedaction(t *testing.T) {
+	const (
+		authToken = "secret-auth-token-5678"
+		webhookID = "secret-webhook-id-1234"
+		passkey   = "0123456789ABCDEF0123456789ABCDEF"
+		password  = "wunderground-password-9999"
+	)
+	secrets := []string{authToken, webhookID, passkey, strings.ToLower(passkey), password}
+
+	// An unreachable target, so that the delivery error quotes the webhook
+	// URL.
+	ha := httptest.NewServer(http.NotFoundHandler())
+	ha.Close()
+
+	core, logs := observer.New(zap.DebugLevel)
+	var echoLog bytes.Buffer
+	e := echo.New()
+	e.Logger.SetOutput(&echoLog)
+
+	ctrl := New(ha.URL, authToken, webhookID, zap.New(core), WithEchoServer(e),
+		WithLogLevel(logging.DebugLevel))
+	defer ctrl.Close()
+	e.POST("/event", ctrl.HandleEventPost)
+	e.GET("/weatherstation/updateweatherstation.php", ctrl.HandleWundergroundGet)
+	e.GET("/status", func(ctx echo.Context) error { return ctrl.HandleStatus(ctx, ":8080") })
+	e.POST("/rewrite/dry-run", ctrl.HandleRewriteDryRun)
+
+	tmpl := template.Must(template.ParseFiles("testdata/status.html"))
+	htmlEcho := echo.New()
+	htmlCtrl := New(ha.URL, authToken, webhookID, zap.New(core), WithTemplates(tmpl), WithEchoServer(htmlEcho))
+	defer htmlCtrl.Close()
+
+	serve := func(method, target, body string) string {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	upload := "PASSKEY=" + passkey + "&tempf=45.5"
+	output := []string{
+		serve(http.MethodPost, "/event", upload),
+		serve(http.MethodGet, "/weatherstation/updateweatherstation.php?ID=KXXX1&PASSWORD="+password+"&tempf=45.5", ""),
+		serve(http.MethodGet, "/missing?PASSWORD="+password, ""),
+		serve(http.MethodGet, "/status", ""),
+		serve(http.MethodPost, "/rewrite/dry-run", upload),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	rec := httptest.NewRecorder()
+	require.NoError(t, htmlCtrl.HandleStatus(htmlEcho.NewContext(req, rec), ":8080"))
+	output = append(output, rec.Body.String())
+
+	for _, entry := range logs.All() {
+		output = append(output, entry.Message)
+		for k, v := range entry.ContextMap() {
+			output = append(output, fmt.Sprintf("%s=%v", k, v))
+		}
+	}
+	output = append(output, echoLog.String())
+
+	all := strings.Join(output, "\n")
+	for _, secret := range secrets {
+		assert.NotContains(t, all, secret)
+	}
+
+	// Masked tokens and hashed PASSKEYs are still recognizable.
+	assert.Contains(t, all, "****1234")
+	assert.Contains(t, all, "****5678")
+	assert.Contains(t, all, ecowitt.Station{Passkey: passkey}.ID())
+	assert.Contains(t, echoLog.String(), "Ecowitt event data")
+}
+
+func TestUploadSecretsAreNotRegistered(t *testing.T) {
+	const (
+		passkey  = "0123456789ABCDEF0123456789ABCDEF"
+		password = "wunderground-password-9999"
+	)
+
+	ha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ha.Close()
+
+	core, logs := observer.New(zap.DebugLevel)
+	var echoLog bytes.Buffer
+	e := echo.New()
+	e.Logger.SetOutput(&echoLog)
+
+	redactor := redact.New()
+	ctrl := New(ha.URL, "secret-auth-token-5678", "secret-webhook-id-1234", zap.New(core), WithEchoServer(e),
+		WithLogLevel(logging.DebugLevel), WithRedactor(redactor))
+	defer ctrl.Close()
+	e.POST("/event", ctrl.HandleEventPost)
+	e.GET("/weatherstation/updateweatherstation.php", ctrl.HandleWundergroundGet)
+
+	var output []string
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("PASSKEY=e&tempf=45.5")),
+		httptest.NewRequest(http.MethodGet, "/weatherstation/updateweatherstation.php?ID=KXXX1&PASSWORD=t&tempf=45.5", nil),
+		httptest.NewRequest(http.MethodPost, "/event", strings.NewReader("PASSKEY="+passkey+"&tempf=45.5")),
+		httptest.NewRequest(http.MethodGet, "/weatherstation/updateweatherstation.php?ID=KXXX1&PASSWORD="+password+"&tempf=45.5", nil),
+	} {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		output = append(output, rec.Body.String())
+	}
+
+	// A one-character PASSKEY or password does not mangle unrelated text.
+	assert.Contains(t, echoLog.String(), "Ecowitt event data")
+	messages := []string{}
+	for _, entry := range logs.All() {
+		messages = append(messages, entry.Message)
+		for k, v := range entry.ContextMap() {
+			output = append(output, fmt.Sprintf("%s=%v", k, v))
+		}
+	}
+	assert.Contains(t, strings.Join(messages, "\n"), "Forwarding Ecowitt event data to target")
+
+	// Secrets from uploads are redacted where they are logged, not by
+	// registering them with the redactor.
+	assert.Equal(t, passkey, redactor.String(passkey))
+	assert.Equal(t, password, redactor.String(password))
+
+	output = append(output, messages...)
+	output = append(output, echoLog.String())
+	all := strings.Join(output, "\n")
+	for _, secret := range []string{passkey, strings.ToLower(passkey), password} {
+		assert.NotContains(t, all, secret)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DerivedMetricsMode selects where the readings computed by the derived
+// package, e.g. dew point and wind chill, are added.
+type DerivedMetricsMode uint8
+
+const (
+	// DerivedMetricsOff forwards uploads as received.
+	DerivedMetricsOff DerivedMetricsMode = iota
+	// DerivedMetricsSinks adds the derived readings for the sinks and the
+	// Prometheus metrics only. Home Assistant receives the upload unchanged.
+	DerivedMetricsSinks
+	// DerivedMetricsAll also adds them to the form data forwarded to Home
+	// Assistant.
+	DerivedMetricsAll
+	InvalidDerivedMetricsMode
+)
+
+var derivedMetricsModeNames = map[DerivedMetricsMode]string{
+	DerivedMetricsOff:   "off",
+	DerivedMetricsSinks: "sinks",
+	DerivedMetricsAll:   "all",
+}
+
+func (m DerivedMetricsMode) String() string {
+	return derivedMetricsModeNames[m]
+}
+
+func DerivedMetricsModeNames() []string {
+	return []string{DerivedMetricsOff.String(), DerivedMetricsSinks.String(), DerivedMetricsAll.String()}
+}
+
+func DerivedMetricsModeFromStr(name string) (DerivedMetricsMode, error) {
+	switch strings.ToLower(name) {
+	case "off":
+		return DerivedMetricsOff, nil
+	case "sinks":
+		return DerivedMetricsSinks, nil
+	case "all":
+		return DerivedMetricsAll, nil
+	default:
+		return InvalidDerivedMetricsMode, fmt.Errorf("invalid derived metrics mode %q", name)
+	}
+}
+
+// WithDerivedMetrics computes derived readings for every accepted upload.
+func WithDerivedMetrics(mode DerivedMetricsMode) Option {
+	return func(c *Controller) {
+		c.derivedMetrics = mode
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"hass-ecowitt-proxy/queue"
+)
+
+const defaultDrainInterval = 30 * time.Second
+
+// forwardQueue is the part of queue.Queue the controller uses.
+type forwardQueue interface {
+	Push(receivedAt time.Time, target string, values url.Values) error
+	PeekTarget(target string) (queue.Item, bool, error)
+	Remove(id uint64) error
+	Len() int
+	LenTarget(target string) int
+	Targets() []string
+	Evicted() uint64
+}
+
+// enqueue persists an upload for later delivery to t. forwardErr is the error
+// from the failed delivery attempt, if there was one.
+func (c *Controller) enqueue(t *target, receivedAt time.Time, values url.Values, forwardErr error) (string, error) {
+	if err := c.queue.Push(receivedAt, t.Name, values); err != nil {
+		t.errorCount.Add(1)
+		c.logger.Errorf("Error queueing event data for later delivery to target %q: %s", t.Name, err)
+		if forwardErr == nil {
+			forwardErr = err
+		}
+		return "", fmt.Errorf("target %q: %w", t.Name, forwardErr)
+	}
+
+	c.queuedCount.Add(1)
+	t.queuedCount.Add(1)
+	c.logger.Infof("Queued Ecowitt event data for later delivery to target %q (queue length %d)",
+		t.Name, c.queue.LenTarget(t.Name))
+	c.kickDrain()
+
+	return "QUEUED", nil
+}
+
+// kickDrain asks the drain loop to run now rather than at the next tick.
+func (c *Controller) kickDrain() {
+	select {
+	case c.drainKick <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Controller) drainLoop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.drainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		case <-c.drainKick:
+		}
+
+		c.drainQueue()
+	}
+}
+
+// drainQueue delivers queued uploads oldest first. Each target is drained
+// independently and stops at its first failure so that its ordering is
+// preserved without an unreachable target holding up the others.
+func (c *Controller) drainQueue() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	c.drainTargets(ctx)
+}
+
+// flushQueue makes a last attempt to deliver queued uploads on shutdown. It is
+// skipped when the drain loop is busy doing the same.
+func (c *Controller) flushQueue(ctx context.Context) {
+	if !c.drainMu.TryLock() {
+		return
+	}
+	defer c.drainMu.Unlock()
+	c.drainTargets(ctx)
+}
+
+func (c *Controller) drainTargets(ctx context.Context) {
+	state := c.current()
+	for _, name := range c.queue.Targets() {
+		t := state.lookupTarget(name)
+		if t == nil {
+			c.logger.Warnf("Queued events for unknown target %q will expire undelivered", name)
+			continue
+		}
+
+		c.drainTarget(ctx, name, t)
+	}
+}
+
+// drainTarget delivers the uploads queued for t. An upload that was delivered
+// but could not be removed from the queue is remembered in c.undeleted, and
+// its removal is retried instead of delivering it again.
+func (c *Controller) drainTarget(ctx context.Context, name string, t *target) {
+	for {
+		item, ok, err := c.queue.PeekTarget(name)
+		if err != nil {
+			c.logger.Errorf("Error reading from forward queue: %s", err)
+			return
+		}
+		if !ok {
+			delete(c.undeleted, name)
+			return
+		}
+
+		if id, ok := c.undeleted[name]; ok && id == item.ID {
+			if err := c.queue.Remove(item.ID); err != nil {
+				c.logger.Errorf("Error removing delivered event %d from forward queue: %s", item.ID, err)
+				return
+			}
+			delete(c.undeleted, name)
+			continue
+		}
+		delete(c.undeleted, name)
+
+		if err := c.forward(ctx, t, item.Values); err != nil {
+			c.logger.Infof("Target %q still unavailable, %d queued events pending: %s",
+				t.Name, c.queue.LenTarget(name), err)
+			return
+		}
+
+		t.eventCount.Add(1)
+		if err := c.queue.Remove(item.ID); err != nil {
+			c.undeleted[name] = item.ID
+			c.logger.Errorf("Error removing delivered event %d from forward queue: %s", item.ID, err)
+			return
+		}
+
+		c.logger.Debugf("Delivered queued event %d received at %s to target %q", item.ID, item.ReceivedAt, t.Name)
+	}
+}
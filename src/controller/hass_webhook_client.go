@@ -17,52 +17,309 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package controller
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"hass-ecowitt-proxy/tlsconfig"
+
+	"go.uber.org/zap"
 )
 
+// RetryPolicy controls how PostData retries failed deliveries. A policy with
+// MaxAttempts of 1 or less makes exactly one attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry. It doubles for every
+	// following retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between attempts, including waits requested by
+	// a Retry-After header. Without it, Retry-After is still capped at
+	// maxRetryAfter.
+	MaxDelay time.Duration
+	// Jitter randomizes each wait by up to this fraction of the delay, in the
+	// range [0, 1].
+	Jitter float64
+	// RetryableStatusCodes lists the HTTP status codes worth retrying.
+	RetryableStatusCodes []int
+}
+
+// maxRetryAfter caps the wait requested by a Retry-After header when the
+// policy has no MaxDelay, so that a misbehaving server cannot stall delivery
+// for hours.
+const maxRetryAfter = time.Minute
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:          3,
+		BaseDelay:            500 * time.Millisecond,
+		MaxDelay:             5 * time.Second,
+		Jitter:               0.2,
+		RetryableStatusCodes: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	}
+}
+
+func (p RetryPolicy) Validate() error {
+	if p.BaseDelay < 0 || p.MaxDelay < 0 {
+		return errors.New("retry delays must not be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	return nil
+}
+
+// backoff returns the wait before the given retry, where retry 1 is the wait
+// after the first failed attempt.
+func (p RetryPolicy) backoff(retry int, randFn func() float64) time.Duration {
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(retry-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*randFn()-1)
+	}
+	return time.Duration(delay)
+}
+
+// StatusError is returned by PostData when Home Assistant responds with
+// anything other than 200 OK.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Response   string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error making request to %q. Response code: %d. Response: %s",
+		e.URL, e.StatusCode, e.Response)
+}
+
+// Attempt describes the outcome of a single delivery attempt.
+type Attempt struct {
+	Number int
+	Err    error
+	Retry  bool
+}
+
+type AttemptHookFn func(Attempt)
+
+// DefaultRequestTimeout bounds a single delivery attempt, from dialing until
+// the response body has been read.
+const DefaultRequestTimeout = 10 * time.Second
+
+// maxResponseBody is the most read from a Home Assistant response. Anything
+// beyond it is discarded, which still allows the connection to be reused.
+const maxResponseBody = 64 << 10
+
+// HassWebhookClient delivers uploads to a single Home Assistant webhook. It
+// is safe for concurrent use and meant to live as long as the target, so
+// that connections are kept alive and reused between uploads.
 type HassWebhookClient struct {
 	authToken string
-	formData  url.Values
 	url       string
 
-	openClientFn HassOpenHttpFn
+	httpClient     *http.Client
+	requestTimeout time.Duration
+	retryPolicy    RetryPolicy
+	attemptHook    AttemptHookFn
+	logger         *zap.SugaredLogger
+	randFn         func() float64
+	sleepFn        func(context.Context, time.Duration) error
 }
 
 type HassClientOption func(*HassWebhookClient)
 
-func WithOpenClientFn(openHttpClientFn HassOpenHttpFn) HassClientOption {
+// WithHTTPClient replaces the client's pooled HTTP client.
+func WithHTTPClient(client *http.Client) HassClientOption {
 	return func(hc *HassWebhookClient) {
-		hc.openClientFn = openHttpClientFn
+		hc.httpClient = client
 	}
 }
 
-type HassOpenHttpFn func() *http.Client
+// WithRequestTimeout bounds each delivery attempt. Zero means no timeout.
+func WithRequestTimeout(timeout time.Duration) HassClientOption {
+	return func(hc *HassWebhookClient) {
+		hc.requestTimeout = timeout
+	}
+}
 
-func defaultHassOpenHttpFn() *http.Client {
-	return &http.Client{}
+func WithRetryPolicy(policy RetryPolicy) HassClientOption {
+	return func(hc *HassWebhookClient) {
+		hc.retryPolicy = policy
+	}
+}
+
+// WithAttemptHook registers a function that is called after every delivery
+// attempt, successful or not.
+func WithAttemptHook(hook AttemptHookFn) HassClientOption {
+	return func(hc *HassWebhookClient) {
+		hc.attemptHook = hook
+	}
+}
+
+func WithClientLogger(logger *zap.SugaredLogger) HassClientOption {
+	return func(hc *HassWebhookClient) {
+		hc.logger = logger
+	}
+}
+
+// NewTransport returns a pooled transport tuned for repeated uploads to a
+// small number of Home Assistant instances. HTTP/2 is used when the server
+// supports it, also with a custom tlsConfig.
+func NewTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
 }
 
-func NewHassClient(url string, authToken string, formData url.Values, opts ...HassClientOption) *HassWebhookClient {
+// newTLSHTTPClient returns an HTTP client that connects with the given TLS
+// settings. Settings that cannot be loaded make every request fail with the
+// error.
+func newTLSHTTPClient(settings tlsconfig.Client) *http.Client {
+	tlsConfig, err := settings.Config()
+	if err != nil {
+		return &http.Client{Transport: errTransport{err: err}}
+	}
+	return &http.Client{Transport: NewTransport(tlsConfig)}
+}
+
+// errTransport fails every request with err.
+type errTransport struct {
+	err error
+}
+
+func (t errTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func NewHassClient(url string, authToken string, opts ...HassClientOption) *HassWebhookClient {
 	hc := &HassWebhookClient{
-		authToken:    authToken,
-		formData:     formData,
-		url:          url,
-		openClientFn: defaultHassOpenHttpFn,
+		authToken:      authToken,
+		url:            url,
+		requestTimeout: DefaultRequestTimeout,
+		retryPolicy:    RetryPolicy{MaxAttempts: 1},
+		logger:         zap.NewNop().Sugar(),
+		randFn:         rand.Float64,
+		sleepFn:        sleepContext,
 	}
 
 	for _, opt := range opts {
 		opt(hc)
 	}
+	if hc.httpClient == nil {
+		hc.httpClient = &http.Client{Transport: NewTransport(nil)}
+	}
 	return hc
 }
 
-func (hc *HassWebhookClient) PostData(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, "POST", hc.url, strings.NewReader(hc.formData.Encode()))
+// Close releases idle connections.
+func (hc *HassWebhookClient) Close() {
+	hc.httpClient.CloseIdleConnections()
+}
+
+// PostData delivers the form data to Home Assistant, retrying transient
+// failures according to the client's RetryPolicy.
+func (hc *HassWebhookClient) PostData(ctx context.Context, formData url.Values) error {
+	maxAttempts := max(hc.retryPolicy.MaxAttempts, 1)
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = hc.postOnce(ctx, formData)
+		retry := err != nil && attempt < maxAttempts && ctx.Err() == nil && hc.isRetryable(err)
+
+		if hc.attemptHook != nil {
+			hc.attemptHook(Attempt{Number: attempt, Err: err, Retry: retry})
+		}
+
+		if err == nil {
+			hc.logger.Debugf("Attempt %d/%d to deliver to %s succeeded", attempt, maxAttempts, hc.url)
+			return nil
+		}
+		if !retry {
+			hc.logger.Debugf("Attempt %d/%d to deliver to %s failed: %s", attempt, maxAttempts, hc.url, err)
+			return err
+		}
+
+		delay := hc.retryPolicy.backoff(attempt, hc.randFn)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+			delay = min(statusErr.RetryAfter, maxRetryAfter)
+		}
+		if hc.retryPolicy.MaxDelay > 0 && delay > hc.retryPolicy.MaxDelay {
+			delay = hc.retryPolicy.MaxDelay
+		}
+
+		hc.logger.Warnf("Attempt %d/%d to deliver to %s failed, retrying in %s: %s",
+			attempt, maxAttempts, hc.url, delay, err)
+
+		if sleepErr := hc.sleepFn(ctx, delay); sleepErr != nil {
+			return fmt.Errorf("%w (retry abandoned: %w)", err, sleepErr)
+		}
+	}
+
+	return err
+}
+
+func (hc *HassWebhookClient) isRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return slices.Contains(hc.retryPolicy.RetryableStatusCodes, statusErr.StatusCode)
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (hc *HassWebhookClient) postOnce(ctx context.Context, formData url.Values) error {
+	if hc.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hc.requestTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", hc.url, strings.NewReader(formData.Encode()))
 	if err != nil {
 		return fmt.Errorf("error creating HTTP request for %s: %w", hc.url, err)
 	}
@@ -70,20 +327,49 @@ func (hc *HassWebhookClient) PostData(ctx context.Context) error {
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", hc.authToken))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	client := hc.openClientFn()
-	resp, err := client.Do(req)
+	resp, err := hc.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("error making request to %q: %w", hc.url, err)
 	}
+	defer func() {
+		// Drain the body so the connection can be reused.
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBody))
+		resp.Body.Close()
+	}()
 
 	if resp.StatusCode != 200 {
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(resp.Body)
-		respMsg := buf.String()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
 
-		return fmt.Errorf("error making request to %q. Response code: %d. Response: %s",
-			hc.url, resp.StatusCode, respMsg)
+		return &StatusError{
+			URL:        hc.url,
+			StatusCode: resp.StatusCode,
+			Response:   string(body),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 	}
 
 	return nil
 }
+
+// parseRetryAfter understands both forms of the Retry-After header: a number
+// of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		if d := when.Sub(now); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,283 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "ecowitt_proxy"
+	sensorNamespace  = "ecowitt"
+)
+
+// MaxStations bounds the number of stations that per-station state is kept
+// for, such as sensor metric series and the last good values of the outlier
+// filter, so that uploads with made-up PASSKEYs cannot grow it without limit.
+// When a new station appears beyond it, the station that has been silent the
+// longest is forgotten.
+const MaxStations = 32
+
+// metrics holds the Prometheus metrics that are not derived from the
+// controller's own counters.
+type metrics struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+
+	requests        *prometheus.CounterVec
+	forwardDuration *prometheus.HistogramVec
+	readings        *prometheus.GaugeVec
+	lastUpload      *prometheus.GaugeVec
+
+	// stations holds the time of the latest upload of every station with
+	// sensor series, at most maxStations of them.
+	stationsMu  sync.Mutex
+	stations    map[string]time.Time
+	maxStations int
+}
+
+func newMetrics(c *Controller, maxStations int) *metrics {
+	m := &metrics{
+		registry:    prometheus.NewRegistry(),
+		stations:    map[string]time.Time{},
+		maxStations: maxStations,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests handled, by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		forwardDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "forward_duration_seconds",
+			Help:      "Time taken to deliver an upload to a Home Assistant target, including retries.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"target", "result"}),
+		readings: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: sensorNamespace,
+			Name:      "sensor_value",
+			Help:      "Latest reading of each sensor field, in the units reported by the gateway.",
+		}, []string{"station", "field", "group", "kind", "unit"}),
+		lastUpload: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: sensorNamespace,
+			Name:      "last_upload_timestamp_seconds",
+			Help:      "Time of the latest upload received from each station.",
+		}, []string{"station", "model"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.forwardDuration,
+		m.readings,
+		m.lastUpload,
+		&controllerCollector{c: c},
+	)
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+
+	return m
+}
+
+// middleware counts every request handled by the echo server.
+func (m *metrics) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		err := next(ctx)
+
+		code := ctx.Response().Status
+		if err != nil {
+			code = http.StatusInternalServerError
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				code = he.Code
+			}
+		}
+
+		// Only label with registered routes to keep the number of series
+		// bounded.
+		route := ctx.Path()
+		if code == http.StatusNotFound || route == "" {
+			route = "other"
+		}
+
+		m.requests.WithLabelValues(route, ctx.Request().Method, strconv.Itoa(code)).Inc()
+		return err
+	}
+}
+
+func (m *metrics) observeForward(t *target, d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.forwardDuration.WithLabelValues(t.Name, result).Observe(d.Seconds())
+}
+
+// recordReadings updates the sensor gauges of the station that sent the
+// payload. Stations are identified by Station.ID so the PASSKEY is never
+// exposed.
+func (m *metrics) recordReadings(receivedAt time.Time, payload *ecowitt.Payload) {
+	station := payload.Station.ID()
+
+	m.stationsMu.Lock()
+	defer m.stationsMu.Unlock()
+	if _, ok := m.stations[station]; !ok && len(m.stations) >= m.maxStations {
+		m.evictStationLocked()
+	}
+	m.stations[station] = receivedAt
+	m.lastUpload.WithLabelValues(station, payload.Station.Model).Set(float64(receivedAt.UnixNano()) / 1e9)
+
+	payload.Each(func(name string, v float64) {
+		info, _ := ecowitt.FieldInfo(name)
+		m.readings.WithLabelValues(station, name, info.Group, info.Kind.String(), info.Unit).Set(v)
+	})
+}
+
+// evictStationLocked deletes the series of the station that has been silent
+// the longest.
+func (m *metrics) evictStationLocked() {
+	var oldest string
+	var oldestAt time.Time
+	for station, at := range m.stations {
+		if oldest == "" || at.Before(oldestAt) {
+			oldest, oldestAt = station, at
+		}
+	}
+
+	delete(m.stations, oldest)
+	m.readings.DeletePartialMatch(prometheus.Labels{"station": oldest})
+	m.lastUpload.DeletePartialMatch(prometheus.Labels{"station": oldest})
+}
+
+var (
+	targetLabels = []string{"target"}
+	sinkLabels   = []string{"sink"}
+
+	descForwarded = prometheus.NewDesc(metricsNamespace+"_forwarded_total",
+		"Uploads delivered to a Home Assistant target.", targetLabels, nil)
+	descForwardErrors = prometheus.NewDesc(metricsNamespace+"_forward_errors_total",
+		"Uploads that could not be delivered to a Home Assistant target.", targetLabels, nil)
+	descQueued = prometheus.NewDesc(metricsNamespace+"_queued_total",
+		"Uploads stored in the forward queue for later delivery.", targetLabels, nil)
+	descAttempts = prometheus.NewDesc(metricsNamespace+"_forward_attempts_total",
+		"Delivery attempts made to a Home Assistant target, including retries.", targetLabels, nil)
+	descRetries = prometheus.NewDesc(metricsNamespace+"_forward_retries_total",
+		"Delivery attempts that were retries.", targetLabels, nil)
+	descQueueLength = prometheus.NewDesc(metricsNamespace+"_queue_length",
+		"Uploads waiting in the forward queue.", targetLabels, nil)
+	descQueueEvicted = prometheus.NewDesc(metricsNamespace+"_queue_evicted_total",
+		"Uploads discarded from the forward queue because it was full or they expired.", nil, nil)
+	descRejected = prometheus.NewDesc(metricsNamespace+"_rejected_total",
+		"Uploads refused before any delivery was attempted.", nil, nil)
+	descDenied = prometheus.NewDesc(metricsNamespace+"_ingest_denied_total",
+		"Uploads refused by the ingest allowlist, by reason.", []string{"reason"}, nil)
+	descAsyncQueueLength = prometheus.NewDesc(metricsNamespace+"_async_queue_length",
+		"Uploads waiting for an asynchronous delivery worker.", nil, nil)
+	descAsyncDropped = prometheus.NewDesc(metricsNamespace+"_async_dropped_total",
+		"Uploads dropped because the asynchronous delivery queue was full or the proxy shut down first.",
+		nil, nil)
+	descSinkPublished = prometheus.NewDesc(metricsNamespace+"_sink_published_total",
+		"Uploads published to a sink.", sinkLabels, nil)
+	descSinkErrors = prometheus.NewDesc(metricsNamespace+"_sink_errors_total",
+		"Uploads that could not be published to a sink.", sinkLabels, nil)
+	descReloads = prometheus.NewDesc(metricsNamespace+"_config_reloads_total",
+		"Configuration reloads by result.", []string{"result"}, nil)
+	descFiltered = prometheus.NewDesc(metricsNamespace+"_readings_filtered_total",
+		"Readings that failed the outlier filter, by field, reason and action taken.",
+		[]string{"field", "reason", "action"}, nil)
+)
+
+// controllerCollector exports the controller's counters at scrape time.
+type controllerCollector struct {
+	c *Controller
+}
+
+func (cc *controllerCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		descForwarded, descForwardErrors, descQueued, descAttempts, descRetries,
+		descQueueLength, descQueueEvicted, descRejected, descDenied, descAsyncQueueLength,
+		descAsyncDropped, descSinkPublished, descSinkErrors, descReloads, descFiltered,
+	} {
+		ch <- d
+	}
+}
+
+func (cc *controllerCollector) Collect(ch chan<- prometheus.Metric) {
+	c := cc.c
+
+	counter := func(d *prometheus.Desc, v uint32, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+	}
+	gauge := func(d *prometheus.Desc, v int, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v), labels...)
+	}
+
+	for _, ts := range c.targetStatuses() {
+		counter(descForwarded, ts.EventCount, ts.Name)
+		counter(descForwardErrors, ts.ErrorCount, ts.Name)
+		counter(descQueued, ts.QueuedCount, ts.Name)
+		counter(descAttempts, ts.AttemptCount, ts.Name)
+		counter(descRetries, ts.RetryCount, ts.Name)
+		if c.queue != nil {
+			gauge(descQueueLength, ts.QueueLength, ts.Name)
+		}
+	}
+
+	counter(descRejected, c.GetRejectedCount())
+	counter(descDenied, c.deniedSource.Load(), DenySource)
+	counter(descDenied, c.deniedPasskey.Load(), DenyPasskey)
+
+	if c.queue != nil {
+		ch <- prometheus.MustNewConstMetric(descQueueEvicted, prometheus.CounterValue, float64(c.queue.Evicted()))
+	}
+
+	if c.async != nil {
+		gauge(descAsyncQueueLength, len(c.async.jobs))
+		counter(descAsyncDropped, c.async.dropped.Load())
+	}
+
+	for _, ss := range c.sinkStatuses() {
+		counter(descSinkPublished, ss.EventCount, ss.Name)
+		counter(descSinkErrors, ss.ErrorCount, ss.Name)
+	}
+
+	reload := c.GetReloadStatus()
+	counter(descReloads, reload.Count-reload.Failures, "success")
+	counter(descReloads, reload.Failures, "failure")
+
+	if c.outliers != nil {
+		for k, v := range c.outliers.Counts() {
+			ch <- prometheus.MustNewConstMetric(descFiltered, prometheus.CounterValue, float64(v),
+				k.Field, k.Reason, k.Action)
+		}
+	}
+}
+
+func (c *Controller) HandleMetrics(ctx echo.Context) error {
+	c.metrics.handler.ServeHTTP(ctx.Response(), ctx.Request())
+	return nil
+}
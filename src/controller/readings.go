@@ -0,0 +1,39 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"hass-ecowitt-proxy/calibration"
+	"hass-ecowitt-proxy/outlier"
+)
+
+// WithCalibration corrects readings before an upload is forwarded, so that
+// Home Assistant, the sinks and the metrics all see the calibrated values.
+// Derived readings are computed from the calibrated values.
+func WithCalibration(rules calibration.Rules) Option {
+	return func(c *Controller) {
+		c.calibration = rules
+	}
+}
+
+// WithOutlierFilter checks the calibrated readings of every upload against
+// the filter's limits before they are forwarded.
+func WithOutlierFilter(f *outlier.Filter) Option {
+	return func(c *Controller) {
+		c.outliers = f
+	}
+}
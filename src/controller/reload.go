@@ -0,0 +1,144 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"time"
+
+	"hass-ecowitt-proxy/calibration"
+	"hass-ecowitt-proxy/logging"
+	"hass-ecowitt-proxy/rewrite"
+)
+
+// state is the part of the configuration that Reload replaces while the
+// controller is running. Each upload uses the state that was current when it
+// arrived.
+type state struct {
+	targets     []*target
+	routing     RoutingConfig
+	rewriter    *rewrite.Rewriter
+	calibration calibration.Rules
+}
+
+func (c *Controller) current() *state {
+	return c.state.Load()
+}
+
+// newState builds the runtime targets of cfg. Targets that already exist in
+// old keep their counters.
+func (c *Controller) newState(cfg ReloadConfig, old *state) *state {
+	s := &state{routing: cfg.Routing, rewriter: cfg.Rewriter, calibration: cfg.Calibration}
+	for _, t := range cfg.Targets {
+		c.redactor.AddToken(t.AuthToken, t.WebhookID)
+
+		var counters *targetCounters
+		if old != nil {
+			for _, ot := range old.targets {
+				if ot.Name == t.Name {
+					counters = ot.targetCounters
+					break
+				}
+			}
+		}
+		s.targets = append(s.targets, c.newTarget(t, counters))
+	}
+	return s
+}
+
+// ReloadConfig is the part of the configuration that can change without a
+// restart.
+type ReloadConfig struct {
+	Targets     []Target
+	Routing     RoutingConfig
+	Rewriter    *rewrite.Rewriter
+	Calibration calibration.Rules
+	LogLevel    logging.LogLevel
+}
+
+// ReloadStatus describes the configuration reloads so far.
+type ReloadStatus struct {
+	Count    uint32
+	Failures uint32
+	Last     time.Time
+	// Error is the error of the last reload, empty if it succeeded.
+	Error string
+}
+
+// Reload calls load for a new configuration and, if it is valid, swaps in its
+// targets, routing, rewrite rules, calibration and log level. Uploads in
+// flight finish with the previous targets. The previous configuration stays in
+// place when load fails or the new configuration is invalid.
+func (c *Controller) Reload(load func() (ReloadConfig, error)) error {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	err := c.reload(load)
+
+	c.reloadStatus.Count++
+	c.reloadStatus.Last = time.Now()
+	c.reloadStatus.Error = ""
+	if err != nil {
+		c.reloadStatus.Failures++
+		c.reloadStatus.Error = err.Error()
+		c.logger.Errorf("Configuration reload failed, keeping the previous configuration: %s", err)
+		return err
+	}
+
+	c.logger.Infof("Configuration reloaded with %d targets", len(c.current().targets))
+	return nil
+}
+
+func (c *Controller) reload(load func() (ReloadConfig, error)) error {
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	if err := ValidateTargets(cfg.Targets); err != nil {
+		return err
+	}
+	if err := cfg.Routing.Validate(cfg.Targets); err != nil {
+		return err
+	}
+	if err := cfg.Calibration.Validate(); err != nil {
+		return err
+	}
+
+	old := c.current()
+	c.state.Store(c.newState(cfg, old))
+	c.SetLogLevel(cfg.LogLevel)
+
+	// Deliveries still using the old clients are not interrupted, only idle
+	// connections are released.
+	for _, t := range old.targets {
+		t.client.Close()
+	}
+	return nil
+}
+
+// SetLogLevel changes the log level of the HTTP listeners.
+func (c *Controller) SetLogLevel(level logging.LogLevel) {
+	c.echoSrv.Logger.SetLevel(level.ToGommon())
+	if c.adminSrv != nil {
+		c.adminSrv.Logger.SetLevel(level.ToGommon())
+	}
+}
+
+func (c *Controller) GetReloadStatus() ReloadStatus {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	return c.reloadStatus
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"net/http"
+	"net/url"
+
+	"hass-ecowitt-proxy/redact"
+	"hass-ecowitt-proxy/rewrite"
+
+	"github.com/labstack/echo/v4"
+)
+
+// WithRewriter applies rewrite rules to every upload after it has been
+// routed, before anything else looks at its fields.
+func WithRewriter(rw *rewrite.Rewriter) Option {
+	return func(c *Controller) {
+		c.rewriter = rw
+	}
+}
+
+// rewrite applies the rewrite rules of s. Rules that fail are logged and
+// skipped.
+func (c *Controller) rewrite(ctx echo.Context, s *state, values url.Values) url.Values {
+	rewritten, applied, err := s.rewriter.Apply(values)
+	if err != nil {
+		ctx.Logger().Warnf("Error rewriting upload: %s", err)
+	}
+	if len(applied) > 0 {
+		ctx.Logger().Debugf("Rewrite rules applied: %v", applied)
+	}
+	return rewritten
+}
+
+// RewriteDryRun is the response of HandleRewriteDryRun.
+type RewriteDryRun struct {
+	Input   url.Values
+	Output  url.Values
+	Applied []string
+	Error   string `json:",omitempty"`
+}
+
+// HandleRewriteDryRun applies the current rewrite rules to the posted form
+// data and returns the result without forwarding anything. It accepts the
+// same body as HandleEventPost. Secret fields are redacted in the response.
+func (c *Controller) HandleRewriteDryRun(ctx echo.Context) error {
+	values, err := ctx.FormParams()
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, c.NewErrorResponse("Error retrieving form parameters", err))
+	}
+
+	rewritten, applied, err := c.current().rewriter.Apply(values)
+	resp := RewriteDryRun{Input: redact.Values(values), Output: redact.Values(rewritten), Applied: applied}
+	if resp.Applied == nil {
+		resp.Applied = []string{}
+	}
+	if err != nil {
+		resp.Error = c.redactor.String(err.Error())
+	}
+	return ctx.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const (
+	RouteFieldPasskey     = "PASSKEY"
+	RouteFieldStationType = "stationtype"
+	RouteFieldModel       = "model"
+)
+
+var errUnknownStation = errors.New("no route for station")
+
+// Route sends uploads whose Field equals Value to the named targets.
+type Route struct {
+	Field   string
+	Value   string
+	Targets []string
+}
+
+func (r Route) matches(values url.Values) bool {
+	return strings.EqualFold(values.Get(r.Field), r.Value)
+}
+
+// RoutingConfig decides which targets receive an upload. Routes are checked
+// in order and the first match wins. Uploads that match no route go to
+// DefaultTargets, or to every target when DefaultTargets is empty, unless
+// RejectUnknown is set.
+type RoutingConfig struct {
+	Routes         []Route
+	DefaultTargets []string
+	RejectUnknown  bool
+}
+
+// Validate checks that every route uses a supported field and only refers to
+// targets in the given list.
+func (rc RoutingConfig) Validate(targets []Target) error {
+	known := func(name string) bool {
+		return slices.ContainsFunc(targets, func(t Target) bool { return t.Name == name })
+	}
+
+	for i, r := range rc.Routes {
+		switch r.Field {
+		case RouteFieldPasskey, RouteFieldStationType, RouteFieldModel:
+		default:
+			return fmt.Errorf("route %d: unsupported field %q, must be one of %s, %s, %s",
+				i, r.Field, RouteFieldPasskey, RouteFieldStationType, RouteFieldModel)
+		}
+		if r.Value == "" {
+			return fmt.Errorf("route %d: missing value", i)
+		}
+		if len(r.Targets) == 0 {
+			return fmt.Errorf("route %d: missing targets", i)
+		}
+		for _, name := range r.Targets {
+			if !known(name) {
+				return fmt.Errorf("route %d: unknown target %q", i, name)
+			}
+		}
+	}
+
+	for _, name := range rc.DefaultTargets {
+		if !known(name) {
+			return fmt.Errorf("default route: unknown target %q", name)
+		}
+	}
+
+	return nil
+}
+
+func WithRouting(cfg RoutingConfig) Option {
+	return func(c *Controller) {
+		c.routingConfig = cfg
+	}
+}
+
+// route picks the targets for an upload.
+func (c *Controller) route(values url.Values) ([]*target, error) {
+	return c.current().route(values)
+}
+
+func (s *state) route(values url.Values) ([]*target, error) {
+	for _, r := range s.routing.Routes {
+		if r.matches(values) {
+			return s.targetsNamed(r.Targets), nil
+		}
+	}
+
+	if s.routing.RejectUnknown {
+		return nil, fmt.Errorf("%w: %s=%q, %s=%q", errUnknownStation,
+			RouteFieldStationType, values.Get(RouteFieldStationType),
+			RouteFieldModel, values.Get(RouteFieldModel))
+	}
+
+	if len(s.routing.DefaultTargets) > 0 {
+		return s.targetsNamed(s.routing.DefaultTargets), nil
+	}
+
+	return s.targets, nil
+}
+
+func (s *state) targetsNamed(names []string) []*target {
+	targets := make([]*target, 0, len(names))
+	for _, name := range names {
+		for _, t := range s.targets {
+			if t.Name == name {
+				targets = append(targets, t)
+				break
+			}
+		}
+	}
+	return targets
+}
@@ -0,0 +1,123 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hass-ecowitt-proxy/derived"
+	"hass-ecowitt-proxy/ecowitt"
+)
+
+// Sink receives every accepted upload in addition to the Home Assistant
+// webhook targets, e.g. to publish it to an MQTT broker. Publish is called
+// concurrently for all sinks with the same payload, so sinks must not modify
+// it.
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, receivedAt time.Time, payload *ecowitt.Payload) error
+}
+
+// WithSinks adds sinks that every accepted upload is published to. The
+// caller remains responsible for closing them after the controller.
+func WithSinks(sinks ...Sink) Option {
+	return func(c *Controller) {
+		for _, s := range sinks {
+			c.sinks = append(c.sinks, &sink{Sink: s})
+		}
+	}
+}
+
+// sink is the runtime state of a Sink.
+type sink struct {
+	Sink
+
+	eventCount atomic.Uint32
+	errorCount atomic.Uint32
+}
+
+// SinkStatus is the per-sink section of the status page.
+type SinkStatus struct {
+	Name       string
+	EventCount uint32
+	ErrorCount uint32
+}
+
+func (c *Controller) sinkStatuses() []SinkStatus {
+	statuses := make([]SinkStatus, 0, len(c.sinks))
+	for _, s := range c.sinks {
+		statuses = append(statuses, SinkStatus{
+			Name:       s.Name(),
+			EventCount: s.eventCount.Load(),
+			ErrorCount: s.errorCount.Load(),
+		})
+	}
+	return statuses
+}
+
+// dispatch hands an upload to the webhook targets and to every sink. Without
+// sinks it is the same as deliver. With sinks, an upload routed to no webhook
+// targets is valid. The result only reflects the delivery to the
+// webhook targets: sinks, including relays to third-party services, are best
+// effort and their errors are logged and counted per sink.
+func (c *Controller) dispatch(ctx context.Context, targets []*target, receivedAt time.Time, values url.Values) (string, error) {
+	if len(c.sinks) == 0 {
+		return c.deliver(ctx, targets, receivedAt, values)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.publish(ctx, receivedAt, values)
+	}()
+
+	status := "OK"
+	var err error
+	if len(targets) > 0 {
+		status, err = c.deliver(ctx, targets, receivedAt, values)
+	}
+	<-done
+
+	return status, err
+}
+
+// publish parses an upload, adds the derived readings when enabled, and
+// publishes it to all sinks concurrently.
+func (c *Controller) publish(ctx context.Context, receivedAt time.Time, values url.Values) {
+	payload := ecowitt.Parse(values)
+	if c.derivedMetrics != DerivedMetricsOff {
+		derived.Enrich(payload)
+	}
+	var wg sync.WaitGroup
+	for _, s := range c.sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Publish(ctx, receivedAt, payload); err != nil {
+				c.logger.Errorf("Error publishing event data to sink %q: %s", s.Name(), err)
+				s.errorCount.Add(1)
+				return
+			}
+			s.eventCount.Add(1)
+		}()
+	}
+	wg.Wait()
+}
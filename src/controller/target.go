@@ -0,0 +1,304 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hass-ecowitt-proxy/redact"
+	"hass-ecowitt-proxy/tlsconfig"
+)
+
+// DefaultTargetName is the name given to the target built from the
+// hass_url, hass_auth_token and hass_webhook_id options.
+const DefaultTargetName = "default"
+
+var errNoTargets = errors.New("no Home Assistant targets configured")
+
+// Target is a single Home Assistant webhook that uploads are delivered to.
+type Target struct {
+	Name      string
+	URL       string
+	AuthToken string
+	WebhookID string
+
+	// Timeout bounds each delivery to this target, including retries. Zero
+	// means no timeout.
+	Timeout time.Duration
+
+	// RetryPolicy overrides the controller wide retry policy when set.
+	RetryPolicy *RetryPolicy
+
+	// TLS configures connections to Home Assistant, e.g. to trust a private
+	// CA or present a client certificate.
+	TLS tlsconfig.Client
+}
+
+func (t Target) ForwardURL() string {
+	return fmt.Sprintf("%s/api/webhook/%s", t.URL, t.WebhookID)
+}
+
+func (t Target) Validate() error {
+	missing := []string{}
+	if t.URL == "" {
+		missing = append(missing, "url")
+	}
+	if t.AuthToken == "" {
+		missing = append(missing, "auth_token")
+	}
+	if t.WebhookID == "" {
+		missing = append(missing, "webhook_id")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("target %q is missing: %s", t.Name, strings.Join(missing, ", "))
+	}
+
+	if t.Timeout < 0 {
+		return fmt.Errorf("target %q has a negative timeout", t.Name)
+	}
+	if t.RetryPolicy != nil {
+		if err := t.RetryPolicy.Validate(); err != nil {
+			return fmt.Errorf("target %q: %w", t.Name, err)
+		}
+	}
+	if _, err := t.TLS.Config(); err != nil {
+		return fmt.Errorf("target %q: %w", t.Name, err)
+	}
+
+	return nil
+}
+
+// ValidateTargets checks every target and makes sure names are unique.
+func ValidateTargets(targets []Target) error {
+	seen := map[string]bool{}
+	for _, t := range targets {
+		if t.Name == "" {
+			return errors.New("every target needs a name")
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		seen[t.Name] = true
+
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithTargets replaces the single target built from New's arguments with the
+// given list. Uploads are delivered to all of them unless routing narrows the
+// list down.
+func WithTargets(targets ...Target) Option {
+	return func(c *Controller) {
+		c.targetConfigs = targets
+	}
+}
+
+// target is the runtime state of a Target, including its delivery counters.
+type target struct {
+	Target
+	retryPolicy RetryPolicy
+	client      *HassWebhookClient
+
+	*targetCounters
+}
+
+// targetCounters are the delivery counters of a target. They are carried over
+// when a reload replaces a target with one of the same name.
+type targetCounters struct {
+	eventCount   atomic.Uint32
+	errorCount   atomic.Uint32
+	queuedCount  atomic.Uint32
+	attemptCount atomic.Uint32
+	retryCount   atomic.Uint32
+}
+
+func (c *Controller) newTarget(t Target, counters *targetCounters) *target {
+	if counters == nil {
+		counters = &targetCounters{}
+	}
+
+	rt := &target{Target: t, retryPolicy: c.retryPolicy, targetCounters: counters}
+	if t.RetryPolicy != nil {
+		rt.retryPolicy = *t.RetryPolicy
+	}
+
+	opts := []HassClientOption{
+		WithRetryPolicy(rt.retryPolicy),
+		WithAttemptHook(c.recordAttempt(rt)),
+		WithClientLogger(c.logger),
+	}
+	if !t.TLS.IsZero() {
+		opts = append(opts, WithHTTPClient(newTLSHTTPClient(t.TLS)))
+	}
+	rt.client = NewHassClient(t.ForwardURL(), t.AuthToken, opts...)
+
+	return rt
+}
+
+// TargetStatus is the per-target section of the status page. The auth token
+// and webhook ID are masked.
+type TargetStatus struct {
+	Name      string
+	URL       string
+	AuthToken string
+	WebhookID string
+	Timeout   time.Duration
+
+	EventCount   uint32
+	ErrorCount   uint32
+	QueuedCount  uint32
+	AttemptCount uint32
+	RetryCount   uint32
+	QueueLength  int
+}
+
+func (c *Controller) targetStatuses() []TargetStatus {
+	targets := c.current().targets
+	statuses := make([]TargetStatus, 0, len(targets))
+	for _, t := range targets {
+		ts := TargetStatus{
+			Name:         t.Name,
+			URL:          t.URL,
+			AuthToken:    redact.Token(t.AuthToken),
+			WebhookID:    redact.Token(t.WebhookID),
+			Timeout:      t.Timeout,
+			EventCount:   t.eventCount.Load(),
+			ErrorCount:   t.errorCount.Load(),
+			QueuedCount:  t.queuedCount.Load(),
+			AttemptCount: t.attemptCount.Load(),
+			RetryCount:   t.retryCount.Load(),
+		}
+		if c.queue != nil {
+			ts.QueueLength = c.queue.LenTarget(t.Name)
+		}
+		statuses = append(statuses, ts)
+	}
+	return statuses
+}
+
+// lookupTarget finds a configured target by name. Items queued before
+// targets had names belong to the first target.
+func (s *state) lookupTarget(name string) *target {
+	for _, t := range s.targets {
+		if t.Name == name {
+			return t
+		}
+	}
+	if name == "" && len(s.targets) > 0 {
+		return s.targets[0]
+	}
+	return nil
+}
+
+func (c *Controller) recordAttempt(t *target) AttemptHookFn {
+	return func(a Attempt) {
+		c.attemptCount.Add(1)
+		t.attemptCount.Add(1)
+		if a.Retry {
+			c.retryCount.Add(1)
+			t.retryCount.Add(1)
+		}
+	}
+}
+
+// deliver forwards a single upload to the given targets concurrently. It
+// returns the delivery status reported back to the gateway: "OK" when every
+// target accepted the upload and "QUEUED" when at least one target will
+// receive it later. The controller-wide counters count the upload once, no
+// matter how many targets it fans out to.
+func (c *Controller) deliver(ctx context.Context, targets []*target, receivedAt time.Time, values url.Values) (string, error) {
+	if len(targets) == 0 {
+		c.errorCount.Add(1)
+		return "", errNoTargets
+	}
+
+	statuses := make([]string, len(targets))
+	errs := make([]error, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], errs[i] = c.deliverTo(ctx, t, receivedAt, values)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		c.errorCount.Add(1)
+		return "", err
+	}
+
+	// An upload is counted here once it has been accepted, even if some
+	// targets will only receive it from the queue; draining the queue only
+	// updates the per-target counters.
+	c.eventCount.Add(1)
+	for _, status := range statuses {
+		if status == "QUEUED" {
+			return status, nil
+		}
+	}
+	return "OK", nil
+}
+
+// deliverTo forwards an upload to a single target, falling back to the
+// durable queue when one is configured.
+func (c *Controller) deliverTo(ctx context.Context, t *target, receivedAt time.Time, values url.Values) (string, error) {
+	// Keep uploads in order: while there is a backlog for this target, new
+	// uploads wait behind it instead of overtaking it.
+	if c.queue != nil && c.queue.LenTarget(t.Name) > 0 {
+		return c.enqueue(t, receivedAt, values, nil)
+	}
+
+	c.logger.Infof("Forwarding Ecowitt event data to target %q at %s", t.Name, t.ForwardURL())
+	if err := c.forward(ctx, t, values); err != nil {
+		c.logger.Errorf("Error posting event data to target %q: %s", t.Name, err)
+		if c.queue != nil {
+			return c.enqueue(t, receivedAt, values, err)
+		}
+
+		t.errorCount.Add(1)
+		return "", fmt.Errorf("target %q: %w", t.Name, err)
+	}
+
+	t.eventCount.Add(1)
+	return "OK", nil
+}
+
+func (c *Controller) forward(ctx context.Context, t *target, values url.Values) error {
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := t.client.PostData(ctx, values)
+	c.metrics.observeForward(t, time.Since(start), err)
+	return err
+}
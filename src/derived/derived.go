@@ -0,0 +1,168 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package derived computes weather metrics that Ecowitt gateways do not send,
+// e.g. dew point and heat index, from the temperature, humidity and wind
+// readings of a payload.
+//
+// Temperatures are in °F and wind speeds in mph, matching the Ecowitt
+// protocol. Absolute humidity is in g/m³ and vapor pressure deficit in inHg.
+package derived
+
+import (
+	"math"
+
+	"hass-ecowitt-proxy/ecowitt"
+)
+
+// Magnus formula coefficients over water (Alduchov and Eskridge, 1996, as
+// used by the WMO), for temperatures in °C and pressures in hPa.
+const (
+	magnusA  = 17.62
+	magnusB  = 243.12
+	magnusE0 = 6.112
+
+	hPaPerInHg = 33.8639
+)
+
+func fToC(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+func cToF(c float64) float64 {
+	return c*9/5 + 32
+}
+
+// round rounds v to the given number of decimal places.
+func round(v float64, places int) float64 {
+	scale := math.Pow10(places)
+	return math.Round(v*scale) / scale
+}
+
+// saturationVaporPressure returns the saturation vapor pressure in hPa at a
+// temperature in °C.
+func saturationVaporPressure(tempC float64) float64 {
+	return magnusE0 * math.Exp(magnusA*tempC/(magnusB+tempC))
+}
+
+// DewPoint returns the dew point in °F. The humidity must be above zero.
+func DewPoint(tempF, humidity float64) float64 {
+	t := fToC(tempF)
+	gamma := math.Log(humidity/100) + magnusA*t/(magnusB+t)
+	return cToF(magnusB * gamma / (magnusA - gamma))
+}
+
+// HeatIndex returns the heat index in °F using the algorithm of the US
+// National Weather Service: a simple formula for mild conditions and the
+// Rothfusz regression, with its adjustments for very dry and very humid air,
+// above 80°F.
+func HeatIndex(tempF, humidity float64) float64 {
+	t, rh := tempF, humidity
+
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 < 80 {
+		return hi
+	}
+
+	hi = -42.379 + 2.04901523*t + 10.14333127*rh -
+		0.22475541*t*rh - 0.00683783*t*t - 0.05481717*rh*rh +
+		0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+	switch {
+	case rh < 13 && t >= 80 && t <= 112:
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+	case rh > 85 && t >= 80 && t <= 87:
+		hi += (rh - 85) / 10 * (87 - t) / 5
+	}
+	return hi
+}
+
+// WindChill returns the wind chill in °F using the formula of the US
+// National Weather Service. The formula is only defined at or below 50°F with
+// winds of at least 3 mph; otherwise the temperature is returned.
+func WindChill(tempF, windMPH float64) float64 {
+	if tempF > 50 || windMPH < 3 {
+		return tempF
+	}
+	v := math.Pow(windMPH, 0.16)
+	return 35.74 + 0.6215*tempF - 35.75*v + 0.4275*tempF*v
+}
+
+// FeelsLike returns the apparent temperature in °F: the heat index when it
+// is hot, the wind chill when it is cold and windy and the temperature
+// otherwise. A nil wind speed is treated as calm.
+func FeelsLike(tempF, humidity float64, windMPH *float64) float64 {
+	switch {
+	case tempF >= 80:
+		return HeatIndex(tempF, humidity)
+	case windMPH != nil:
+		return WindChill(tempF, *windMPH)
+	default:
+		return tempF
+	}
+}
+
+// AbsoluteHumidity returns the mass of water vapor per volume of air in g/m³.
+func AbsoluteHumidity(tempF, humidity float64) float64 {
+	t := fToC(tempF)
+	e := saturationVaporPressure(t) * humidity / 100
+	return 216.7 * e / (273.15 + t)
+}
+
+// VaporPressureDeficit returns the difference between the saturation and
+// the actual vapor pressure in inHg.
+func VaporPressureDeficit(tempF, humidity float64) float64 {
+	es := saturationVaporPressure(fToC(tempF))
+	return es * (1 - humidity/100) / hPaPerInHg
+}
+
+// fill stores v in dst unless the gateway already sent a value.
+func fill(dst **float64, v float64) {
+	if *dst == nil {
+		*dst = &v
+	}
+}
+
+// enrich computes the derived readings of a temperature and humidity pair.
+func enrich(d *ecowitt.Derived, tempF, humidity *float64, windMPH *float64) {
+	if tempF == nil || humidity == nil || *humidity <= 0 || *humidity > 100 {
+		return
+	}
+	t, rh := *tempF, *humidity
+
+	fill(&d.DewPointF, round(DewPoint(t, rh), 1))
+	fill(&d.HeatIndexF, round(HeatIndex(t, rh), 1))
+	fill(&d.FeelsLikeF, round(FeelsLike(t, rh, windMPH), 1))
+	fill(&d.AbsHumidity, round(AbsoluteHumidity(t, rh), 2))
+	fill(&d.VPDInHg, round(VaporPressureDeficit(t, rh), 3))
+}
+
+// Enrich adds the derived readings to a payload for the outdoor and indoor
+// sensors and every WH31 channel that reports both temperature and humidity.
+// Wind chill is only computed outdoors. Readings the gateway already sent are
+// left untouched.
+func Enrich(p *ecowitt.Payload) {
+	enrich(&p.Outdoor.Derived, p.Outdoor.TempF, p.Outdoor.Humidity, p.Wind.SpeedMPH)
+	enrich(&p.Indoor.Derived, p.Indoor.TempF, p.Indoor.Humidity, nil)
+	for _, c := range p.TempHumidityChannels {
+		enrich(&c.Derived, c.TempF, c.Humidity, nil)
+	}
+
+	if p.Outdoor.TempF != nil && p.Wind.SpeedMPH != nil {
+		fill(&p.Wind.ChillF, round(WindChill(*p.Outdoor.TempF, *p.Wind.SpeedMPH), 1))
+	}
+}
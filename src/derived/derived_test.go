@@ -0,0 +1,155 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package derived
+
+import (
+	"net/url"
+	"testing"
+
+	"hass-ecowitt-proxy/ecowitt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Reference values are taken from the NWS heat index and wind chill charts
+// and from psychrometric tables, rounded as Enrich rounds them.
+func TestTempHumidityMetrics(t *testing.T) {
+	tests := []struct {
+		name          string
+		tempF         float64
+		humidity      float64
+		wantDewPoint  float64
+		wantHeatIndex float64
+		wantAbsHum    float64
+		wantVPD       float64
+	}{
+		{name: "room", tempF: 68, humidity: 50, wantDewPoint: 48.7, wantHeatIndex: 66.9, wantAbsHum: 8.62, wantVPD: 0.344},
+		{name: "muggy", tempF: 90, humidity: 70, wantDewPoint: 78.9, wantHeatIndex: 105.9, wantAbsHum: 23.87, wantVPD: 0.426},
+		{name: "dry heat adjustment", tempF: 100, humidity: 10, wantDewPoint: 33.7, wantHeatIndex: 94.1, wantAbsHum: 4.56, wantVPD: 1.737},
+		{name: "humid adjustment", tempF: 85, humidity: 90, wantDewPoint: 81.7, wantHeatIndex: 101.8, wantAbsHum: 26.43, wantVPD: 0.121},
+		{name: "cool", tempF: 50, humidity: 80, wantDewPoint: 44.1, wantHeatIndex: 48.5, wantAbsHum: 7.51, wantVPD: 0.072},
+		{name: "saturated", tempF: 32, humidity: 100, wantDewPoint: 32, wantHeatIndex: 29.6, wantAbsHum: 4.85, wantVPD: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.wantDewPoint, round(DewPoint(test.tempF, test.humidity), 1))
+			assert.Equal(t, test.wantHeatIndex, round(HeatIndex(test.tempF, test.humidity), 1))
+			assert.Equal(t, test.wantAbsHum, round(AbsoluteHumidity(test.tempF, test.humidity), 2))
+			assert.Equal(t, test.wantVPD, round(VaporPressureDeficit(test.tempF, test.humidity), 3))
+		})
+	}
+}
+
+func TestWindChill(t *testing.T) {
+	tests := []struct {
+		name    string
+		tempF   float64
+		windMPH float64
+		want    float64
+	}{
+		{name: "frigid", tempF: 0, windMPH: 15, want: -19.4},
+		{name: "freezing", tempF: 30, windMPH: 10, want: 21.2},
+		{name: "threshold", tempF: 50, windMPH: 3, want: 49.7},
+		{name: "too warm", tempF: 51, windMPH: 20, want: 51},
+		{name: "calm", tempF: 40, windMPH: 2, want: 40},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, round(WindChill(test.tempF, test.windMPH), 1))
+		})
+	}
+}
+
+func TestFeelsLike(t *testing.T) {
+	wind := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name     string
+		tempF    float64
+		humidity float64
+		windMPH  *float64
+		want     float64
+	}{
+		{name: "hot", tempF: 90, humidity: 70, windMPH: wind(10), want: 105.9},
+		{name: "cold and windy", tempF: 30, humidity: 70, windMPH: wind(10), want: 21.2},
+		{name: "cold without wind sensor", tempF: 30, humidity: 70, want: 30},
+		{name: "mild", tempF: 65, humidity: 40, windMPH: wind(10), want: 65},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, round(FeelsLike(test.tempF, test.humidity, test.windMPH), 1))
+		})
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	p := ecowitt.Parse(url.Values{
+		"PASSKEY":      {"AAAA"},
+		"tempf":        {"30"},
+		"humidity":     {"70"},
+		"windspeedmph": {"10"},
+		"tempinf":      {"68"},
+		"humidityin":   {"50"},
+		"temp1f":       {"90"},
+		"humidity1":    {"70"},
+		"temp2f":       {"77"},
+		"dewpointf":    {"20.5"},
+	})
+	Enrich(p)
+
+	values := p.Values()
+	want := map[string]string{
+		// The gateway's own reading wins.
+		"dewpointf":     "20.5",
+		"windchillf":    "21.2",
+		"feelslikef":    "21.2",
+		"dewpointinf":   "48.7",
+		"heatindexinf":  "66.9",
+		"feelslikeinf":  "68",
+		"abshumidityin": "8.62",
+		"vpdin":         "0.344",
+		"dewpoint1f":    "78.9",
+		"heatindex1f":   "105.9",
+		"feelslike1f":   "105.9",
+		"abshumidity1":  "23.87",
+		"vpd1":          "0.426",
+	}
+	for name, v := range want {
+		assert.Equal(t, v, values.Get(name), name)
+	}
+
+	// Channel 2 has no humidity reading.
+	assert.False(t, values.Has("dewpoint2f"))
+	assert.Empty(t, p.Extra)
+
+	reparsed := ecowitt.Parse(values)
+	require.NotNil(t, reparsed.TempHumidityChannels[1])
+	assert.Equal(t, 23.87, *reparsed.TempHumidityChannels[1].AbsHumidity)
+}
+
+func TestEnrichWithoutReadings(t *testing.T) {
+	p := ecowitt.Parse(url.Values{"PASSKEY": {"AAAA"}, "tempf": {"45"}, "humidity": {"0"}})
+	Enrich(p)
+
+	assert.Nil(t, p.Outdoor.DewPointF)
+	assert.Nil(t, p.Wind.ChillF)
+	assert.Equal(t, url.Values{"PASSKEY": {"AAAA"}, "tempf": {"45"}, "humidity": {"0"}}, p.Values())
+}
@@ -0,0 +1,341 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package ecowitt
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MaxChannels is the highest channel number accepted for multi-channel
+// sensors.
+const MaxChannels = 16
+
+var stringFieldNames = []string{FieldPasskey, FieldStationType, FieldModel, FieldFrequency, FieldDateUTC}
+
+func stringField(p *Payload, name string) *string {
+	switch name {
+	case FieldPasskey:
+		return &p.Station.Passkey
+	case FieldStationType:
+		return &p.Station.StationType
+	case FieldModel:
+		return &p.Station.Model
+	case FieldFrequency:
+		return &p.Station.Frequency
+	case FieldDateUTC:
+		return &p.Station.DateUTC
+	default:
+		return nil
+	}
+}
+
+// binding connects an Ecowitt field name to where its value lives in a
+// Payload.
+type binding struct {
+	name  string
+	get   func(p *Payload) (float64, bool)
+	set   func(p *Payload, v float64)
+	clear func(p *Payload)
+}
+
+// ptrBinding builds a binding for a *float64 field. ref returns the address of
+// the field, or nil when its containing struct does not exist and create is
+// false.
+func ptrBinding(name string, ref func(p *Payload, create bool) **float64) binding {
+	return binding{
+		name: name,
+		get: func(p *Payload) (float64, bool) {
+			r := ref(p, false)
+			if r == nil || *r == nil {
+				return 0, false
+			}
+			return **r, true
+		},
+		set: func(p *Payload, v float64) {
+			*ref(p, true) = &v
+		},
+		clear: func(p *Payload) {
+			if r := ref(p, false); r != nil {
+				*r = nil
+			}
+		},
+	}
+}
+
+func field(name string, ref func(p *Payload) **float64) binding {
+	return ptrBinding(name, func(p *Payload, _ bool) **float64 { return ref(p) })
+}
+
+func co2Field(name string, ref func(s *CO2Sensor) **float64) binding {
+	return ptrBinding(name, func(p *Payload, create bool) **float64 {
+		if p.CO2 == nil {
+			if !create {
+				return nil
+			}
+			p.CO2 = &CO2Sensor{}
+		}
+		return ref(p.CO2)
+	})
+}
+
+func lightningField(name string, ref func(l *Lightning) **float64) binding {
+	return ptrBinding(name, func(p *Payload, create bool) **float64 {
+		if p.Lightning == nil {
+			if !create {
+				return nil
+			}
+			p.Lightning = &Lightning{}
+		}
+		return ref(p.Lightning)
+	})
+}
+
+func batteryField(name string) binding {
+	return binding{
+		name: name,
+		get: func(p *Payload) (float64, bool) {
+			v, ok := p.Batteries[name]
+			return v, ok
+		},
+		set: func(p *Payload, v float64) {
+			if p.Batteries == nil {
+				p.Batteries = map[string]float64{}
+			}
+			p.Batteries[name] = v
+		},
+		clear: func(p *Payload) {
+			delete(p.Batteries, name)
+		},
+	}
+}
+
+var fixedBindings = []binding{
+	field("runtime", func(p *Payload) **float64 { return &p.Station.Runtime }),
+	field("interval", func(p *Payload) **float64 { return &p.Station.Interval }),
+
+	field("tempinf", func(p *Payload) **float64 { return &p.Indoor.TempF }),
+	field("humidityin", func(p *Payload) **float64 { return &p.Indoor.Humidity }),
+	field("tempf", func(p *Payload) **float64 { return &p.Outdoor.TempF }),
+	field("humidity", func(p *Payload) **float64 { return &p.Outdoor.Humidity }),
+
+	field("dewpointinf", func(p *Payload) **float64 { return &p.Indoor.DewPointF }),
+	field("heatindexinf", func(p *Payload) **float64 { return &p.Indoor.HeatIndexF }),
+	field("feelslikeinf", func(p *Payload) **float64 { return &p.Indoor.FeelsLikeF }),
+	field("abshumidityin", func(p *Payload) **float64 { return &p.Indoor.AbsHumidity }),
+	field("vpdin", func(p *Payload) **float64 { return &p.Indoor.VPDInHg }),
+	field("dewpointf", func(p *Payload) **float64 { return &p.Outdoor.DewPointF }),
+	field("heatindexf", func(p *Payload) **float64 { return &p.Outdoor.HeatIndexF }),
+	field("feelslikef", func(p *Payload) **float64 { return &p.Outdoor.FeelsLikeF }),
+	field("abshumidity", func(p *Payload) **float64 { return &p.Outdoor.AbsHumidity }),
+	field("vpd", func(p *Payload) **float64 { return &p.Outdoor.VPDInHg }),
+
+	field("baromrelin", func(p *Payload) **float64 { return &p.Pressure.RelativeInHg }),
+	field("baromabsin", func(p *Payload) **float64 { return &p.Pressure.AbsoluteInHg }),
+
+	field("winddir", func(p *Payload) **float64 { return &p.Wind.DirectionDeg }),
+	field("windspeedmph", func(p *Payload) **float64 { return &p.Wind.SpeedMPH }),
+	field("windgustmph", func(p *Payload) **float64 { return &p.Wind.GustMPH }),
+	field("maxdailygust", func(p *Payload) **float64 { return &p.Wind.MaxDailyGustMPH }),
+	field("windchillf", func(p *Payload) **float64 { return &p.Wind.ChillF }),
+
+	field("rainratein", func(p *Payload) **float64 { return &p.Rain.RateInHr }),
+	field("eventrainin", func(p *Payload) **float64 { return &p.Rain.EventIn }),
+	field("hourlyrainin", func(p *Payload) **float64 { return &p.Rain.HourlyIn }),
+	field("dailyrainin", func(p *Payload) **float64 { return &p.Rain.DailyIn }),
+	field("weeklyrainin", func(p *Payload) **float64 { return &p.Rain.WeeklyIn }),
+	field("monthlyrainin", func(p *Payload) **float64 { return &p.Rain.MonthlyIn }),
+	field("yearlyrainin", func(p *Payload) **float64 { return &p.Rain.YearlyIn }),
+	field("totalrainin", func(p *Payload) **float64 { return &p.Rain.TotalIn }),
+
+	field("solarradiation", func(p *Payload) **float64 { return &p.Solar.RadiationWm2 }),
+	field("uv", func(p *Payload) **float64 { return &p.Solar.UVIndex }),
+
+	co2Field("tf_co2", func(s *CO2Sensor) **float64 { return &s.TempF }),
+	co2Field("humi_co2", func(s *CO2Sensor) **float64 { return &s.Humidity }),
+	co2Field("pm25_co2", func(s *CO2Sensor) **float64 { return &s.PM25 }),
+	co2Field("pm25_24h_co2", func(s *CO2Sensor) **float64 { return &s.PM25Avg24h }),
+	co2Field("pm10_co2", func(s *CO2Sensor) **float64 { return &s.PM10 }),
+	co2Field("pm10_24h_co2", func(s *CO2Sensor) **float64 { return &s.PM10Avg24h }),
+	co2Field("co2", func(s *CO2Sensor) **float64 { return &s.CO2 }),
+	co2Field("co2_24h", func(s *CO2Sensor) **float64 { return &s.CO2Avg24h }),
+	co2Field("co2_batt", func(s *CO2Sensor) **float64 { return &s.Battery }),
+
+	lightningField("lightning", func(l *Lightning) **float64 { return &l.DistanceKm }),
+	lightningField("lightning_time", func(l *Lightning) **float64 { return &l.Time }),
+	lightningField("lightning_num", func(l *Lightning) **float64 { return &l.Count }),
+	lightningField("wh57batt", func(l *Lightning) **float64 { return &l.Battery }),
+
+	batteryField("wh25batt"),
+	batteryField("wh26batt"),
+	batteryField("wh40batt"),
+	batteryField("wh65batt"),
+	batteryField("wh68batt"),
+	batteryField("wh80batt"),
+	batteryField("wh90batt"),
+}
+
+var fixedBindingsByName = func() map[string]binding {
+	m := map[string]binding{}
+	for _, b := range fixedBindings {
+		m[b.name] = b
+	}
+	return m
+}()
+
+// channelPattern describes a per-channel field named prefix + N + suffix.
+type channelPattern struct {
+	prefix string
+	suffix string
+	ref    func(p *Payload, n int, create bool) **float64
+}
+
+func (cp channelPattern) name(n int) string {
+	return fmt.Sprintf("%s%d%s", cp.prefix, n, cp.suffix)
+}
+
+// channel extracts the channel number from a field name matching the pattern.
+func (cp channelPattern) channel(name string) (int, bool) {
+	if !strings.HasPrefix(name, cp.prefix) || !strings.HasSuffix(name, cp.suffix) {
+		return 0, false
+	}
+	digits := name[len(cp.prefix) : len(name)-len(cp.suffix)]
+	if digits == "" || digits[0] == '0' || strings.Trim(digits, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 1 || n > MaxChannels {
+		return 0, false
+	}
+	return n, true
+}
+
+func (cp channelPattern) binding(n int) binding {
+	return ptrBinding(cp.name(n), func(p *Payload, create bool) **float64 {
+		return cp.ref(p, n, create)
+	})
+}
+
+func tempHumidityChannel(ref func(c *TempHumidityChannel) **float64) func(*Payload, int, bool) **float64 {
+	return func(p *Payload, n int, create bool) **float64 {
+		c := p.TempHumidityChannels[n]
+		if c == nil {
+			if !create {
+				return nil
+			}
+			if p.TempHumidityChannels == nil {
+				p.TempHumidityChannels = map[int]*TempHumidityChannel{}
+			}
+			c = &TempHumidityChannel{}
+			p.TempHumidityChannels[n] = c
+		}
+		return ref(c)
+	}
+}
+
+func soilChannel(ref func(c *SoilChannel) **float64) func(*Payload, int, bool) **float64 {
+	return func(p *Payload, n int, create bool) **float64 {
+		c := p.SoilChannels[n]
+		if c == nil {
+			if !create {
+				return nil
+			}
+			if p.SoilChannels == nil {
+				p.SoilChannels = map[int]*SoilChannel{}
+			}
+			c = &SoilChannel{}
+			p.SoilChannels[n] = c
+		}
+		return ref(c)
+	}
+}
+
+func pm25Channel(ref func(c *PM25Channel) **float64) func(*Payload, int, bool) **float64 {
+	return func(p *Payload, n int, create bool) **float64 {
+		c := p.PM25Channels[n]
+		if c == nil {
+			if !create {
+				return nil
+			}
+			if p.PM25Channels == nil {
+				p.PM25Channels = map[int]*PM25Channel{}
+			}
+			c = &PM25Channel{}
+			p.PM25Channels[n] = c
+		}
+		return ref(c)
+	}
+}
+
+var (
+	tempHumidityPatterns = []channelPattern{
+		{"temp", "f", tempHumidityChannel(func(c *TempHumidityChannel) **float64 { return &c.TempF })},
+		{"humidity", "", tempHumidityChannel(func(c *TempHumidityChannel) **float64 { return &c.Humidity })},
+		{"batt", "", tempHumidityChannel(func(c *TempHumidityChannel) **float64 { return &c.Battery })},
+		{"dewpoint", "f", tempHumidityChannel(func(c *TempHumidityChannel) **float64 { return &c.DewPointF })},
+		{"heatindex", "f", tempHumidityChannel(func(c *TempHumidityChannel) **float64 { return &c.HeatIndexF })},
+		{"feelslike", "f", tempHumidityChannel(func(c *TempHumidityChannel) **float64 { return &c.FeelsLikeF })},
+		{"abshumidity", "", tempHumidityChannel(func(c *TempHumidityChannel) **float64 { return &c.AbsHumidity })},
+		{"vpd", "", tempHumidityChannel(func(c *TempHumidityChannel) **float64 { return &c.VPDInHg })},
+	}
+
+	soilPatterns = []channelPattern{
+		{"soilmoisture", "", soilChannel(func(c *SoilChannel) **float64 { return &c.MoisturePct })},
+		{"soilad", "", soilChannel(func(c *SoilChannel) **float64 { return &c.AD })},
+		{"soilbatt", "", soilChannel(func(c *SoilChannel) **float64 { return &c.Battery })},
+	}
+
+	pm25Patterns = []channelPattern{
+		{"pm25_ch", "", pm25Channel(func(c *PM25Channel) **float64 { return &c.PM25 })},
+		{"pm25_avg_24h_ch", "", pm25Channel(func(c *PM25Channel) **float64 { return &c.PM25Avg24h })},
+		{"pm25batt", "", pm25Channel(func(c *PM25Channel) **float64 { return &c.Battery })},
+	}
+
+	channelPatterns = slices.Concat(tempHumidityPatterns, soilPatterns, pm25Patterns)
+)
+
+func channelNames(n int, patterns []channelPattern) []string {
+	names := make([]string, 0, len(patterns))
+	for _, cp := range patterns {
+		names = append(names, cp.name(n))
+	}
+	return names
+}
+
+// lookup finds the binding for a numeric field name.
+func lookup(name string) (binding, bool) {
+	if b, ok := fixedBindingsByName[name]; ok {
+		return b, true
+	}
+	for _, cp := range channelPatterns {
+		if n, ok := cp.channel(name); ok {
+			return cp.binding(n), true
+		}
+	}
+	return binding{}, false
+}
+
+// IsKnownField reports whether name is a field the parser understands.
+func IsKnownField(name string) bool {
+	if stringField(&Payload{}, name) != nil {
+		return true
+	}
+	_, ok := lookup(name)
+	return ok
+}
@@ -0,0 +1,243 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package ecowitt
+
+import "hass-ecowitt-proxy/redact"
+
+// Kind is the physical quantity a field measures.
+type Kind uint8
+
+const (
+	KindUnknown Kind = iota
+	KindTemperature
+	KindHumidity
+	KindPressure
+	KindWindSpeed
+	KindWindDirection
+	KindRain
+	KindRainRate
+	KindIrradiance
+	KindUVIndex
+	KindPM25
+	KindPM10
+	KindCO2
+	KindMoisture
+	KindBattery
+	KindDistance
+	KindTimestamp
+	KindCount
+	KindDuration
+	KindAbsoluteHumidity
+	KindVaporPressure
+)
+
+var kindNames = map[Kind]string{
+	KindUnknown:       "unknown",
+	KindTemperature:   "temperature",
+	KindHumidity:      "humidity",
+	KindPressure:      "pressure",
+	KindWindSpeed:     "wind_speed",
+	KindWindDirection: "wind_direction",
+	KindRain:          "rain",
+	KindRainRate:      "rain_rate",
+	KindIrradiance:    "irradiance",
+	KindUVIndex:       "uv_index",
+	KindPM25:          "pm25",
+	KindPM10:          "pm10",
+	KindCO2:           "co2",
+	KindMoisture:      "moisture",
+	KindBattery:       "battery",
+	KindDistance:      "distance",
+	KindTimestamp:     "timestamp",
+	KindCount:         "count",
+	KindDuration:      "duration",
+
+	KindAbsoluteHumidity: "absolute_humidity",
+	KindVaporPressure:    "vapor_pressure",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// Info describes a numeric Ecowitt field.
+type Info struct {
+	Name string
+	Kind Kind
+	// Unit is the unit the gateway reports the field in. Ecowitt always
+	// uploads imperial units.
+	Unit string
+	// Group is the sensor the field belongs to, e.g. "outdoor" or "wh31".
+	Group string
+	// Channel is the channel of multi-channel sensors, or 0.
+	Channel int
+}
+
+// Units used by the Ecowitt protocol.
+const (
+	UnitFahrenheit = "°F"
+	UnitPercent    = "%"
+	UnitInHg       = "inHg"
+	UnitMPH        = "mph"
+	UnitDegrees    = "°"
+	UnitInches     = "in"
+	UnitInPerHour  = "in/h"
+	UnitWm2        = "W/m²"
+	UnitUgm3       = "µg/m³"
+	UnitPPM        = "ppm"
+	UnitKm         = "km"
+	UnitSeconds    = "s"
+	UnitGm3        = "g/m³"
+)
+
+var fixedInfo = map[string]Info{
+	"runtime":  {Kind: KindDuration, Unit: UnitSeconds, Group: "station"},
+	"interval": {Kind: KindDuration, Unit: UnitSeconds, Group: "station"},
+
+	"tempinf":    {Kind: KindTemperature, Unit: UnitFahrenheit, Group: "indoor"},
+	"humidityin": {Kind: KindHumidity, Unit: UnitPercent, Group: "indoor"},
+	"tempf":      {Kind: KindTemperature, Unit: UnitFahrenheit, Group: "outdoor"},
+	"humidity":   {Kind: KindHumidity, Unit: UnitPercent, Group: "outdoor"},
+
+	"dewpointinf":   {Kind: KindTemperature, Unit: UnitFahrenheit, Group: "indoor"},
+	"heatindexinf":  {Kind: KindTemperature, Unit: UnitFahrenheit, Group: "indoor"},
+	"feelslikeinf":  {Kind: KindTemperature, Unit: UnitFahrenheit, Group: "indoor"},
+	"abshumidityin": {Kind: KindAbsoluteHumidity, Unit: UnitGm3, Group: "indoor"},
+	"vpdin":         {Kind: KindVaporPressure, Unit: UnitInHg, Group: "indoor"},
+	"dewpointf":     {Kind: KindTemperature, Unit: UnitFahrenheit, Group: "outdoor"},
+	"heatindexf":    {Kind: KindTemperature, Unit: UnitFahrenheit, Group: "outdoor"},
+	"feelslikef":    {Kind: KindTemperature, Unit: UnitFahrenheit, Group: "outdoor"},
+	"windchillf":    {Kind: KindTemperature, Unit: UnitFahrenheit, Group: "outdoor"},
+	"abshumidity":   {Kind: KindAbsoluteHumidity, Unit: UnitGm3, Group: "outdoor"},
+	"vpd":           {Kind: KindVaporPressure, Unit: UnitInHg, Group: "outdoor"},
+
+	"baromrelin": {Kind: KindPressure, Unit: UnitInHg, Group: "pressure"},
+	"baromabsin": {Kind: KindPressure, Unit: UnitInHg, Group: "pressure"},
+
+	"winddir":      {Kind: KindWindDirection, Unit: UnitDegrees, Group: "wind"},
+	"windspeedmph": {Kind: KindWindSpeed, Unit: UnitMPH, Group: "wind"},
+	"windgustmph":  {Kind: KindWindSpeed, Unit: UnitMPH, Group: "wind"},
+	"maxdailygust": {Kind: KindWindSpeed, Unit: UnitMPH, Group: "wind"},
+
+	"rainratein":    {Kind: KindRainRate, Unit: UnitInPerHour, Group: "rain"},
+	"eventrainin":   {Kind: KindRain, Unit: UnitInches, Group: "rain"},
+	"hourlyrainin":  {Kind: KindRain, Unit: UnitInches, Group: "rain"},
+	"dailyrainin":   {Kind: KindRain, Unit: UnitInches, Group: "rain"},
+	"weeklyrainin":  {Kind: KindRain, Unit: UnitInches, Group: "rain"},
+	"monthlyrainin": {Kind: KindRain, Unit: UnitInches, Group: "rain"},
+	"yearlyrainin":  {Kind: KindRain, Unit: UnitInches, Group: "rain"},
+	"totalrainin":   {Kind: KindRain, Unit: UnitInches, Group: "rain"},
+
+	"solarradiation": {Kind: KindIrradiance, Unit: UnitWm2, Group: "solar"},
+	"uv":             {Kind: KindUVIndex, Group: "solar"},
+
+	"tf_co2":       {Kind: KindTemperature, Unit: UnitFahrenheit, Group: "wh45"},
+	"humi_co2":     {Kind: KindHumidity, Unit: UnitPercent, Group: "wh45"},
+	"pm25_co2":     {Kind: KindPM25, Unit: UnitUgm3, Group: "wh45"},
+	"pm25_24h_co2": {Kind: KindPM25, Unit: UnitUgm3, Group: "wh45"},
+	"pm10_co2":     {Kind: KindPM10, Unit: UnitUgm3, Group: "wh45"},
+	"pm10_24h_co2": {Kind: KindPM10, Unit: UnitUgm3, Group: "wh45"},
+	"co2":          {Kind: KindCO2, Unit: UnitPPM, Group: "wh45"},
+	"co2_24h":      {Kind: KindCO2, Unit: UnitPPM, Group: "wh45"},
+	"co2_batt":     {Kind: KindBattery, Group: "wh45"},
+
+	"lightning":      {Kind: KindDistance, Unit: UnitKm, Group: "wh57"},
+	"lightning_time": {Kind: KindTimestamp, Group: "wh57"},
+	"lightning_num":  {Kind: KindCount, Group: "wh57"},
+	"wh57batt":       {Kind: KindBattery, Group: "wh57"},
+
+	"wh25batt": {Kind: KindBattery, Group: "wh25"},
+	"wh26batt": {Kind: KindBattery, Group: "wh26"},
+	"wh40batt": {Kind: KindBattery, Group: "wh40"},
+	"wh65batt": {Kind: KindBattery, Group: "wh65"},
+	"wh68batt": {Kind: KindBattery, Group: "wh68"},
+	"wh80batt": {Kind: KindBattery, Group: "wh80"},
+	"wh90batt": {Kind: KindBattery, Group: "wh90"},
+}
+
+type channelInfo struct {
+	patterns []channelPattern
+	group    string
+	infos    []Info
+}
+
+var channelInfos = []channelInfo{
+	{
+		patterns: tempHumidityPatterns,
+		group:    "wh31",
+		infos: []Info{
+			{Kind: KindTemperature, Unit: UnitFahrenheit},
+			{Kind: KindHumidity, Unit: UnitPercent},
+			{Kind: KindBattery},
+			{Kind: KindTemperature, Unit: UnitFahrenheit},
+			{Kind: KindTemperature, Unit: UnitFahrenheit},
+			{Kind: KindTemperature, Unit: UnitFahrenheit},
+			{Kind: KindAbsoluteHumidity, Unit: UnitGm3},
+			{Kind: KindVaporPressure, Unit: UnitInHg},
+		},
+	},
+	{
+		patterns: soilPatterns,
+		group:    "wh51",
+		infos: []Info{
+			{Kind: KindMoisture, Unit: UnitPercent},
+			{Kind: KindUnknown},
+			{Kind: KindBattery},
+		},
+	},
+	{
+		patterns: pm25Patterns,
+		group:    "wh41",
+		infos: []Info{
+			{Kind: KindPM25, Unit: UnitUgm3},
+			{Kind: KindPM25, Unit: UnitUgm3},
+			{Kind: KindBattery},
+		},
+	},
+}
+
+// FieldInfo returns the metadata of a numeric Ecowitt field.
+func FieldInfo(name string) (Info, bool) {
+	if info, ok := fixedInfo[name]; ok {
+		info.Name = name
+		return info, true
+	}
+
+	for _, ci := range channelInfos {
+		for i, cp := range ci.patterns {
+			if n, ok := cp.channel(name); ok {
+				info := ci.infos[i]
+				info.Name = name
+				info.Group = ci.group
+				info.Channel = n
+				return info, true
+			}
+		}
+	}
+
+	return Info{Name: name}, false
+}
+
+// ID returns a short identifier for the station derived from its PASSKEY. It
+// is the keyed hash redact.Passkey puts in logs and is stable for as long as
+// the key set with redact.SetKey does not change.
+func (s Station) ID() string {
+	if s.Passkey == "" {
+		return "unknown"
+	}
+	return redact.Passkey(s.Passkey)
+}
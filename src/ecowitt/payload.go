@@ -0,0 +1,322 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package ecowitt parses the form data uploaded by Ecowitt gateways using the
+// "customized server" Ecowitt protocol into typed readings, and turns those
+// readings back into form data without losing anything it did not understand.
+package ecowitt
+
+import (
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Names of the station metadata fields.
+const (
+	FieldPasskey     = "PASSKEY"
+	FieldStationType = "stationtype"
+	FieldModel       = "model"
+	FieldFrequency   = "freq"
+	FieldDateUTC     = "dateutc"
+)
+
+// DateFormat is the layout of the dateutc field.
+const DateFormat = "2006-01-02 15:04:05"
+
+// Station describes the gateway that sent an upload.
+type Station struct {
+	Passkey     string
+	StationType string
+	Model       string
+	Frequency   string
+	DateUTC     string
+	Runtime     *float64
+	Interval    *float64
+}
+
+// Time parses DateUTC. Gateways without a time source send "now".
+func (s Station) Time() (time.Time, error) {
+	return time.ParseInLocation(DateFormat, s.DateUTC, time.UTC)
+}
+
+// TempHumidity is a temperature and humidity reading, used for the indoor
+// (WH25) and outdoor (WH32/WH65/WH80/WH90) sensors.
+type TempHumidity struct {
+	TempF    *float64
+	Humidity *float64
+
+	Derived
+}
+
+// Derived holds readings computed from temperature, humidity and wind by the
+// derived package. Gateways do not send them.
+type Derived struct {
+	DewPointF  *float64
+	HeatIndexF *float64
+	FeelsLikeF *float64
+	// AbsHumidity is the absolute humidity in g/m³.
+	AbsHumidity *float64
+	// VPDInHg is the vapor pressure deficit.
+	VPDInHg *float64
+}
+
+type Pressure struct {
+	RelativeInHg *float64
+	AbsoluteInHg *float64
+}
+
+type Wind struct {
+	DirectionDeg    *float64
+	SpeedMPH        *float64
+	GustMPH         *float64
+	MaxDailyGustMPH *float64
+
+	// ChillF is the wind chill, computed by the derived package.
+	ChillF *float64
+}
+
+// Rain holds the rain rate in inches per hour and the accumulated rain
+// counters in inches.
+type Rain struct {
+	RateInHr  *float64
+	EventIn   *float64
+	HourlyIn  *float64
+	DailyIn   *float64
+	WeeklyIn  *float64
+	MonthlyIn *float64
+	YearlyIn  *float64
+	TotalIn   *float64
+}
+
+type Solar struct {
+	RadiationWm2 *float64
+	UVIndex      *float64
+}
+
+// TempHumidityChannel is a WH31 multi-channel temperature and humidity sensor.
+type TempHumidityChannel struct {
+	TempF    *float64
+	Humidity *float64
+	Battery  *float64
+
+	Derived
+}
+
+// SoilChannel is a WH51 soil moisture sensor.
+type SoilChannel struct {
+	MoisturePct *float64
+	AD          *float64
+	Battery     *float64
+}
+
+// PM25Channel is a WH41/WH43 particulate matter sensor.
+type PM25Channel struct {
+	PM25       *float64
+	PM25Avg24h *float64
+	Battery    *float64
+}
+
+// CO2Sensor is a WH45 indoor air quality sensor.
+type CO2Sensor struct {
+	TempF      *float64
+	Humidity   *float64
+	PM25       *float64
+	PM25Avg24h *float64
+	PM10       *float64
+	PM10Avg24h *float64
+	CO2        *float64
+	CO2Avg24h  *float64
+	Battery    *float64
+}
+
+// Lightning is a WH57 lightning detector. DistanceKm and Time describe the
+// most recent strike.
+type Lightning struct {
+	DistanceKm *float64
+	Time       *float64
+	Count      *float64
+	Battery    *float64
+}
+
+// Payload is a parsed Ecowitt upload. Optional readings are nil when the
+// gateway did not send them. Fields the parser does not know about, or could
+// not parse, are kept in Extra so that Values reproduces the original upload.
+type Payload struct {
+	Station Station
+	Indoor  TempHumidity
+	Outdoor TempHumidity
+
+	Pressure Pressure
+	Wind     Wind
+	Rain     Rain
+	Solar    Solar
+
+	TempHumidityChannels map[int]*TempHumidityChannel
+	SoilChannels         map[int]*SoilChannel
+	PM25Channels         map[int]*PM25Channel
+	CO2                  *CO2Sensor
+	Lightning            *Lightning
+
+	// Batteries holds battery readings of the single instance sensors that
+	// have no other readings of their own, keyed by field name, e.g.
+	// "wh65batt".
+	Batteries map[string]float64
+
+	Extra url.Values
+
+	// raw keeps the original text of every field that was parsed so that
+	// unchanged values are written back exactly as received.
+	raw map[string]string
+}
+
+// Parse converts an upload into a Payload. It never fails: anything that
+// cannot be interpreted ends up in Payload.Extra.
+func Parse(values url.Values) *Payload {
+	p := &Payload{
+		Extra: url.Values{},
+		raw:   map[string]string{},
+	}
+
+	for name, vals := range values {
+		if len(vals) != 1 {
+			p.Extra[name] = append([]string(nil), vals...)
+			continue
+		}
+		value := vals[0]
+
+		if str := stringField(p, name); str != nil {
+			*str = value
+			p.raw[name] = value
+			continue
+		}
+
+		b, ok := lookup(name)
+		if !ok {
+			p.Extra.Set(name, value)
+			continue
+		}
+
+		// NaN and infinities parse, but are not readings; consumers such as
+		// InfluxDB cannot store them.
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			p.Extra.Set(name, value)
+			continue
+		}
+
+		b.set(p, f)
+		p.raw[name] = value
+	}
+
+	return p
+}
+
+// Values converts the payload back to form data. For a payload that has not
+// been modified the result is identical to the values it was parsed from.
+func (p *Payload) Values() url.Values {
+	values := url.Values{}
+
+	for name, vals := range p.Extra {
+		values[name] = append([]string(nil), vals...)
+	}
+
+	for _, name := range stringFieldNames {
+		str := stringField(p, name)
+		if _, received := p.raw[name]; *str != "" || received {
+			values.Set(name, *str)
+		}
+	}
+
+	p.Each(func(name string, v float64) {
+		values.Set(name, p.format(name, v))
+	})
+
+	return values
+}
+
+func (p *Payload) format(name string, v float64) string {
+	if raw, ok := p.raw[name]; ok {
+		if f, err := strconv.ParseFloat(raw, 64); err == nil && f == v {
+			return raw
+		}
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Get returns the numeric reading with the given Ecowitt field name.
+func (p *Payload) Get(name string) (float64, bool) {
+	b, ok := lookup(name)
+	if !ok {
+		return 0, false
+	}
+	return b.get(p)
+}
+
+// Set stores a numeric reading under the given Ecowitt field name. Unknown
+// field names are stored in Extra.
+func (p *Payload) Set(name string, v float64) {
+	b, ok := lookup(name)
+	if !ok {
+		p.Extra.Set(name, strconv.FormatFloat(v, 'f', -1, 64))
+		return
+	}
+	b.set(p, v)
+}
+
+// Delete removes the reading with the given field name, numeric or not.
+func (p *Payload) Delete(name string) {
+	if str := stringField(p, name); str != nil {
+		*str = ""
+		delete(p.raw, name)
+		return
+	}
+	if b, ok := lookup(name); ok {
+		b.clear(p)
+		delete(p.raw, name)
+	}
+	p.Extra.Del(name)
+}
+
+// Each calls fn for every numeric reading present in the payload, in field
+// name order.
+func (p *Payload) Each(fn func(name string, v float64)) {
+	names := []string{}
+	for _, b := range fixedBindings {
+		if _, ok := b.get(p); ok {
+			names = append(names, b.name)
+		}
+	}
+	for n := range p.TempHumidityChannels {
+		names = append(names, channelNames(n, tempHumidityPatterns)...)
+	}
+	for n := range p.SoilChannels {
+		names = append(names, channelNames(n, soilPatterns)...)
+	}
+	for n := range p.PM25Channels {
+		names = append(names, channelNames(n, pm25Patterns)...)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if v, ok := p.Get(name); ok {
+			fn(name, v)
+		}
+	}
+}
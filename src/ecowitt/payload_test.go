@@ -0,0 +1,199 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package ecowitt
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadValues(t *testing.T, name string) url.Values {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/" + name)
+	require.NoError(t, err)
+
+	values, err := url.ParseQuery(strings.TrimSpace(string(data)))
+	require.NoError(t, err)
+	return values
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
+
+func TestParse(t *testing.T) {
+	p := Parse(loadValues(t, "gw2000.txt"))
+
+	assert.Equal(t, "0123456789ABCDEF0123456789ABCDEF", p.Station.Passkey)
+	assert.Equal(t, "GW2000A_V3.1.4", p.Station.StationType)
+	assert.Equal(t, "GW2000A", p.Station.Model)
+	assert.Equal(t, "915M", p.Station.Frequency)
+	assert.Equal(t, ptr(60), p.Station.Interval)
+
+	when, err := p.Station.Time()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 17, 3, 22, 0, time.UTC), when)
+
+	assert.Equal(t, TempHumidity{TempF: ptr(71.78), Humidity: ptr(37)}, p.Indoor)
+	assert.Equal(t, TempHumidity{TempF: ptr(45.5), Humidity: ptr(61)}, p.Outdoor)
+	assert.Equal(t, Pressure{RelativeInHg: ptr(29.858), AbsoluteInHg: ptr(29.403)}, p.Pressure)
+	assert.Equal(t, Wind{DirectionDeg: ptr(247), SpeedMPH: ptr(3.8), GustMPH: ptr(6.93), MaxDailyGustMPH: ptr(17.22)}, p.Wind)
+	assert.Equal(t, ptr(0.402), p.Rain.WeeklyIn)
+	assert.Equal(t, ptr(6.5), p.Rain.TotalIn)
+	assert.Equal(t, Solar{RadiationWm2: ptr(312.66), UVIndex: ptr(2)}, p.Solar)
+
+	assert.Len(t, p.TempHumidityChannels, 2)
+	assert.Equal(t, &TempHumidityChannel{TempF: ptr(33.8), Humidity: ptr(88), Battery: ptr(0)}, p.TempHumidityChannels[2])
+	assert.Equal(t, &SoilChannel{MoisturePct: ptr(32), AD: ptr(239), Battery: ptr(1.4)}, p.SoilChannels[1])
+	assert.Equal(t, &PM25Channel{PM25: ptr(6), PM25Avg24h: ptr(5.4), Battery: ptr(5)}, p.PM25Channels[1])
+
+	require.NotNil(t, p.CO2)
+	assert.Equal(t, ptr(612), p.CO2.CO2)
+	assert.Equal(t, ptr(6), p.CO2.Battery)
+
+	require.NotNil(t, p.Lightning)
+	assert.Equal(t, &Lightning{DistanceKm: ptr(12), Time: ptr(1709311000), Count: ptr(3), Battery: ptr(5)}, p.Lightning)
+
+	assert.Equal(t, map[string]float64{"wh65batt": 0, "wh25batt": 0}, p.Batteries)
+	assert.Equal(t, url.Values{"heap": {"96484"}}, p.Extra)
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		values url.Values
+	}{
+		{
+			name:   "GW2000 upload",
+			values: loadValues(t, "gw2000.txt"),
+		},
+		{
+			name: "unparseable and repeated fields are preserved",
+			values: url.Values{
+				"tempf":    {"n/a"},
+				"humidity": {"50", "51"},
+				"temp9f":   {"70.10"},
+				"temp0f":   {"1"},
+				"model":    {""},
+				"newthing": {"x"},
+			},
+		},
+		{
+			name: "non-finite values are preserved",
+			values: url.Values{
+				"tempf":    {"NaN"},
+				"humidity": {"Inf"},
+				"temp1f":   {"+Inf"},
+				"temp2f":   {"-inf"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.values, Parse(test.values).Values())
+		})
+	}
+}
+
+func TestParseNonFinite(t *testing.T) {
+	p := Parse(url.Values{"tempf": {"NaN"}, "humidity": {"+Inf"}, "baromrelin": {"-Inf"}, "temp1f": {"70"}})
+
+	for _, name := range []string{"tempf", "humidity", "baromrelin"} {
+		_, ok := p.Get(name)
+		assert.False(t, ok, name)
+	}
+	assert.Equal(t, url.Values{"tempf": {"NaN"}, "humidity": {"+Inf"}, "baromrelin": {"-Inf"}}, p.Extra)
+
+	names := []string{}
+	p.Each(func(name string, _ float64) { names = append(names, name) })
+	assert.Equal(t, []string{"temp1f"}, names)
+}
+
+func TestModify(t *testing.T) {
+	p := Parse(url.Values{"tempf": {"45.50"}, "humidity": {"61"}, "temp1f": {"68.00"}})
+
+	p.Set("tempf", 46.25)
+	p.Set("temp3f", 50)
+	p.Delete("humidity")
+	p.Set("dewptf", 33.1)
+
+	v, ok := p.Get("temp3f")
+	assert.True(t, ok)
+	assert.Equal(t, 50.0, v)
+	_, ok = p.Get("humidity")
+	assert.False(t, ok)
+
+	assert.Equal(t, url.Values{
+		"tempf":  {"46.25"},
+		"temp1f": {"68.00"},
+		"temp3f": {"50"},
+		"dewptf": {"33.1"},
+	}, p.Values())
+}
+
+func TestEach(t *testing.T) {
+	p := Parse(url.Values{"tempf": {"45.5"}, "batt1": {"0"}, "co2": {"600"}, "PASSKEY": {"A"}, "foo": {"1"}})
+
+	var names []string
+	p.Each(func(name string, _ float64) { names = append(names, name) })
+	assert.Equal(t, []string{"batt1", "co2", "tempf"}, names)
+}
+
+func TestIsKnownField(t *testing.T) {
+	assert.True(t, IsKnownField("PASSKEY"))
+	assert.True(t, IsKnownField("temp8f"))
+	assert.True(t, IsKnownField("pm25_avg_24h_ch4"))
+	assert.False(t, IsKnownField("temp17f"))
+	assert.False(t, IsKnownField("heap"))
+}
+
+func TestFieldInfo(t *testing.T) {
+	for _, b := range fixedBindings {
+		_, ok := FieldInfo(b.name)
+		assert.True(t, ok, "missing info for %s", b.name)
+	}
+
+	info, ok := FieldInfo("temp2f")
+	assert.True(t, ok)
+	assert.Equal(t, Info{Name: "temp2f", Kind: KindTemperature, Unit: UnitFahrenheit, Group: "wh31", Channel: 2}, info)
+
+	info, ok = FieldInfo("baromrelin")
+	assert.True(t, ok)
+	assert.Equal(t, KindPressure, info.Kind)
+	assert.Equal(t, "pressure", info.Group)
+
+	_, ok = FieldInfo("heap")
+	assert.False(t, ok)
+}
+
+func TestStationID(t *testing.T) {
+	a := Station{Passkey: "0123456789ABCDEF0123456789ABCDEF"}
+	b := Station{Passkey: "0123456789abcdef0123456789abcdef"}
+
+	assert.Len(t, a.ID(), 12)
+	assert.Equal(t, a.ID(), b.ID())
+	assert.NotContains(t, a.ID(), "0123456789")
+	assert.Equal(t, "unknown", Station{}.ID())
+}
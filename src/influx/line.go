@@ -0,0 +1,143 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package influx
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+	"hass-ecowitt-proxy/units"
+)
+
+// Tag keys added to every point.
+const (
+	TagStation     = "station"
+	TagModel       = "model"
+	TagStationType = "stationtype"
+	TagChannel     = "channel"
+	// TagUnits is only added when the readings are not in the imperial
+	// units of the Ecowitt protocol.
+	TagUnits = "units"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// point is a single line: the fields of one sensor at one time.
+type point struct {
+	measurement string
+	channel     int
+	fields      []string
+}
+
+// Lines converts an upload into InfluxDB line protocol, one line per sensor
+// group. Multi-channel sensors get one line per channel with a channel tag.
+// The timestamp is taken from the upload when the gateway sent a valid one,
+// otherwise receivedAt is used. Timestamps have second precision. Readings
+// are converted to system and renamed by units.FieldName, so that a bucket
+// never holds a field in two units.
+func Lines(receivedAt time.Time, payload *ecowitt.Payload, system units.System) []string {
+	points := map[string]*point{}
+	payload.Each(func(name string, v float64) {
+		info, ok := ecowitt.FieldInfo(name)
+		if !ok {
+			return
+		}
+
+		key := info.Group + "/" + strconv.Itoa(info.Channel)
+		p, ok := points[key]
+		if !ok {
+			p = &point{measurement: info.Group, channel: info.Channel}
+			points[key] = p
+		}
+		v, unit := system.Convert(info, v)
+		p.fields = append(p.fields, keyEscaper.Replace(units.FieldName(name, info, unit))+"="+formatField(info.Kind, v))
+	})
+
+	sorted := make([]*point, 0, len(points))
+	for _, p := range points {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].measurement != sorted[j].measurement {
+			return sorted[i].measurement < sorted[j].measurement
+		}
+		return sorted[i].channel < sorted[j].channel
+	})
+
+	ts := receivedAt
+	if t, err := payload.Station.Time(); err == nil {
+		ts = t
+	}
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	tags := stationTags(payload.Station, system)
+
+	lines := make([]string, 0, len(sorted))
+	for _, p := range sorted {
+		var b strings.Builder
+		b.WriteString(measurementEscaper.Replace(p.measurement))
+		if p.channel > 0 {
+			b.WriteString("," + TagChannel + "=" + strconv.Itoa(p.channel))
+		}
+		b.WriteString(tags)
+		b.WriteByte(' ')
+		b.WriteString(strings.Join(p.fields, ","))
+		b.WriteByte(' ')
+		b.WriteString(timestamp)
+		lines = append(lines, b.String())
+	}
+	return lines
+}
+
+// stationTags returns the station tags in the sorted order InfluxDB prefers.
+// The PASSKEY is replaced by the station ID.
+func stationTags(s ecowitt.Station, system units.System) string {
+	tags := [][2]string{
+		{TagModel, s.Model},
+		{TagStation, s.ID()},
+		{TagStationType, s.StationType},
+	}
+	if system != units.Imperial {
+		tags = append(tags, [2]string{TagUnits, system.String()})
+	}
+
+	var b strings.Builder
+	for _, tag := range tags {
+		if tag[1] == "" {
+			continue
+		}
+		b.WriteString("," + tag[0] + "=" + keyEscaper.Replace(tag[1]))
+	}
+	return b.String()
+}
+
+// formatField writes counters, timestamps and durations as integers and
+// everything else as floats. The type only depends on the field so that it
+// never changes between uploads, which InfluxDB would reject.
+func formatField(kind ecowitt.Kind, v float64) string {
+	switch kind {
+	case ecowitt.KindCount, ecowitt.KindTimestamp, ecowitt.KindDuration:
+		return strconv.FormatInt(int64(v), 10) + "i"
+	default:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+}
@@ -0,0 +1,375 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package influx archives Ecowitt uploads in InfluxDB. Uploads are converted
+// to line protocol, buffered and written in batches through the InfluxDB v2
+// HTTP write API.
+package influx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+	"hass-ecowitt-proxy/tlsconfig"
+	"hass-ecowitt-proxy/units"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultBatchSize     = 500
+	DefaultMaxPending    = 10000
+	DefaultFlushInterval = 10 * time.Second
+	DefaultTimeout       = 10 * time.Second
+)
+
+var errClosed = errors.New("influxdb writer is closed")
+
+// Config describes the InfluxDB server and how writes are batched.
+type Config struct {
+	// URL is the base URL of the server, e.g. http://influxdb:8086.
+	URL    string
+	Org    string
+	Bucket string
+	Token  string
+	TLS    tlsconfig.Client
+
+	// BatchSize is the number of lines that triggers a write before the
+	// flush interval has passed, and the most lines sent in one request.
+	BatchSize int
+	// MaxPending bounds the number of lines kept while InfluxDB is
+	// unreachable. The oldest lines are dropped first.
+	MaxPending    int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+
+	// Units is the unit system readings are written in.
+	Units units.System
+}
+
+func DefaultConfig() Config {
+	return Config{
+		BatchSize:     DefaultBatchSize,
+		MaxPending:    DefaultMaxPending,
+		FlushInterval: DefaultFlushInterval,
+		Timeout:       DefaultTimeout,
+	}
+}
+
+func (c Config) Validate() error {
+	missing := []string{}
+	if c.URL == "" {
+		missing = append(missing, "url")
+	}
+	if c.Org == "" {
+		missing = append(missing, "org")
+	}
+	if c.Bucket == "" {
+		missing = append(missing, "bucket")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("influxdb is missing: %s", strings.Join(missing, ", "))
+	}
+
+	if c.BatchSize < 1 {
+		return errors.New("influxdb batch size must be at least 1")
+	}
+	if c.MaxPending < c.BatchSize {
+		return errors.New("influxdb max pending must be at least the batch size")
+	}
+	if c.FlushInterval <= 0 {
+		return errors.New("influxdb flush interval must be positive")
+	}
+	if c.Timeout < 0 {
+		return errors.New("influxdb timeout may not be negative")
+	}
+	if c.Units >= units.InvalidSystem {
+		return fmt.Errorf("invalid influxdb unit system %d", c.Units)
+	}
+	return nil
+}
+
+// WriteURL returns the v2 write API endpoint for the bucket.
+func (c Config) WriteURL() string {
+	query := url.Values{
+		"org":       {c.Org},
+		"bucket":    {c.Bucket},
+		"precision": {"s"},
+	}
+	return strings.TrimSuffix(c.URL, "/") + "/api/v2/write?" + query.Encode()
+}
+
+type Option func(*Writer)
+
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(w *Writer) {
+		w.logger = logger
+	}
+}
+
+func WithHTTPClient(client *http.Client) Option {
+	return func(w *Writer) {
+		w.client = client
+	}
+}
+
+// Writer is a controller.Sink that writes uploads to InfluxDB. Publish only
+// buffers the upload; a background goroutine writes the buffer whenever it
+// holds a full batch and on every flush interval.
+type Writer struct {
+	cfg    Config
+	client *http.Client
+	logger *zap.SugaredLogger
+
+	mu      sync.Mutex
+	pending []string
+	closed  bool
+
+	// flushMu keeps lines in order when Flush is called concurrently with
+	// the background writer.
+	flushMu sync.Mutex
+
+	written  atomic.Uint64
+	dropped  atomic.Uint64
+	rejected atomic.Uint64
+
+	kick      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func New(cfg Config, opts ...Option) (*Writer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		cfg:    cfg,
+		logger: zap.NewNop().Sugar(),
+		kick:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	if w.client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if !cfg.TLS.IsZero() {
+			tlsConfig, err := cfg.TLS.Config()
+			if err != nil {
+				return nil, fmt.Errorf("error configuring influxdb TLS: %w", err)
+			}
+			transport.TLSClientConfig = tlsConfig
+		}
+		w.client = &http.Client{Transport: transport, Timeout: cfg.Timeout}
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+func (w *Writer) Name() string {
+	return "influxdb"
+}
+
+// Publish adds the upload to the write buffer.
+func (w *Writer) Publish(_ context.Context, receivedAt time.Time, payload *ecowitt.Payload) error {
+	lines := Lines(receivedAt, payload, w.cfg.Units)
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return errClosed
+	}
+	w.pending = append(w.pending, lines...)
+	w.trimLocked()
+	full := len(w.pending) >= w.cfg.BatchSize
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// trimLocked drops the oldest lines beyond MaxPending.
+func (w *Writer) trimLocked() {
+	if excess := len(w.pending) - w.cfg.MaxPending; excess > 0 {
+		w.pending = w.pending[excess:]
+		w.dropped.Add(uint64(excess))
+		w.logger.Warnf("InfluxDB write buffer full, dropped %d lines", excess)
+	}
+}
+
+// Written returns the number of lines InfluxDB accepted.
+func (w *Writer) Written() uint64 {
+	return w.written.Load()
+}
+
+// Dropped returns the number of lines discarded because the buffer was full.
+func (w *Writer) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Rejected returns the number of lines discarded because InfluxDB refused
+// them, e.g. because of a field type conflict.
+func (w *Writer) Rejected() uint64 {
+	return w.rejected.Load()
+}
+
+// Pending returns the number of buffered lines.
+func (w *Writer) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+func (w *Writer) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		case <-w.kick:
+		}
+
+		if err := w.Flush(context.Background()); err != nil {
+			w.logger.Errorf("Error writing to InfluxDB: %s", err)
+		}
+	}
+}
+
+// Flush writes all buffered lines in batches. Lines that could not be
+// written because InfluxDB is unavailable stay in the buffer for the next
+// attempt. Batches InfluxDB refuses are dropped, since retrying them would
+// block every later batch, and reported in the returned error.
+func (w *Writer) Flush(ctx context.Context) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	var rejected []error
+	for {
+		w.mu.Lock()
+		n := min(len(w.pending), w.cfg.BatchSize)
+		batch := w.pending[:n:n]
+		w.pending = w.pending[n:]
+		w.mu.Unlock()
+
+		if len(batch) == 0 {
+			return errors.Join(rejected...)
+		}
+
+		if err := w.write(ctx, batch); err != nil {
+			var se *statusError
+			if errors.As(err, &se) && !se.retryable() {
+				w.rejected.Add(uint64(len(batch)))
+				rejected = append(rejected, fmt.Errorf("dropped %d lines: %w", len(batch), err))
+				continue
+			}
+
+			w.mu.Lock()
+			w.pending = append(batch, w.pending...)
+			w.trimLocked()
+			w.mu.Unlock()
+			return errors.Join(append(rejected, err)...)
+		}
+		w.written.Add(uint64(len(batch)))
+	}
+}
+
+// statusError is an unsuccessful response from the write API.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("influxdb write failed with status %d: %s", e.status, e.msg)
+}
+
+// retryable reports whether writing the same lines again may succeed. Other
+// client errors, e.g. 400 for a field type conflict, are permanent.
+func (e *statusError) retryable() bool {
+	return e.status < 400 || e.status >= 500 || e.status == http.StatusTooManyRequests
+}
+
+func (w *Writer) write(ctx context.Context, lines []string) error {
+	body := strings.Join(lines, "\n")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.WriteURL(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.cfg.Token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{status: resp.StatusCode, msg: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// Close stops the background writer and writes whatever is still buffered.
+func (w *Writer) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		w.mu.Lock()
+		w.closed = true
+		w.mu.Unlock()
+
+		close(w.done)
+		w.wg.Wait()
+
+		ctx := context.Background()
+		if w.cfg.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, w.cfg.Timeout)
+			defer cancel()
+		}
+		err = w.Flush(ctx)
+	})
+	return err
+}
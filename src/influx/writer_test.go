@@ -0,0 +1,304 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package influx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+	"hass-ecowitt-proxy/units"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLines(t *testing.T) {
+	receivedAt := time.Date(2024, 3, 1, 17, 5, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		values url.Values
+		units  units.System
+		want   []string
+	}{
+		{
+			name: "groups, channels and field types",
+			values: url.Values{
+				"PASSKEY":       {"0123456789ABCDEF0123456789ABCDEF"},
+				"stationtype":   {"GW2000A_V3.1.4"},
+				"model":         {"GW2000A"},
+				"dateutc":       {"2024-03-01 17:03:22"},
+				"runtime":       {"3600"},
+				"tempf":         {"45.50"},
+				"humidity":      {"61"},
+				"temp2f":        {"33.8"},
+				"humidity2":     {"88"},
+				"temp1f":        {"68"},
+				"lightning_num": {"3"},
+				"heap":          {"96484"},
+			},
+			want: []string{
+				"outdoor,model=GW2000A,station=%s,stationtype=GW2000A_V3.1.4 humidity=61,tempf=45.5 1709312602",
+				"station,model=GW2000A,station=%s,stationtype=GW2000A_V3.1.4 runtime=3600i 1709312602",
+				"wh31,channel=1,model=GW2000A,station=%s,stationtype=GW2000A_V3.1.4 temp1f=68 1709312602",
+				"wh31,channel=2,model=GW2000A,station=%s,stationtype=GW2000A_V3.1.4 humidity2=88,temp2f=33.8 1709312602",
+				"wh57,model=GW2000A,station=%s,stationtype=GW2000A_V3.1.4 lightning_num=3i 1709312602",
+			},
+		},
+		{
+			name: "escaping and fallback timestamp",
+			values: url.Values{
+				"PASSKEY": {"AAAA"},
+				"model":   {"My Station,1"},
+				"dateutc": {"now"},
+				"tempinf": {"70"},
+			},
+			want: []string{
+				`indoor,model=My\ Station\,1,station=%s tempinf=70 1709312700`,
+			},
+		},
+		{
+			name: "metric units",
+			values: url.Values{
+				"PASSKEY":      {"AAAA"},
+				"dateutc":      {"2024-03-01 17:03:22"},
+				"tempf":        {"45.5"},
+				"humidity":     {"61"},
+				"windspeedmph": {"10"},
+				"baromrelin":   {"29.92"},
+				"dailyrainin":  {"0.5"},
+				"rainratein":   {"0.1"},
+				"maxdailygust": {"20"},
+				"vpdin":        {"0.3"},
+			},
+			units: units.MetricWindMS,
+			want: []string{
+				"indoor,station=%s,units=metric_wind_ms vpdin_hpa=10.16 1709312602",
+				"outdoor,station=%s,units=metric_wind_ms humidity=61,tempc=7.5 1709312602",
+				"pressure,station=%s,units=metric_wind_ms baromrelhpa=1013.21 1709312602",
+				"rain,station=%s,units=metric_wind_ms dailyrainmm=12.7,rainratemmh=2.54 1709312602",
+				"wind,station=%s,units=metric_wind_ms maxdailygust_ms=8.94,windspeedms=4.47 1709312602",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := ecowitt.Parse(test.values)
+			id := payload.Station.ID()
+
+			want := make([]string, len(test.want))
+			for i, line := range test.want {
+				want[i] = strings.ReplaceAll(line, "%s", id)
+			}
+			assert.Equal(t, want, Lines(receivedAt, payload, test.units))
+		})
+	}
+}
+
+// influxServer records the bodies of write requests. Bodies containing
+// reject are refused with 400 Bad Request.
+type influxServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	status int
+	reject string
+	bodies []string
+	auth   string
+	query  url.Values
+}
+
+func newInfluxServer(t *testing.T) *influxServer {
+	s := &influxServer{status: http.StatusNoContent}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.auth = r.Header.Get("Authorization")
+		s.query = r.URL.Query()
+		if s.reject != "" && strings.Contains(string(body), s.reject) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"code":"invalid","message":"field type conflict"}`)
+			return
+		}
+		if s.status == http.StatusNoContent {
+			s.bodies = append(s.bodies, string(body))
+		}
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *influxServer) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *influxServer) writes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func testConfig(s *influxServer) Config {
+	cfg := DefaultConfig()
+	cfg.URL = s.URL
+	cfg.Org = "home"
+	cfg.Bucket = "weather"
+	cfg.Token = "secret"
+	return cfg
+}
+
+func upload(temp string) *ecowitt.Payload {
+	return ecowitt.Parse(url.Values{"PASSKEY": {"AAAA"}, "dateutc": {"2024-03-01 17:03:22"}, "tempf": {temp}})
+}
+
+func TestWriterBatching(t *testing.T) {
+	s := newInfluxServer(t)
+	cfg := testConfig(s)
+	cfg.BatchSize = 2
+	cfg.FlushInterval = time.Hour
+
+	w, err := New(cfg)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, w.Publish(ctx, time.Now(), upload("40")))
+	assert.Equal(t, 1, w.Pending())
+	require.NoError(t, w.Publish(ctx, time.Now(), upload("41")))
+
+	require.Eventually(t, func() bool { return len(s.writes()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	id := ecowitt.Station{Passkey: "AAAA"}.ID()
+	assert.Equal(t, "outdoor,station="+id+" tempf=40 1709312602\noutdoor,station="+id+" tempf=41 1709312602",
+		s.writes()[0])
+	assert.Equal(t, "Token secret", s.auth)
+	assert.Equal(t, url.Values{"org": {"home"}, "bucket": {"weather"}, "precision": {"s"}}, s.query)
+
+	// Close writes the remainder.
+	require.NoError(t, w.Publish(ctx, time.Now(), upload("42")))
+	require.NoError(t, w.Close())
+	assert.Len(t, s.writes(), 2)
+	assert.Equal(t, uint64(3), w.Written())
+
+	assert.Error(t, w.Publish(ctx, time.Now(), upload("43")))
+}
+
+func TestWriterFlushInterval(t *testing.T) {
+	s := newInfluxServer(t)
+	cfg := testConfig(s)
+	cfg.FlushInterval = 20 * time.Millisecond
+
+	w, err := New(cfg)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.Publish(context.Background(), time.Now(), upload("40")))
+	require.Eventually(t, func() bool { return len(s.writes()) == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWriterFailure(t *testing.T) {
+	s := newInfluxServer(t)
+	s.setStatus(http.StatusServiceUnavailable)
+
+	cfg := testConfig(s)
+	cfg.BatchSize = 1
+	cfg.MaxPending = 2
+	cfg.FlushInterval = time.Hour
+
+	w, err := New(cfg)
+	require.NoError(t, err)
+	defer w.Close()
+
+	ctx := context.Background()
+	for _, temp := range []string{"40", "41", "42"} {
+		require.NoError(t, w.Publish(ctx, time.Now(), upload(temp)))
+	}
+
+	// The background writer keeps failing; the oldest line is dropped once
+	// the buffer is full.
+	assert.Error(t, w.Flush(ctx))
+	require.Eventually(t, func() bool {
+		return w.Pending() == 2 && w.Dropped() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.setStatus(http.StatusNoContent)
+	require.NoError(t, w.Flush(ctx))
+	assert.Equal(t, 0, w.Pending())
+
+	writes := s.writes()
+	require.Len(t, writes, 2)
+	assert.Contains(t, writes[0], "tempf=41")
+	assert.Contains(t, writes[1], "tempf=42")
+}
+
+func TestWriterRejected(t *testing.T) {
+	s := newInfluxServer(t)
+	s.reject = "tempf=41"
+
+	cfg := testConfig(s)
+	cfg.BatchSize = 1
+	cfg.FlushInterval = time.Hour
+
+	w, err := New(cfg)
+	require.NoError(t, err)
+	defer w.Close()
+
+	ctx := context.Background()
+	for _, temp := range []string{"40", "41", "42"} {
+		require.NoError(t, w.Publish(ctx, time.Now(), upload(temp)))
+	}
+
+	// The refused batch is dropped instead of blocking the ones after it.
+	err = w.Flush(ctx)
+	assert.ErrorContains(t, err, "status 400")
+	assert.ErrorContains(t, err, "field type conflict")
+	assert.Equal(t, 0, w.Pending())
+	assert.Equal(t, uint64(1), w.Rejected())
+	assert.Equal(t, uint64(2), w.Written())
+
+	writes := s.writes()
+	require.Len(t, writes, 2)
+	assert.Contains(t, writes[0], "tempf=40")
+	assert.Contains(t, writes[1], "tempf=42")
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Error(t, cfg.Validate())
+
+	cfg.URL = "http://influxdb:8086/"
+	cfg.Org = "home"
+	cfg.Bucket = "weather"
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, "http://influxdb:8086/api/v2/write?bucket=weather&org=home&precision=s", cfg.WriteURL())
+
+	cfg.MaxPending = cfg.BatchSize - 1
+	assert.Error(t, cfg.Validate())
+}
@@ -0,0 +1,103 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package mqtt
+
+import (
+	"encoding/json"
+
+	"hass-ecowitt-proxy/ecowitt"
+)
+
+// Home Assistant sensor state classes.
+const (
+	stateClassMeasurement     = "measurement"
+	stateClassTotalIncreasing = "total_increasing"
+)
+
+// deviceClasses maps field kinds to Home Assistant sensor device classes.
+// Kinds without a matching device class are left out.
+var deviceClasses = map[ecowitt.Kind]string{
+	ecowitt.KindTemperature: "temperature",
+	ecowitt.KindHumidity:    "humidity",
+	ecowitt.KindPressure:    "atmospheric_pressure",
+	ecowitt.KindWindSpeed:   "wind_speed",
+	ecowitt.KindRain:        "precipitation",
+	ecowitt.KindRainRate:    "precipitation_intensity",
+	ecowitt.KindIrradiance:  "irradiance",
+	ecowitt.KindPM25:        "pm25",
+	ecowitt.KindPM10:        "pm10",
+	ecowitt.KindCO2:         "carbon_dioxide",
+	ecowitt.KindMoisture:    "moisture",
+	ecowitt.KindDistance:    "distance",
+	ecowitt.KindDuration:    "duration",
+
+	ecowitt.KindAbsoluteHumidity: "absolute_humidity",
+	ecowitt.KindVaporPressure:    "pressure",
+}
+
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// sensorConfig is the discovery message of a single sensor.
+type sensorConfig struct {
+	Name              string `json:"name"`
+	UniqueID          string `json:"unique_id"`
+	ObjectID          string `json:"object_id"`
+	StateTopic        string `json:"state_topic"`
+	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string `json:"device_class,omitempty"`
+	StateClass        string `json:"state_class,omitempty"`
+	Device            device `json:"device"`
+}
+
+func discoveryMessage(stationID string, station ecowitt.Station, info ecowitt.Info, stateTopic string) ([]byte, error) {
+	model := station.Model
+	if model == "" {
+		model = station.StationType
+	}
+
+	cfg := sensorConfig{
+		Name:              info.Name,
+		UniqueID:          "ecowitt_" + stationID + "_" + info.Name,
+		ObjectID:          "ecowitt_" + stationID + "_" + info.Name,
+		StateTopic:        stateTopic,
+		UnitOfMeasurement: info.Unit,
+		DeviceClass:       deviceClasses[info.Kind],
+		Device: device{
+			Identifiers:  []string{"ecowitt_" + stationID},
+			Name:         "Ecowitt " + stationID,
+			Manufacturer: "Ecowitt",
+			Model:        model,
+			SWVersion:    station.StationType,
+		},
+	}
+
+	switch info.Kind {
+	case ecowitt.KindRain, ecowitt.KindCount:
+		cfg.StateClass = stateClassTotalIncreasing
+	case ecowitt.KindTimestamp, ecowitt.KindUnknown:
+	default:
+		cfg.StateClass = stateClassMeasurement
+	}
+
+	return json.Marshal(cfg)
+}
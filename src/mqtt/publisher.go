@@ -0,0 +1,288 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package mqtt publishes Ecowitt readings to an MQTT broker, one topic per
+// reading, together with Home Assistant MQTT discovery messages so that the
+// sensors show up in Home Assistant without the Ecowitt integration.
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+	"hass-ecowitt-proxy/tlsconfig"
+	"hass-ecowitt-proxy/units"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultTopicPrefix     = "ecowitt"
+	DefaultDiscoveryPrefix = "homeassistant"
+	DefaultClientID        = "hass-ecowitt-proxy"
+	DefaultConnectTimeout  = 10 * time.Second
+)
+
+// Config describes the broker connection and the topic layout.
+type Config struct {
+	// Broker is the broker URL, e.g. tcp://localhost:1883 or
+	// ssl://broker:8883.
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	TLS      tlsconfig.Client
+
+	// TopicPrefix is the first level of the state topics. Readings are
+	// published to <TopicPrefix>/<station id>/<field>.
+	TopicPrefix string
+	// DiscoveryPrefix is the Home Assistant discovery prefix. Discovery is
+	// disabled when it is empty.
+	DiscoveryPrefix string
+
+	QoS    byte
+	Retain bool
+
+	// Units is the unit system readings are published in. Discovery
+	// messages carry the matching units.
+	Units units.System
+
+	ConnectTimeout time.Duration
+}
+
+// DefaultConfig returns a Config with the default client id, prefixes and
+// timeout. Broker must still be set.
+func DefaultConfig() Config {
+	return Config{
+		ClientID:        DefaultClientID,
+		TopicPrefix:     DefaultTopicPrefix,
+		DiscoveryPrefix: DefaultDiscoveryPrefix,
+		ConnectTimeout:  DefaultConnectTimeout,
+	}
+}
+
+func (c Config) Validate() error {
+	if c.Broker == "" {
+		return errors.New("mqtt broker is required")
+	}
+	if c.TopicPrefix == "" {
+		return errors.New("mqtt topic prefix is required")
+	}
+	if strings.ContainsAny(c.TopicPrefix+c.DiscoveryPrefix, "#+") {
+		return errors.New("mqtt topic prefixes may not contain wildcards")
+	}
+	if c.QoS > 2 {
+		return fmt.Errorf("invalid mqtt qos %d: must be 0, 1 or 2", c.QoS)
+	}
+	if c.ConnectTimeout < 0 {
+		return errors.New("mqtt connect timeout may not be negative")
+	}
+	if c.Units >= units.InvalidSystem {
+		return fmt.Errorf("invalid mqtt unit system %d", c.Units)
+	}
+	return nil
+}
+
+type Option func(*Publisher)
+
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(p *Publisher) {
+		p.logger = logger
+	}
+}
+
+// Publisher is a controller.Sink that publishes uploads to an MQTT broker.
+type Publisher struct {
+	cfg    Config
+	client paho.Client
+	logger *zap.SugaredLogger
+
+	// announced records the discovery topics published since the last
+	// (re)connect.
+	mu        sync.Mutex
+	announced map[string]bool
+}
+
+// New connects to the broker. The connection is re-established automatically
+// if it is lost later on.
+func New(cfg Config, opts ...Option) (*Publisher, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = DefaultConnectTimeout
+	}
+
+	p := &Publisher{
+		cfg:       cfg,
+		logger:    zap.NewNop().Sugar(),
+		announced: map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	clientOpts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(cfg.ConnectTimeout).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			p.logger.Warnf("Lost connection to MQTT broker %s: %s", cfg.Broker, err)
+		})
+
+	if !cfg.TLS.IsZero() {
+		tlsConfig, err := cfg.TLS.Config()
+		if err != nil {
+			return nil, fmt.Errorf("error configuring mqtt TLS: %w", err)
+		}
+		clientOpts.SetTLSConfig(tlsConfig)
+	}
+
+	p.client = paho.NewClient(clientOpts)
+	token := p.client.Connect()
+	if !token.WaitTimeout(cfg.ConnectTimeout) {
+		p.client.Disconnect(0)
+		return nil, fmt.Errorf("timed out connecting to mqtt broker %s", cfg.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("error connecting to mqtt broker %s: %w", cfg.Broker, err)
+	}
+
+	return p, nil
+}
+
+// onConnect runs after every successful (re)connect. Discovery messages are
+// sent again with the next upload, and whenever Home Assistant announces that
+// it came back online, in case the broker lost its retained messages.
+func (p *Publisher) onConnect(client paho.Client) {
+	p.logger.Infof("Connected to MQTT broker %s", p.cfg.Broker)
+	p.resetDiscovery()
+
+	if p.cfg.DiscoveryPrefix == "" {
+		return
+	}
+	client.Subscribe(p.cfg.DiscoveryPrefix+"/status", 0, func(_ paho.Client, msg paho.Message) {
+		if string(msg.Payload()) == "online" {
+			p.resetDiscovery()
+		}
+	})
+}
+
+func (p *Publisher) resetDiscovery() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(p.announced)
+}
+
+func (p *Publisher) Name() string {
+	return "mqtt"
+}
+
+// Publish sends every numeric reading of the payload to its state topic,
+// preceded by a discovery message for readings Home Assistant has not been
+// told about yet. Converted readings are renamed by units.FieldName, e.g.
+// tempf is published as tempc, so that a topic never carries two units.
+func (p *Publisher) Publish(ctx context.Context, _ time.Time, payload *ecowitt.Payload) error {
+	id := payload.Station.ID()
+
+	tokens := []paho.Token{}
+	payload.Each(func(name string, v float64) {
+		info, ok := ecowitt.FieldInfo(name)
+		if !ok {
+			return
+		}
+		v, unit := p.cfg.Units.Convert(info, v)
+		info.Name = units.FieldName(name, info, unit)
+		info.Unit = unit
+		if topic, msg, ok := p.discovery(id, payload.Station, info); ok {
+			tokens = append(tokens, p.client.Publish(topic, p.cfg.QoS, true, msg))
+		}
+		tokens = append(tokens, p.client.Publish(p.StateTopic(id, info.Name), p.cfg.QoS, p.cfg.Retain,
+			strconv.FormatFloat(v, 'f', -1, 64)))
+	})
+
+	errs := []error{}
+	for _, token := range tokens {
+		select {
+		case <-token.Done():
+			if err := token.Error(); err != nil {
+				errs = append(errs, err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		// Make sure discovery is sent again once the broker is back.
+		p.resetDiscovery()
+		return err
+	}
+	return nil
+}
+
+// StateTopic returns the topic a station's reading is published to.
+func (p *Publisher) StateTopic(stationID string, field string) string {
+	return fmt.Sprintf("%s/%s/%s", p.cfg.TopicPrefix, stationID, field)
+}
+
+// DiscoveryTopic returns the topic of the Home Assistant discovery message of
+// a station's reading.
+func (p *Publisher) DiscoveryTopic(stationID string, field string) string {
+	return fmt.Sprintf("%s/sensor/ecowitt_%s/%s/config", p.cfg.DiscoveryPrefix, stationID, field)
+}
+
+// discovery returns the discovery message for a reading unless it has
+// already been sent since the last connect.
+func (p *Publisher) discovery(stationID string, station ecowitt.Station, info ecowitt.Info) (string, []byte, bool) {
+	if p.cfg.DiscoveryPrefix == "" {
+		return "", nil, false
+	}
+
+	topic := p.DiscoveryTopic(stationID, info.Name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.announced[topic] {
+		return "", nil, false
+	}
+
+	msg, err := discoveryMessage(stationID, station, info, p.StateTopic(stationID, info.Name))
+	if err != nil {
+		p.logger.Errorf("Error building discovery message for %s: %s", info.Name, err)
+		return "", nil, false
+	}
+	p.announced[topic] = true
+	return topic, msg, true
+}
+
+// Close disconnects from the broker, waiting briefly for in-flight messages.
+func (p *Publisher) Close() error {
+	p.client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,282 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+	"hass-ecowitt-proxy/units"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testUsername = "ecowitt"
+	testPassword = "secret"
+)
+
+// broker is an embedded MQTT broker that records everything published to it.
+type broker struct {
+	server *mochi.Server
+	addr   string
+
+	mu       sync.Mutex
+	messages map[string]packets.Packet
+}
+
+func startBroker(t *testing.T) *broker {
+	t.Helper()
+
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.Hook), &auth.Options{
+		Ledger: &auth.Ledger{
+			Auth: auth.AuthRules{{Username: testUsername, Password: testPassword, Allow: true}},
+			ACL:  auth.ACLRules{{}},
+		},
+	}))
+
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	require.NoError(t, server.AddListener(tcp))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { server.Close() })
+
+	b := &broker{server: server, addr: tcp.Address(), messages: map[string]packets.Packet{}}
+	require.NoError(t, server.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.messages[pk.TopicName] = pk
+	}))
+	return b
+}
+
+func (b *broker) message(topic string) (packets.Packet, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pk, ok := b.messages[topic]
+	return pk, ok
+}
+
+func (b *broker) waitFor(t *testing.T, topic string) packets.Packet {
+	t.Helper()
+
+	var pk packets.Packet
+	require.Eventually(t, func() bool {
+		var ok bool
+		pk, ok = b.message(topic)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond, "no message on %s", topic)
+	return pk
+}
+
+func (b *broker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.messages)
+}
+
+func testConfig(b *broker) Config {
+	cfg := DefaultConfig()
+	cfg.Broker = "tcp://" + b.addr
+	cfg.Username = testUsername
+	cfg.Password = testPassword
+	cfg.TopicPrefix = "weather"
+	cfg.QoS = 1
+	return cfg
+}
+
+func TestPublish(t *testing.T) {
+	b := startBroker(t)
+
+	p, err := New(testConfig(b))
+	require.NoError(t, err)
+	defer p.Close()
+
+	payload := ecowitt.Parse(url.Values{
+		"PASSKEY":     {"0123456789ABCDEF0123456789ABCDEF"},
+		"stationtype": {"GW2000A_V3.1.4"},
+		"model":       {"GW2000A"},
+		"tempf":       {"45.50"},
+		"dailyrainin": {"0.12"},
+		"heap":        {"96484"},
+	})
+	id := payload.Station.ID()
+
+	require.NoError(t, p.Publish(context.Background(), time.Now(), payload))
+
+	state := b.waitFor(t, "weather/"+id+"/tempf")
+	assert.Equal(t, "45.5", string(state.Payload))
+	assert.False(t, state.FixedHeader.Retain)
+	b.waitFor(t, "weather/"+id+"/dailyrainin")
+	_, ok := b.message("weather/" + id + "/heap")
+	assert.False(t, ok)
+
+	disc := b.waitFor(t, "homeassistant/sensor/ecowitt_"+id+"/tempf/config")
+	assert.True(t, disc.FixedHeader.Retain)
+
+	var cfg sensorConfig
+	require.NoError(t, json.Unmarshal(disc.Payload, &cfg))
+	assert.Equal(t, sensorConfig{
+		Name:              "tempf",
+		UniqueID:          "ecowitt_" + id + "_tempf",
+		ObjectID:          "ecowitt_" + id + "_tempf",
+		StateTopic:        "weather/" + id + "/tempf",
+		UnitOfMeasurement: "°F",
+		DeviceClass:       "temperature",
+		StateClass:        "measurement",
+		Device: device{
+			Identifiers:  []string{"ecowitt_" + id},
+			Name:         "Ecowitt " + id,
+			Manufacturer: "Ecowitt",
+			Model:        "GW2000A",
+			SWVersion:    "GW2000A_V3.1.4",
+		},
+	}, cfg)
+
+	rain := b.waitFor(t, "homeassistant/sensor/ecowitt_"+id+"/dailyrainin/config")
+	require.NoError(t, json.Unmarshal(rain.Payload, &cfg))
+	assert.Equal(t, "precipitation", cfg.DeviceClass)
+	assert.Equal(t, "total_increasing", cfg.StateClass)
+
+	// Discovery is only sent once per connection, until Home Assistant comes
+	// back online.
+	b.reset()
+	require.NoError(t, p.Publish(context.Background(), time.Now(), payload))
+	b.waitFor(t, "weather/"+id+"/tempf")
+	_, ok = b.message("homeassistant/sensor/ecowitt_" + id + "/tempf/config")
+	assert.False(t, ok)
+
+	require.NoError(t, b.server.Publish("homeassistant/status", []byte("online"), false, 0))
+	require.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.announced) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, p.Publish(context.Background(), time.Now(), payload))
+	b.waitFor(t, "homeassistant/sensor/ecowitt_"+id+"/tempf/config")
+}
+
+func TestPublishMetric(t *testing.T) {
+	b := startBroker(t)
+
+	cfg := testConfig(b)
+	cfg.Units = units.Metric
+	p, err := New(cfg)
+	require.NoError(t, err)
+	defer p.Close()
+
+	payload := ecowitt.Parse(url.Values{
+		"PASSKEY":      {"0123456789ABCDEF0123456789ABCDEF"},
+		"tempf":        {"45.50"},
+		"windspeedmph": {"10"},
+		"humidity":     {"61"},
+	})
+	id := payload.Station.ID()
+
+	require.NoError(t, p.Publish(context.Background(), time.Now(), payload))
+
+	tests := []struct {
+		field string
+		state string
+		unit  string
+	}{
+		{field: "tempc", state: "7.5", unit: "°C"},
+		{field: "windspeedkmh", state: "16.09", unit: "km/h"},
+		{field: "humidity", state: "61", unit: "%"},
+	}
+	for _, test := range tests {
+		t.Run(test.field, func(t *testing.T) {
+			state := b.waitFor(t, "weather/"+id+"/"+test.field)
+			assert.Equal(t, test.state, string(state.Payload))
+
+			disc := b.waitFor(t, "homeassistant/sensor/ecowitt_"+id+"/"+test.field+"/config")
+			var cfg sensorConfig
+			require.NoError(t, json.Unmarshal(disc.Payload, &cfg))
+			assert.Equal(t, test.unit, cfg.UnitOfMeasurement)
+			assert.Equal(t, "ecowitt_"+id+"_"+test.field, cfg.UniqueID)
+			assert.Equal(t, "weather/"+id+"/"+test.field, cfg.StateTopic)
+		})
+	}
+
+	// Nothing is published under the imperial names.
+	for _, field := range []string{"tempf", "windspeedmph"} {
+		_, ok := b.message("weather/" + id + "/" + field)
+		assert.False(t, ok, field)
+	}
+}
+
+func TestNew(t *testing.T) {
+	b := startBroker(t)
+
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr bool
+	}{
+		{
+			name:   "valid credentials",
+			modify: func(*Config) {},
+		},
+		{
+			name:    "wrong password",
+			modify:  func(c *Config) { c.Password = "wrong" },
+			wantErr: true,
+		},
+		{
+			name:    "missing broker",
+			modify:  func(c *Config) { c.Broker = "" },
+			wantErr: true,
+		},
+		{
+			name:    "wildcard prefix",
+			modify:  func(c *Config) { c.TopicPrefix = "weather/#" },
+			wantErr: true,
+		},
+		{
+			name:    "invalid qos",
+			modify:  func(c *Config) { c.QoS = 3 },
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(b)
+			cfg.ClientID = t.Name()
+			test.modify(&cfg)
+
+			p, err := New(cfg)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.NoError(t, p.Close())
+		})
+	}
+}
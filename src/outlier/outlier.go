@@ -0,0 +1,367 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package outlier filters bogus sensor readings, e.g. the 200 mph gusts or
+// -40°F temperatures a sensor with a failing battery reports, before they
+// reach Home Assistant's long-term statistics.
+//
+// Every reading is checked against a physical range and, optionally, a
+// maximum rate of change relative to the last good reading of the same
+// station. A reading that fails either check is dropped, replaced by the last
+// good value or causes the whole upload to be rejected.
+package outlier
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+)
+
+// ErrRejected is returned by Filter.Apply when an upload is rejected.
+var ErrRejected = errors.New("upload rejected by outlier filter")
+
+// Action is what happens to a reading that fails a check.
+type Action uint8
+
+const (
+	// UnsetAction makes a Limit use the action of the filter.
+	UnsetAction Action = iota
+	// DropAction removes the reading from the upload.
+	DropAction
+	// LastGoodAction replaces the reading with the last good value from the
+	// same station, or drops it when there is none.
+	LastGoodAction
+	// RejectAction rejects the whole upload.
+	RejectAction
+	InvalidAction
+)
+
+var actionNames = map[Action]string{
+	DropAction:     "drop",
+	LastGoodAction: "last_good",
+	RejectAction:   "reject",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+func ActionNames() []string {
+	return []string{DropAction.String(), LastGoodAction.String(), RejectAction.String()}
+}
+
+// ActionFromStr parses an action name. The empty string is UnsetAction.
+func ActionFromStr(name string) (Action, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return UnsetAction, nil
+	case "drop":
+		return DropAction, nil
+	case "last_good":
+		return LastGoodAction, nil
+	case "reject":
+		return RejectAction, nil
+	default:
+		return InvalidAction, fmt.Errorf("invalid outlier action %q", name)
+	}
+}
+
+// Reasons a reading is filtered.
+const (
+	ReasonRange = "range"
+	ReasonRate  = "rate"
+)
+
+// Limit bounds a single reading.
+type Limit struct {
+	Min *float64
+	Max *float64
+	// MaxRate is the largest change per minute relative to the last good
+	// reading. Zero disables the check.
+	MaxRate float64
+	Action  Action
+}
+
+func (l Limit) validate() error {
+	if l.Min != nil && l.Max != nil && *l.Min > *l.Max {
+		return fmt.Errorf("min %v is greater than max %v", *l.Min, *l.Max)
+	}
+	if l.MaxRate < 0 {
+		return fmt.Errorf("max rate %v is negative", l.MaxRate)
+	}
+	if l.Action >= InvalidAction {
+		return fmt.Errorf("invalid action %d", l.Action)
+	}
+	return nil
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+// defaultLimits are the physical ranges of each kind of reading in the units
+// of the Ecowitt protocol. They are generous on purpose and only catch values
+// no home weather station can measure. Temperatures start just above -40°F:
+// it is the lowest reading Ecowitt sensors report, and the one a sensor with
+// a failing battery sends. Stations that do see -40°F can configure a lower
+// min.
+var defaultLimits = map[ecowitt.Kind]Limit{
+	ecowitt.KindTemperature:   {Min: bound(-39.9), Max: bound(160)},
+	ecowitt.KindHumidity:      {Min: bound(0), Max: bound(100)},
+	ecowitt.KindPressure:      {Min: bound(15), Max: bound(32.5)},
+	ecowitt.KindWindSpeed:     {Min: bound(0), Max: bound(160)},
+	ecowitt.KindWindDirection: {Min: bound(0), Max: bound(360)},
+	ecowitt.KindRain:          {Min: bound(0)},
+	ecowitt.KindRainRate:      {Min: bound(0), Max: bound(30)},
+	ecowitt.KindIrradiance:    {Min: bound(0), Max: bound(2000)},
+	ecowitt.KindUVIndex:       {Min: bound(0), Max: bound(20)},
+	ecowitt.KindPM25:          {Min: bound(0), Max: bound(1000)},
+	ecowitt.KindPM10:          {Min: bound(0), Max: bound(1000)},
+	ecowitt.KindCO2:           {Min: bound(0), Max: bound(10000)},
+	ecowitt.KindMoisture:      {Min: bound(0), Max: bound(100)},
+}
+
+// Config configures a Filter.
+type Config struct {
+	// Action applies to limits without an action of their own. It defaults
+	// to DropAction.
+	Action Action
+	// Limits are keyed by Ecowitt field name, e.g. "windgustmph". Min and
+	// Max replace the default range of the field when set.
+	Limits map[string]Limit
+	// MaxStations bounds the number of stations whose last good values are
+	// kept. The station that has been silent the longest is forgotten to make
+	// room for a new one. Zero keeps every station.
+	MaxStations int
+}
+
+// Validate checks that every limit applies to a numeric Ecowitt field and is
+// consistent.
+func (cfg Config) Validate() error {
+	if cfg.Action >= InvalidAction {
+		return fmt.Errorf("invalid action %d", cfg.Action)
+	}
+	if cfg.MaxStations < 0 {
+		return fmt.Errorf("max stations %d is negative", cfg.MaxStations)
+	}
+
+	names := make([]string, 0, len(cfg.Limits))
+	for name := range cfg.Limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	unknown := []string{}
+	for _, name := range names {
+		if _, ok := ecowitt.FieldInfo(name); !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if err := cfg.Limits[name].validate(); err != nil {
+			return fmt.Errorf("limit of %s: %w", name, err)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("limits of unknown fields: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Count identifies a counter of filtered readings.
+type Count struct {
+	Field  string
+	Reason string
+	Action string
+}
+
+// sample is the last good value of a reading.
+type sample struct {
+	value float64
+	at    time.Time
+}
+
+// Filter checks uploads against the limits. It remembers the last good value
+// of every reading per station and is safe for concurrent use.
+type Filter struct {
+	action      Action
+	limits      map[string]Limit
+	maxStations int
+
+	mu       sync.Mutex
+	last     map[string]map[string]sample
+	seen     map[string]time.Time
+	filtered map[Count]uint64
+}
+
+// New returns a filter for a valid configuration.
+func New(cfg Config) (*Filter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	action := cfg.Action
+	if action == UnsetAction {
+		action = DropAction
+	}
+	return &Filter{
+		action:      action,
+		limits:      cfg.Limits,
+		maxStations: cfg.MaxStations,
+		last:        map[string]map[string]sample{},
+		seen:        map[string]time.Time{},
+		filtered:    map[Count]uint64{},
+	}, nil
+}
+
+// limit returns the limit of a field: its default range, overridden by the
+// configured limit. Fields without either only have to be finite.
+func (f *Filter) limit(name string) Limit {
+	info, _ := ecowitt.FieldInfo(name)
+	l := defaultLimits[info.Kind]
+
+	if fl, configured := f.limits[name]; configured {
+		if fl.Min != nil {
+			l.Min = fl.Min
+		}
+		if fl.Max != nil {
+			l.Max = fl.Max
+		}
+		l.MaxRate = fl.MaxRate
+		l.Action = fl.Action
+	}
+
+	if l.Action == UnsetAction {
+		l.Action = f.action
+	}
+	return l
+}
+
+// check returns why a reading fails its limit, or "" if it passes. NaN and
+// infinities are always out of range. At least a minute is assumed between
+// readings so that gateways uploading every few seconds are not held to a
+// fraction of the rate.
+func check(l Limit, v float64, prev sample, hasPrev bool, at time.Time) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return ReasonRange
+	}
+	if (l.Min != nil && v < *l.Min) || (l.Max != nil && v > *l.Max) {
+		return ReasonRange
+	}
+	if l.MaxRate > 0 && hasPrev {
+		minutes := math.Max(at.Sub(prev.at).Minutes(), 1)
+		if math.Abs(v-prev.value) > l.MaxRate*minutes {
+			return ReasonRate
+		}
+	}
+	return ""
+}
+
+// Apply checks the readings of an upload from station received at the given
+// time and drops or replaces those that fail. It reports whether the payload
+// was modified. When a failing reading's action is RejectAction, the payload
+// is left alone and an error wrapping ErrRejected is returned.
+//
+// Because the allowed change grows with the time since the last good
+// reading, a genuine jump that exceeds the rate is accepted eventually.
+func (f *Filter) Apply(p *ecowitt.Payload, station string, at time.Time) (bool, error) {
+	type reading struct {
+		name  string
+		value float64
+	}
+	readings := []reading{}
+	p.Each(func(name string, v float64) {
+		readings = append(readings, reading{name, v})
+	})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	last := f.last[station]
+	if last == nil {
+		last = map[string]sample{}
+	}
+
+	good := map[string]sample{}
+	failed := map[string]Action{}
+	rejected := []string{}
+	for _, r := range readings {
+		l := f.limit(r.name)
+		prev, hasPrev := last[r.name]
+		reason := check(l, r.value, prev, hasPrev, at)
+		if reason == "" {
+			good[r.name] = sample{value: r.value, at: at}
+			continue
+		}
+
+		f.filtered[Count{Field: r.name, Reason: reason, Action: l.Action.String()}]++
+		failed[r.name] = l.Action
+		if l.Action == RejectAction {
+			rejected = append(rejected, fmt.Sprintf("%s=%v (%s)", r.name, r.value, reason))
+		}
+	}
+
+	if len(rejected) > 0 {
+		return false, fmt.Errorf("%w: %s", ErrRejected, strings.Join(rejected, ", "))
+	}
+
+	for name, s := range good {
+		last[name] = s
+	}
+	if _, ok := f.last[station]; !ok && f.maxStations > 0 && len(f.last) >= f.maxStations {
+		f.forgetStationLocked()
+	}
+	f.last[station] = last
+	f.seen[station] = at
+
+	for name, action := range failed {
+		if prev, ok := last[name]; ok && action == LastGoodAction {
+			p.Set(name, prev.value)
+			continue
+		}
+		p.Delete(name)
+	}
+	return len(failed) > 0, nil
+}
+
+// forgetStationLocked forgets the last good values of the station that has
+// been silent the longest.
+func (f *Filter) forgetStationLocked() {
+	var oldest string
+	var oldestAt time.Time
+	for station, at := range f.seen {
+		if oldest == "" || at.Before(oldestAt) {
+			oldest, oldestAt = station, at
+		}
+	}
+
+	delete(f.last, oldest)
+	delete(f.seen, oldest)
+}
+
+// Counts returns the number of readings filtered so far.
+func (f *Filter) Counts() map[Count]uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return maps.Clone(f.filtered)
+}
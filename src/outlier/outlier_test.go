@@ -0,0 +1,241 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package outlier
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"testing"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2024, 3, 1, 17, 0, 0, 0, time.UTC)
+
+func TestApply(t *testing.T) {
+	type upload struct {
+		after    time.Duration
+		values   url.Values
+		want     url.Values
+		wantErr  bool
+		modified bool
+	}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		uploads []upload
+	}{
+		{
+			name: "default ranges drop impossible readings",
+			uploads: []upload{
+				{
+					values:   url.Values{"windgustmph": {"201.3"}, "humidity": {"104"}, "tempf": {"45.5"}},
+					want:     url.Values{"tempf": {"45.5"}},
+					modified: true,
+				},
+			},
+		},
+		{
+			name: "default range drops the -40°F of a failing sensor",
+			uploads: []upload{
+				{
+					values:   url.Values{"tempf": {"-40"}, "temp1f": {"-39.9"}, "tempinf": {"-40.0"}},
+					want:     url.Values{"temp1f": {"-39.9"}},
+					modified: true,
+				},
+			},
+		},
+		{
+			name: "configured min lets -40°F through",
+			cfg:  Config{Limits: map[string]Limit{"tempf": {Min: bound(-60)}}},
+			uploads: []upload{
+				{values: url.Values{"tempf": {"-40"}}, want: url.Values{"tempf": {"-40"}}},
+			},
+		},
+		{
+			name: "configured range replaces the default",
+			cfg:  Config{Limits: map[string]Limit{"windgustmph": {Max: bound(100)}}},
+			uploads: []upload{
+				{
+					values:   url.Values{"windgustmph": {"120"}, "windspeedmph": {"120"}},
+					want:     url.Values{"windspeedmph": {"120"}},
+					modified: true,
+				},
+			},
+		},
+		{
+			name: "spikes are replaced by the last good value",
+			cfg: Config{
+				Action: LastGoodAction,
+				Limits: map[string]Limit{"tempf": {MaxRate: 2}},
+			},
+			uploads: []upload{
+				{values: url.Values{"tempf": {"45.5"}}, want: url.Values{"tempf": {"45.5"}}},
+				{
+					after:    time.Minute,
+					values:   url.Values{"tempf": {"-40"}},
+					want:     url.Values{"tempf": {"45.5"}},
+					modified: true,
+				},
+				// The rate is relative to the last good reading.
+				{after: 2 * time.Minute, values: url.Values{"tempf": {"46.3"}}, want: url.Values{"tempf": {"46.3"}}},
+				// After a long gap, larger changes are fine.
+				{after: time.Hour, values: url.Values{"tempf": {"60"}}, want: url.Values{"tempf": {"60"}}},
+			},
+		},
+		{
+			name: "frequent uploads get at least a minute's worth of change",
+			cfg:  Config{Limits: map[string]Limit{"tempf": {MaxRate: 2}}},
+			uploads: []upload{
+				{values: url.Values{"tempf": {"45.5"}}, want: url.Values{"tempf": {"45.5"}}},
+				{after: 16 * time.Second, values: url.Values{"tempf": {"47"}}, want: url.Values{"tempf": {"47"}}},
+			},
+		},
+		{
+			name: "last good without history drops the reading",
+			cfg:  Config{Action: LastGoodAction},
+			uploads: []upload{
+				{values: url.Values{"uv": {"42"}}, want: url.Values{}, modified: true},
+			},
+		},
+		{
+			name: "reject",
+			cfg: Config{
+				Limits: map[string]Limit{"windgustmph": {Action: RejectAction}},
+			},
+			uploads: []upload{
+				{
+					values:  url.Values{"windgustmph": {"200"}, "humidity": {"104"}},
+					wantErr: true,
+				},
+				// Readings of rejected uploads are not remembered.
+				{
+					values:   url.Values{"windgustmph": {"12"}, "humidity": {"104"}},
+					want:     url.Values{"windgustmph": {"12"}},
+					modified: true,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := New(test.cfg)
+			require.NoError(t, err)
+
+			at := start
+			for i, u := range test.uploads {
+				at = at.Add(u.after)
+				p := ecowitt.Parse(u.values)
+
+				modified, err := f.Apply(p, "station", at)
+				if u.wantErr {
+					assert.ErrorIs(t, err, ErrRejected, "upload %d", i)
+					assert.Equal(t, u.values, p.Values(), "upload %d", i)
+					continue
+				}
+				require.NoError(t, err, "upload %d", i)
+				assert.Equal(t, u.modified, modified, "upload %d", i)
+				assert.Equal(t, u.want, p.Values(), "upload %d", i)
+			}
+		})
+	}
+}
+
+func TestStationsAreSeparate(t *testing.T) {
+	f, err := New(Config{Limits: map[string]Limit{"tempf": {MaxRate: 1}}})
+	require.NoError(t, err)
+
+	_, err = f.Apply(ecowitt.Parse(url.Values{"tempf": {"45"}}), "a", start)
+	require.NoError(t, err)
+
+	p := ecowitt.Parse(url.Values{"tempf": {"70"}})
+	modified, err := f.Apply(p, "b", start.Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, modified)
+}
+
+func TestNonFiniteReadings(t *testing.T) {
+	f, err := New(Config{})
+	require.NoError(t, err)
+
+	p := ecowitt.Parse(url.Values{"tempf": {"45.5"}, "soilmoisture1": {"30"}, "lightning_num": {"0"}})
+	p.Set("tempf", math.NaN())
+	p.Set("lightning_num", math.Inf(1))
+
+	modified, err := f.Apply(p, "station", start)
+	require.NoError(t, err)
+	assert.True(t, modified)
+	assert.Equal(t, url.Values{"soilmoisture1": {"30"}}, p.Values())
+}
+
+func TestStationLimit(t *testing.T) {
+	const maxStations = 4
+	f, err := New(Config{Limits: map[string]Limit{"tempf": {MaxRate: 1}}, MaxStations: maxStations})
+	require.NoError(t, err)
+
+	for i := range maxStations + 1 {
+		_, err := f.Apply(ecowitt.Parse(url.Values{"tempf": {"45"}}), fmt.Sprintf("station%d", i), start.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+	}
+	assert.Len(t, f.last, maxStations)
+
+	// The first station was forgotten, so a jump is not a spike anymore.
+	p := ecowitt.Parse(url.Values{"tempf": {"70"}})
+	modified, err := f.Apply(p, "station0", start.Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, modified)
+}
+
+func TestCounts(t *testing.T) {
+	f, err := New(Config{Limits: map[string]Limit{"tempf": {MaxRate: 1, Action: LastGoodAction}}})
+	require.NoError(t, err)
+
+	for _, v := range []string{"45", "60", "200", "45.5"} {
+		_, err := f.Apply(ecowitt.Parse(url.Values{"tempf": {v}, "uv": {"-1"}}), "a", start)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, map[Count]uint64{
+		{Field: "tempf", Reason: ReasonRate, Action: "last_good"}:  1,
+		{Field: "tempf", Reason: ReasonRange, Action: "last_good"}: 1,
+		{Field: "uv", Reason: ReasonRange, Action: "drop"}:         4,
+	}, f.Counts())
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{Action: RejectAction, Limits: map[string]Limit{"temp3f": {MaxRate: 5}}}.Validate())
+
+	assert.EqualError(t, Config{Limits: map[string]Limit{"tempf": {}, "bogus": {}}}.Validate(),
+		"limits of unknown fields: bogus")
+	assert.EqualError(t, Config{Limits: map[string]Limit{"tempf": {Min: bound(10), Max: bound(0)}}}.Validate(),
+		"limit of tempf: min 10 is greater than max 0")
+	assert.EqualError(t, Config{Limits: map[string]Limit{"tempf": {MaxRate: -1}}}.Validate(),
+		"limit of tempf: max rate -1 is negative")
+	assert.EqualError(t, Config{MaxStations: -1}.Validate(), "max stations -1 is negative")
+	assert.Error(t, Config{Action: InvalidAction}.Validate())
+
+	_, err := ActionFromStr("ignore")
+	assert.Error(t, err)
+}
@@ -0,0 +1,472 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package queue implements a durable, on-disk FIFO queue of Ecowitt uploads
+// that could not be delivered to Home Assistant. Every item is written to its
+// own file before Push returns, so queued uploads survive proxy restarts.
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	itemExt = ".json"
+	tmpExt  = ".tmp"
+
+	DefaultMaxSize = 10000
+	DefaultMaxAge  = 24 * time.Hour
+)
+
+var (
+	// ErrFull is returned by Push when the queue is at capacity and the
+	// eviction policy is DropNewest.
+	ErrFull = errors.New("queue is full")
+
+	// ErrClosed is returned when operating on a closed queue.
+	ErrClosed = errors.New("queue is closed")
+)
+
+type EvictionPolicy uint8
+
+const (
+	// DropOldest discards the oldest queued item to make room for a new one.
+	DropOldest EvictionPolicy = iota
+	// DropNewest rejects new items while the queue is full.
+	DropNewest
+	InvalidEvictionPolicy
+)
+
+var evictionPolicyNames = map[EvictionPolicy]string{
+	DropOldest: "drop_oldest",
+	DropNewest: "drop_newest",
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+func EvictionPolicyNames() []string {
+	return []string{DropOldest.String(), DropNewest.String()}
+}
+
+func EvictionPolicyFromStr(name string) (EvictionPolicy, error) {
+	switch strings.ToLower(name) {
+	case "drop_oldest":
+		return DropOldest, nil
+	case "drop_newest":
+		return DropNewest, nil
+	default:
+		return InvalidEvictionPolicy, fmt.Errorf("invalid eviction policy %q", name)
+	}
+}
+
+// Item is a single queued upload destined for one delivery target.
+type Item struct {
+	ID         uint64     `json:"id"`
+	Target     string     `json:"target,omitempty"`
+	ReceivedAt time.Time  `json:"received_at"`
+	Values     url.Values `json:"values"`
+}
+
+type entry struct {
+	id         uint64
+	target     string
+	receivedAt time.Time
+}
+
+type Queue struct {
+	dir      string
+	maxSize  int
+	maxAge   time.Duration
+	eviction EvictionPolicy
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries []entry
+	nextID  uint64
+	evicted uint64
+	closed  bool
+}
+
+type Option func(*Queue)
+
+// WithMaxSize sets the maximum number of items held by the queue. A value of
+// zero or less means unbounded.
+func WithMaxSize(size int) Option {
+	return func(q *Queue) {
+		q.maxSize = size
+	}
+}
+
+// WithMaxAge sets how long an item may wait in the queue before it is
+// discarded. A value of zero or less disables age based expiry.
+func WithMaxAge(age time.Duration) Option {
+	return func(q *Queue) {
+		q.maxAge = age
+	}
+}
+
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(q *Queue) {
+		q.eviction = policy
+	}
+}
+
+func WithClock(now func() time.Time) Option {
+	return func(q *Queue) {
+		q.now = now
+	}
+}
+
+// Open opens the queue stored in dir, creating the directory if needed, and
+// loads any items left behind by a previous run.
+func Open(dir string, opts ...Option) (*Queue, error) {
+	q := &Queue{
+		dir:      dir,
+		maxSize:  DefaultMaxSize,
+		maxAge:   DefaultMaxAge,
+		eviction: DropOldest,
+		now:      time.Now,
+		nextID:   1,
+	}
+
+	for _, opt := range opts {
+		opt(q)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating queue directory %q: %w", dir, err)
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *Queue) load() error {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("error reading queue directory %q: %w", q.dir, err)
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() {
+			continue
+		}
+
+		// Leftovers from a write that was interrupted before it was committed.
+		if strings.HasSuffix(name, tmpExt) {
+			os.Remove(filepath.Join(q.dir, name))
+			continue
+		}
+
+		if !strings.HasSuffix(name, itemExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, itemExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		item, err := q.readItem(id)
+		if err != nil {
+			// A corrupt item can never be delivered, so move it out of the way
+			// rather than refusing to start.
+			os.Rename(q.path(id), q.path(id)+".corrupt")
+			continue
+		}
+
+		q.entries = append(q.entries, entry{id: item.ID, target: item.Target, receivedAt: item.ReceivedAt})
+		if id >= q.nextID {
+			q.nextID = id + 1
+		}
+	}
+
+	slices.SortFunc(q.entries, func(a, b entry) int {
+		switch {
+		case a.id < b.id:
+			return -1
+		case a.id > b.id:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return nil
+}
+
+func (q *Queue) path(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, itemExt))
+}
+
+func (q *Queue) readItem(id uint64) (Item, error) {
+	var item Item
+
+	data, err := os.ReadFile(q.path(id))
+	if err != nil {
+		return item, fmt.Errorf("error reading queue item %d: %w", id, err)
+	}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return item, fmt.Errorf("error decoding queue item %d: %w", id, err)
+	}
+	item.ID = id
+
+	return item, nil
+}
+
+func (q *Queue) writeItem(item Item) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("error encoding queue item %d: %w", item.ID, err)
+	}
+
+	tmp := q.path(item.ID) + tmpExt
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("error creating queue item %d: %w", item.ID, err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("error writing queue item %d: %w", item.ID, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("error syncing queue item %d: %w", item.ID, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error closing queue item %d: %w", item.ID, err)
+	}
+
+	if err := os.Rename(tmp, q.path(item.ID)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error committing queue item %d: %w", item.ID, err)
+	}
+
+	// Persist the rename itself. Not every platform supports syncing a
+	// directory, so failures here are not fatal.
+	if d, err := os.Open(q.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// Push durably appends an upload for the named target to the tail of the
+// queue.
+func (q *Queue) Push(receivedAt time.Time, target string, values url.Values) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	q.expireLocked()
+
+	if q.maxSize > 0 && len(q.entries) >= q.maxSize {
+		if q.eviction == DropNewest {
+			q.evicted++
+			return ErrFull
+		}
+		for len(q.entries) >= q.maxSize {
+			q.discardLocked(0)
+		}
+	}
+
+	item := Item{ID: q.nextID, Target: target, ReceivedAt: receivedAt, Values: values}
+	if err := q.writeItem(item); err != nil {
+		return err
+	}
+
+	q.nextID++
+	q.entries = append(q.entries, entry{id: item.ID, target: target, receivedAt: item.ReceivedAt})
+	return nil
+}
+
+// Peek returns the oldest item in the queue without removing it. The boolean
+// result is false when the queue is empty.
+func (q *Queue) Peek() (Item, bool, error) {
+	return q.peek(func(entry) bool { return true })
+}
+
+// PeekTarget returns the oldest item queued for the named target without
+// removing it.
+func (q *Queue) PeekTarget(target string) (Item, bool, error) {
+	return q.peek(func(e entry) bool { return e.target == target })
+}
+
+func (q *Queue) peek(match func(entry) bool) (Item, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return Item{}, false, ErrClosed
+	}
+
+	q.expireLocked()
+
+	for i := 0; i < len(q.entries); {
+		if !match(q.entries[i]) {
+			i++
+			continue
+		}
+
+		id := q.entries[i].id
+		item, err := q.readItem(id)
+		if err == nil {
+			return item, true, nil
+		}
+
+		// The item vanished or was damaged on disk. Drop it and move on so a
+		// single bad file cannot wedge the queue.
+		os.Rename(q.path(id), q.path(id)+".corrupt")
+		q.entries = slices.Delete(q.entries, i, i+1)
+		q.evicted++
+	}
+
+	return Item{}, false, nil
+}
+
+// Remove deletes the item with the given id, typically after it has been
+// delivered successfully.
+func (q *Queue) Remove(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	return q.removeLocked(id)
+}
+
+func (q *Queue) removeLocked(id uint64) error {
+	idx := slices.IndexFunc(q.entries, func(e entry) bool { return e.id == id })
+	if idx < 0 {
+		return nil
+	}
+
+	if err := os.Remove(q.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing queue item %d: %w", id, err)
+	}
+
+	q.entries = slices.Delete(q.entries, idx, idx+1)
+	return nil
+}
+
+// discardLocked evicts the entry at index i. The entry is dropped from memory
+// even when its file cannot be removed, so that an unwritable queue directory
+// cannot stall the queue; such a file is loaded again on the next start.
+func (q *Queue) discardLocked(i int) {
+	os.Remove(q.path(q.entries[i].id))
+	q.entries = slices.Delete(q.entries, i, i+1)
+	q.evicted++
+}
+
+// expireLocked evicts every entry older than the maximum age. Entries are
+// ordered by id, not by the time the proxy received them: concurrent
+// deliveries can push an older upload after a newer one, and the host clock
+// can step backwards, so every entry is checked.
+func (q *Queue) expireLocked() {
+	if q.maxAge <= 0 {
+		return
+	}
+
+	cutoff := q.now().Add(-q.maxAge)
+	for i := 0; i < len(q.entries); {
+		if q.entries[i].receivedAt.Before(cutoff) {
+			q.discardLocked(i)
+			continue
+		}
+		i++
+	}
+}
+
+// Len returns the number of items waiting in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.entries)
+}
+
+// LenTarget returns the number of items waiting for the named target.
+func (q *Queue) LenTarget(target string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, e := range q.entries {
+		if e.target == target {
+			n++
+		}
+	}
+	return n
+}
+
+// Targets returns the distinct targets that have items waiting, in the order
+// of their oldest item.
+func (q *Queue) Targets() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var targets []string
+	for _, e := range q.entries {
+		if !slices.Contains(targets, e.target) {
+			targets = append(targets, e.target)
+		}
+	}
+	return targets
+}
+
+// Evicted returns the number of items discarded because the queue was full,
+// the items were too old, or they could not be read back from disk.
+func (q *Queue) Evicted() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.evicted
+}
+
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	return nil
+}
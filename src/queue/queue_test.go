@@ -0,0 +1,237 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package queue
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func values(v string) url.Values {
+	return url.Values{"PASSKEY": {"ABCD"}, "tempf": {v}}
+}
+
+func TestPushPeekRemove(t *testing.T) {
+	q, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer q.Close()
+
+	now := time.Now()
+	require.NoError(t, q.Push(now, "", values("70.1")))
+	require.NoError(t, q.Push(now, "", values("70.2")))
+	assert.Equal(t, 2, q.Len())
+
+	item, ok, err := q.Peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, values("70.1"), item.Values)
+
+	require.NoError(t, q.Remove(item.ID))
+
+	item, ok, err = q.Peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, values("70.2"), item.Values)
+
+	require.NoError(t, q.Remove(item.ID))
+
+	_, ok, err = q.Peek()
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestTargets(t *testing.T) {
+	q, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer q.Close()
+
+	now := time.Now()
+	require.NoError(t, q.Push(now, "staging", values("70.1")))
+	require.NoError(t, q.Push(now, "production", values("70.2")))
+	require.NoError(t, q.Push(now, "staging", values("70.3")))
+
+	assert.Equal(t, []string{"staging", "production"}, q.Targets())
+	assert.Equal(t, 2, q.LenTarget("staging"))
+	assert.Equal(t, 1, q.LenTarget("production"))
+
+	item, ok, err := q.PeekTarget("production")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "production", item.Target)
+	assert.Equal(t, "70.2", item.Values.Get("tempf"))
+
+	require.NoError(t, q.Remove(item.ID))
+	_, ok, err = q.PeekTarget("production")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, []string{"staging"}, q.Targets())
+}
+
+func TestReopenPreservesItems(t *testing.T) {
+	dir := t.TempDir()
+	receivedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return receivedAt }
+
+	q, err := Open(dir, WithClock(clock))
+	require.NoError(t, err)
+	require.NoError(t, q.Push(receivedAt, "", values("70.1")))
+	require.NoError(t, q.Push(receivedAt, "", values("70.2")))
+	require.NoError(t, q.Close())
+
+	// Simulate a crash part way through a write.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000003.json.tmp"), []byte("{"), 0o600))
+
+	q, err = Open(dir, WithClock(clock))
+	require.NoError(t, err)
+	defer q.Close()
+
+	assert.Equal(t, 2, q.Len())
+
+	item, ok, err := q.Peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, values("70.1"), item.Values)
+	assert.True(t, receivedAt.Equal(item.ReceivedAt))
+
+	// New items must not reuse ids from the previous run.
+	require.NoError(t, q.Push(receivedAt, "", values("70.3")))
+	assert.Equal(t, 3, q.Len())
+
+	_, err = os.Stat(filepath.Join(dir, "00000000000000000003.json.tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCorruptItemIsSkipped(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000001.json"), []byte("not json"), 0o600))
+
+	q, err := Open(dir)
+	require.NoError(t, err)
+	defer q.Close()
+
+	assert.Equal(t, 0, q.Len())
+	_, err = os.Stat(filepath.Join(dir, "00000000000000000001.json.corrupt"))
+	assert.NoError(t, err)
+}
+
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      EvictionPolicy
+		wantErr     error
+		wantFirst   string
+		wantEvicted uint64
+	}{
+		{
+			name:        "drop oldest",
+			policy:      DropOldest,
+			wantFirst:   "70.2",
+			wantEvicted: 1,
+		},
+		{
+			name:        "drop newest",
+			policy:      DropNewest,
+			wantErr:     ErrFull,
+			wantFirst:   "70.1",
+			wantEvicted: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := Open(t.TempDir(), WithMaxSize(2), WithEvictionPolicy(test.policy))
+			require.NoError(t, err)
+			defer q.Close()
+
+			now := time.Now()
+			require.NoError(t, q.Push(now, "", values("70.1")))
+			require.NoError(t, q.Push(now, "", values("70.2")))
+			assert.ErrorIs(t, q.Push(now, "", values("70.3")), test.wantErr)
+
+			assert.Equal(t, 2, q.Len())
+			assert.Equal(t, test.wantEvicted, q.Evicted())
+
+			item, ok, err := q.Peek()
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, test.wantFirst, item.Values.Get("tempf"))
+		})
+	}
+}
+
+func TestEvictionWhenRemoveFails(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, WithMaxSize(2))
+	require.NoError(t, err)
+	defer q.Close()
+
+	now := time.Now()
+	require.NoError(t, q.Push(now, "", values("70.1")))
+	require.NoError(t, q.Push(now, "", values("70.2")))
+
+	// A non-empty directory in place of the oldest item cannot be removed.
+	oldest := filepath.Join(dir, "00000000000000000001.json")
+	require.NoError(t, os.Remove(oldest))
+	require.NoError(t, os.MkdirAll(filepath.Join(oldest, "busy"), 0o700))
+
+	done := make(chan error, 1)
+	go func() { done <- q.Push(now, "", values("70.3")) }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Push did not return")
+	}
+
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, uint64(1), q.Evicted())
+}
+
+func TestMaxAge(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	q, err := Open(t.TempDir(), WithMaxAge(time.Hour), WithClock(func() time.Time { return now }))
+	require.NoError(t, err)
+	defer q.Close()
+
+	require.NoError(t, q.Push(now.Add(-2*time.Hour), "", values("70.1")))
+	require.NoError(t, q.Push(now.Add(-30*time.Minute), "", values("70.2")))
+	// Received before the item ahead of it, e.g. after a clock correction.
+	require.NoError(t, q.Push(now.Add(-3*time.Hour), "", values("70.3")))
+
+	item, ok, err := q.Peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "70.2", item.Values.Get("tempf"))
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, uint64(2), q.Evicted())
+}
+
+func TestEvictionPolicyFromStr(t *testing.T) {
+	p, err := EvictionPolicyFromStr("DROP_NEWEST")
+	assert.NoError(t, err)
+	assert.Equal(t, DropNewest, p)
+
+	_, err = EvictionPolicyFromStr("bogus")
+	assert.Error(t, err)
+}
@@ -0,0 +1,319 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package redact keeps secrets out of logs, the status page and responses.
+//
+// Tokens, such as Home Assistant auth tokens, webhook IDs and station
+// passwords, are masked to their last four characters. Gateway PASSKEYs are
+// replaced by a keyed hash, the same one used for station IDs in metrics and
+// MQTT topics, so that stations remain distinguishable. The proxy sets a
+// persisted key with SetKey at startup; until then a random key is used.
+//
+// A Redactor additionally replaces every secret registered with it wherever
+// it appears in text, e.g. inside error messages that quote a webhook URL.
+// Only configured secrets are registered; secrets that arrive with uploads
+// are redacted with Values where they are logged.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// mask replaces the hidden part of a token.
+const mask = "****"
+
+// minVisibleLen is the shortest token whose last four characters are shown.
+// Shorter tokens are masked completely.
+const minVisibleLen = 12
+
+// minSecretLen is the shortest secret a Redactor replaces. Shorter ones would
+// match ordinary words and numbers in unrelated text.
+const minSecretLen = 8
+
+// Token masks all but the last four characters of a token.
+func Token(token string) string {
+	if token == "" {
+		return ""
+	}
+	if len(token) < minVisibleLen {
+		return mask
+	}
+	return mask + token[len(token)-4:]
+}
+
+// keySize is the size of generated keys in bytes.
+const keySize = 32
+
+// MinKeyLen is the shortest key accepted by SetKey. PASSKEYs can have little
+// entropy, e.g. Ambient Weather stations use their MAC address, so a short
+// key would let the PASSKEY be guessed from its hash.
+const MinKeyLen = 16
+
+var passkeyKey atomic.Pointer[[]byte]
+
+func init() {
+	key := make([]byte, keySize)
+	rand.Read(key)
+	passkeyKey.Store(&key)
+}
+
+// SetKey sets the per-install secret that keys the PASSKEY hash. It should be
+// called once at startup, before any station IDs are handed out.
+func SetKey(key []byte) error {
+	if len(key) < MinKeyLen {
+		return fmt.Errorf("key must be at least %d bytes long", MinKeyLen)
+	}
+	key = slices.Clone(key)
+	passkeyKey.Store(&key)
+	return nil
+}
+
+// LoadKey reads a key from path, creating the file with a new random key if it
+// does not exist yet.
+func LoadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key := make([]byte, keySize)
+		rand.Read(key)
+		data = []byte(hex.EncodeToString(key) + "\n")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return nil, fmt.Errorf("error creating key file %q: %w", path, err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading key file %q: %w", path, err)
+	}
+
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) < MinKeyLen {
+		return nil, fmt.Errorf("key in %q must be at least %d bytes long", path, MinKeyLen)
+	}
+	return key, nil
+}
+
+// Passkey returns the hash that identifies a station in place of its
+// PASSKEY. PASSKEYs are compared case-insensitively. The hash is keyed, see
+// SetKey, so that PASSKEYs with little entropy cannot be guessed from it by
+// anyone without the key.
+func Passkey(passkey string) string {
+	if passkey == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, *passkeyKey.Load())
+	mac.Write([]byte(strings.ToUpper(passkey)))
+	return hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// Upload fields that carry secrets. They are compared case-insensitively.
+// The field names are those of ecowitt, wunderground and ambient; redact
+// works on raw form data and does not depend on those packages.
+var (
+	passkeyFields = []string{"passkey", "mac"}
+	tokenFields   = []string{"password", "apikey", "applicationkey", "token"}
+)
+
+// Values returns a copy of upload form data with the secret fields redacted.
+func Values(values url.Values) url.Values {
+	out := make(url.Values, len(values))
+	for name, vals := range values {
+		redactFn := func(v string) string { return v }
+		switch lower := strings.ToLower(name); {
+		case slices.Contains(passkeyFields, lower):
+			redactFn = Passkey
+		case slices.Contains(tokenFields, lower):
+			redactFn = Token
+		}
+
+		redacted := make([]string, len(vals))
+		for i, v := range vals {
+			redacted[i] = redactFn(v)
+		}
+		out[name] = redacted
+	}
+	return out
+}
+
+// URL returns u with the secret fields of its query redacted.
+func URL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	redacted := *u
+	redacted.User = nil
+	if u.RawQuery != "" {
+		redacted.RawQuery = Values(u.Query()).Encode()
+	}
+	return redacted.String()
+}
+
+// Redactor replaces registered secrets in text. It is safe for concurrent
+// use. The zero value is not usable; use New.
+type Redactor struct {
+	mu       sync.RWMutex
+	secrets  map[string]string
+	replacer *strings.Replacer
+}
+
+func New() *Redactor {
+	return &Redactor{
+		secrets:  map[string]string{},
+		replacer: strings.NewReplacer(),
+	}
+}
+
+// AddToken registers tokens that are masked by Token wherever they appear.
+// Tokens shorter than eight characters are ignored.
+func (r *Redactor) AddToken(tokens ...string) {
+	for _, t := range tokens {
+		r.add(t, Token(t))
+	}
+}
+
+// AddPasskey registers a PASSKEY that is replaced by its hash wherever it
+// appears. Both the original and the upper case form are replaced. PASSKEYs
+// shorter than eight characters are ignored.
+func (r *Redactor) AddPasskey(passkey string) {
+	r.add(passkey, Passkey(passkey))
+	r.add(strings.ToUpper(passkey), Passkey(passkey))
+}
+
+func (r *Redactor) add(secret, replacement string) {
+	if len(secret) < minSecretLen {
+		return
+	}
+
+	r.mu.RLock()
+	_, known := r.secrets[secret]
+	r.mu.RUnlock()
+	if known {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets[secret] = replacement
+
+	// Longer secrets first, so that a secret that contains another one is
+	// replaced as a whole.
+	secrets := make([]string, 0, len(r.secrets))
+	for s := range r.secrets {
+		secrets = append(secrets, s)
+	}
+	slices.SortFunc(secrets, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return strings.Compare(a, b)
+	})
+
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, s := range secrets {
+		pairs = append(pairs, s, r.secrets[s])
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// String replaces every registered secret in s.
+func (r *Redactor) String(s string) string {
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+	return replacer.Replace(s)
+}
+
+// Writer returns a writer that redacts everything written to w. Each write
+// is redacted on its own, so it suits loggers that write whole lines.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &writer{r: r, w: w}
+}
+
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Core wraps a zap core so that messages and string, error and stringer
+// fields are redacted. It can be passed to zap.WrapCore. Wrapping a core
+// that already uses r returns it unchanged.
+func (r *Redactor) Core(c zapcore.Core) zapcore.Core {
+	if rc, ok := c.(*core); ok && rc.r == r {
+		return c
+	}
+	return &core{Core: c, r: r}
+}
+
+type core struct {
+	zapcore.Core
+	r *Redactor
+}
+
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	return &core{Core: c.Core.With(c.fields(fields)), r: c.r}
+}
+
+func (c *core) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *core) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = c.r.String(ent.Message)
+	return c.Core.Write(ent, c.fields(fields))
+}
+
+func (c *core) fields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch f.Type {
+		case zapcore.StringType:
+			f.String = c.r.String(f.String)
+		case zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok {
+				f = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: c.r.String(err.Error())}
+			}
+		case zapcore.StringerType:
+			if s, ok := f.Interface.(interface{ String() string }); ok {
+				f = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: c.r.String(s.String())}
+			}
+		}
+		out[i] = f
+	}
+	return out
+}
@@ -0,0 +1,299 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package rewrite applies declarative rules to the form data of an upload,
+// e.g. to strip fields the Home Assistant Ecowitt integration does not
+// understand, rename the fields of third-party stations or add constant
+// fields.
+//
+// Rules are applied in order and each rule sees the result of the previous
+// ones. A rule selects fields by exact name or by regular expression and may
+// be limited to stations with given PASSKEYs.
+package rewrite
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Action is what a rule does with the fields it selects.
+type Action uint8
+
+const (
+	// DropAction removes the fields.
+	DropAction Action = iota
+	// RenameAction moves the fields to the name in To.
+	RenameAction
+	// CopyAction copies the fields to the name in To.
+	CopyAction
+	// SetAction sets the field named in Field to Value.
+	SetAction
+	InvalidAction
+)
+
+var actionNames = map[Action]string{
+	DropAction:   "drop",
+	RenameAction: "rename",
+	CopyAction:   "copy",
+	SetAction:    "set",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+func ActionNames() []string {
+	return []string{DropAction.String(), RenameAction.String(), CopyAction.String(), SetAction.String()}
+}
+
+func ActionFromStr(name string) (Action, error) {
+	switch strings.ToLower(name) {
+	case "drop":
+		return DropAction, nil
+	case "rename":
+		return RenameAction, nil
+	case "copy":
+		return CopyAction, nil
+	case "set":
+		return SetAction, nil
+	default:
+		return InvalidAction, fmt.Errorf("invalid rewrite action %q", name)
+	}
+}
+
+// fieldPasskey is the field Rule.Passkeys is compared with. It is the same as
+// ecowitt.FieldPasskey; rewrite works on raw form data and does not need the
+// parser.
+const fieldPasskey = "PASSKEY"
+
+// Rule is a single rewrite rule.
+type Rule struct {
+	// Name identifies the rule in the dry-run output. Defaults to its
+	// position, e.g. "rule 1".
+	Name string
+	// Field selects the field with this exact name.
+	Field string
+	// Match selects every field whose name matches this regular expression.
+	// It is not anchored; use ^ and $ to match whole names.
+	Match  string
+	Action Action
+	// To is the new name for rename and copy. With Match, $1 etc. refer to
+	// the submatches of the expression.
+	To string
+	// Value is the value for set. It is a text/template executed with the
+	// fields of the upload, e.g. "{{.stationtype}}-proxy". The functions
+	// lower, upper, trim, replace and split from the strings package are
+	// available.
+	Value string
+	// Passkeys limits the rule to uploads from these stations. Empty means
+	// all stations.
+	Passkeys []string
+}
+
+var templateFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": strings.ReplaceAll,
+	"split":   strings.Split,
+}
+
+// rule is a compiled Rule.
+type rule struct {
+	Rule
+
+	re    *regexp.Regexp
+	value *template.Template
+}
+
+func compile(i int, r Rule) (rule, error) {
+	c := rule{Rule: r}
+	if c.Name == "" {
+		c.Name = fmt.Sprintf("rule %d", i+1)
+	}
+
+	missing := []string{}
+	switch {
+	case r.Action >= InvalidAction:
+		return rule{}, fmt.Errorf("%s: invalid action %d", c.Name, r.Action)
+	case r.Action == SetAction:
+		if r.Field == "" {
+			missing = append(missing, "field")
+		}
+		if r.Match != "" {
+			return rule{}, fmt.Errorf("%s: set needs a field, not a match", c.Name)
+		}
+	default:
+		if r.Field == "" && r.Match == "" {
+			missing = append(missing, "field or match")
+		}
+		if r.Field != "" && r.Match != "" {
+			return rule{}, fmt.Errorf("%s: field and match are mutually exclusive", c.Name)
+		}
+		if (r.Action == RenameAction || r.Action == CopyAction) && r.To == "" {
+			missing = append(missing, "to")
+		}
+	}
+	if len(missing) > 0 {
+		return rule{}, fmt.Errorf("%s is missing: %s", c.Name, strings.Join(missing, ", "))
+	}
+
+	if r.Match != "" {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return rule{}, fmt.Errorf("%s: %w", c.Name, err)
+		}
+		c.re = re
+	}
+	if r.Action == SetAction {
+		tmpl, err := template.New(c.Name).Funcs(templateFuncs).Option("missingkey=zero").Parse(r.Value)
+		if err != nil {
+			return rule{}, fmt.Errorf("%s: %w", c.Name, err)
+		}
+		c.value = tmpl
+	}
+	return c, nil
+}
+
+// appliesTo reports whether the rule's station condition holds.
+func (r *rule) appliesTo(values url.Values) bool {
+	if len(r.Passkeys) == 0 {
+		return true
+	}
+	passkey := values.Get(fieldPasskey)
+	return slices.ContainsFunc(r.Passkeys, func(p string) bool {
+		return strings.EqualFold(p, passkey)
+	})
+}
+
+// targets returns the fields the rule selects with their new names, in name
+// order. The new name is empty for drop.
+func (r *rule) targets(values url.Values) [][2]string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	targets := [][2]string{}
+	for _, name := range names {
+		switch {
+		case r.re != nil:
+			m := r.re.FindStringSubmatchIndex(name)
+			if m == nil {
+				continue
+			}
+			to := ""
+			if r.To != "" {
+				to = string(r.re.ExpandString(nil, r.To, name, m))
+			}
+			targets = append(targets, [2]string{name, to})
+		case name == r.Field:
+			targets = append(targets, [2]string{name, r.To})
+		}
+	}
+	return targets
+}
+
+// apply rewrites values in place and reports whether the rule changed them.
+func (r *rule) apply(values url.Values) (bool, error) {
+	if r.Action == SetAction {
+		data := make(map[string]string, len(values))
+		for name := range values {
+			data[name] = values.Get(name)
+		}
+
+		var b strings.Builder
+		if err := r.value.Execute(&b, data); err != nil {
+			return false, fmt.Errorf("%s: %w", r.Name, err)
+		}
+		if old, ok := values[r.Field]; ok && len(old) == 1 && old[0] == b.String() {
+			return false, nil
+		}
+		values.Set(r.Field, b.String())
+		return true, nil
+	}
+
+	targets := r.targets(values)
+	for _, t := range targets {
+		from, to := t[0], t[1]
+		vals := values[from]
+		if r.Action != CopyAction {
+			values.Del(from)
+		}
+		if r.Action != DropAction {
+			values[to] = append([]string(nil), vals...)
+		}
+	}
+	return len(targets) > 0, nil
+}
+
+// Rewriter applies a list of rules. A nil Rewriter leaves uploads unchanged.
+type Rewriter struct {
+	rules []rule
+}
+
+// New compiles rules into a Rewriter.
+func New(rules []Rule) (*Rewriter, error) {
+	rw := &Rewriter{}
+	for i, r := range rules {
+		c, err := compile(i, r)
+		if err != nil {
+			return nil, err
+		}
+		rw.rules = append(rw.rules, c)
+	}
+	return rw, nil
+}
+
+// Apply returns a rewritten copy of values and the names of the rules that
+// changed it. Rules that fail, e.g. because their template cannot be
+// executed, are skipped and reported in the returned error.
+func (rw *Rewriter) Apply(values url.Values) (url.Values, []string, error) {
+	if rw == nil || len(rw.rules) == 0 {
+		return values, nil, nil
+	}
+
+	out := make(url.Values, len(values))
+	for name, vals := range values {
+		out[name] = append([]string(nil), vals...)
+	}
+
+	applied := []string{}
+	errs := []error{}
+	for i := range rw.rules {
+		r := &rw.rules[i]
+		if !r.appliesTo(out) {
+			continue
+		}
+		changed, err := r.apply(out)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if changed {
+			applied = append(applied, r.Name)
+		}
+	}
+	return out, applied, errors.Join(errs...)
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package rewrite
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	upload := url.Values{
+		"PASSKEY":         {"AAAA"},
+		"stationtype":     {"GW2000A_V3.1.1"},
+		"tempf":           {"45.5"},
+		"leafwetness_ch1": {"12"},
+		"leafwetness_ch2": {"13"},
+		"outtemp":         {"45.5"},
+	}
+
+	tests := []struct {
+		name        string
+		rules       []Rule
+		want        url.Values
+		wantApplied []string
+	}{
+		{
+			name:  "drop by name",
+			rules: []Rule{{Field: "outtemp", Action: DropAction}},
+			want: url.Values{
+				"PASSKEY": {"AAAA"}, "stationtype": {"GW2000A_V3.1.1"}, "tempf": {"45.5"},
+				"leafwetness_ch1": {"12"}, "leafwetness_ch2": {"13"},
+			},
+			wantApplied: []string{"rule 1"},
+		},
+		{
+			name:  "drop by regex",
+			rules: []Rule{{Name: "no leaf wetness", Match: "^leafwetness_ch\\d+$", Action: DropAction}},
+			want: url.Values{
+				"PASSKEY": {"AAAA"}, "stationtype": {"GW2000A_V3.1.1"}, "tempf": {"45.5"}, "outtemp": {"45.5"},
+			},
+			wantApplied: []string{"no leaf wetness"},
+		},
+		{
+			name: "rename with submatches",
+			rules: []Rule{
+				{Match: "^leafwetness_ch(\\d+)$", Action: RenameAction, To: "leaf_wetness${1}"},
+				{Field: "outtemp", Action: DropAction},
+			},
+			want: url.Values{
+				"PASSKEY": {"AAAA"}, "stationtype": {"GW2000A_V3.1.1"}, "tempf": {"45.5"},
+				"leaf_wetness1": {"12"}, "leaf_wetness2": {"13"},
+			},
+			wantApplied: []string{"rule 1", "rule 2"},
+		},
+		{
+			name: "copy and set",
+			rules: []Rule{
+				{Field: "tempf", Action: CopyAction, To: "temp1f"},
+				{Field: "freq", Action: SetAction, Value: "868M"},
+				{Field: "model", Action: SetAction, Value: `{{ index (split .stationtype "_") 0 }}`},
+			},
+			want: url.Values{
+				"PASSKEY": {"AAAA"}, "stationtype": {"GW2000A_V3.1.1"}, "tempf": {"45.5"}, "temp1f": {"45.5"},
+				"leafwetness_ch1": {"12"}, "leafwetness_ch2": {"13"}, "outtemp": {"45.5"},
+				"freq": {"868M"}, "model": {"GW2000A"},
+			},
+			wantApplied: []string{"rule 1", "rule 2", "rule 3"},
+		},
+		{
+			name: "station conditions",
+			rules: []Rule{
+				{Field: "outtemp", Action: DropAction, Passkeys: []string{"BBBB"}},
+				{Field: "tempf", Action: DropAction, Passkeys: []string{"bbbb", "aaaa"}},
+			},
+			want: url.Values{
+				"PASSKEY": {"AAAA"}, "stationtype": {"GW2000A_V3.1.1"}, "outtemp": {"45.5"},
+				"leafwetness_ch1": {"12"}, "leafwetness_ch2": {"13"},
+			},
+			wantApplied: []string{"rule 2"},
+		},
+		{
+			name:        "no match",
+			rules:       []Rule{{Field: "humidity", Action: DropAction}},
+			want:        upload,
+			wantApplied: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rw, err := New(test.rules)
+			require.NoError(t, err)
+
+			got, applied, err := rw.Apply(upload)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+			assert.Equal(t, test.wantApplied, applied)
+		})
+	}
+
+	// The input is never modified.
+	assert.Equal(t, []string{"45.5"}, upload["outtemp"])
+}
+
+func TestNilRewriter(t *testing.T) {
+	var rw *Rewriter
+	values := url.Values{"tempf": {"45.5"}}
+	got, applied, err := rw.Apply(values)
+	assert.NoError(t, err)
+	assert.Equal(t, values, got)
+	assert.Empty(t, applied)
+}
+
+func TestTemplateError(t *testing.T) {
+	rw, err := New([]Rule{
+		{Field: "model", Action: SetAction, Value: `{{ index .missing 3 }}`},
+		{Field: "tempf", Action: DropAction},
+	})
+	require.NoError(t, err)
+
+	got, applied, err := rw.Apply(url.Values{"tempf": {"45.5"}})
+	assert.ErrorContains(t, err, "rule 1")
+	assert.Equal(t, url.Values{}, got)
+	assert.Equal(t, []string{"rule 2"}, applied)
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr string
+	}{
+		{name: "drop", rule: Rule{Field: "tempf"}},
+		{name: "no field", rule: Rule{Action: DropAction}, wantErr: "rule 1 is missing: field or match"},
+		{name: "both", rule: Rule{Field: "a", Match: "b"}, wantErr: "rule 1: field and match are mutually exclusive"},
+		{name: "rename", rule: Rule{Name: "r", Match: "a", Action: RenameAction}, wantErr: "r is missing: to"},
+		{name: "set by match", rule: Rule{Match: "a", Action: SetAction}, wantErr: "rule 1: set needs a field, not a match"},
+		{name: "bad regex", rule: Rule{Match: "(", Action: DropAction}, wantErr: "rule 1: error parsing regexp"},
+		{name: "bad template", rule: Rule{Field: "a", Action: SetAction, Value: "{{"}, wantErr: "rule 1: template"},
+		{name: "bad action", rule: Rule{Field: "a", Action: InvalidAction}, wantErr: "rule 1: invalid action"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := New([]Rule{test.rule})
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server describes the certificate a TLS listener serves and, optionally,
+// the certificate authorities client certificates must be signed by.
+type Server struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM bundle of certificate authorities. When set,
+	// clients must present a certificate signed by one of them.
+	ClientCAFile string
+}
+
+func (s Server) Validate() error {
+	missing := []string{}
+	if s.CertFile == "" {
+		missing = append(missing, "cert_file")
+	}
+	if s.KeyFile == "" {
+		missing = append(missing, "key_file")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("TLS listener is missing: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Config builds a *tls.Config from the settings. The certificate is reloaded
+// when the certificate or key file changes, so renewed certificates are
+// picked up without a restart. onReloadError, if not nil, is called when a
+// changed certificate cannot be loaded; the previous one stays in use.
+func (s Server) Config(onReloadError func(error)) (*tls.Config, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	reloader, err := NewCertReloader(s.CertFile, s.KeyFile, onReloadError)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if s.ClientCAFile != "" {
+		pool := x509.NewCertPool()
+		if err := appendCertsFromFile(pool, s.ClientCAFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// CertReloader serves a certificate from a pair of files and reloads it when
+// either file's modification time changes.
+type CertReloader struct {
+	certFile      string
+	keyFile       string
+	onReloadError func(error)
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	// failed is set while the files are in the state recorded in failedAt,
+	// their modification times at the last failed reload. A file that could
+	// not be read is recorded with the zero time.
+	failed   bool
+	failedAt [2]time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string, onReloadError func(error)) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, onReloadError: onReloadError}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if _, err := r.reload(); err != nil && r.onReloadError != nil {
+		r.onReloadError(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// reload loads the certificate if the files changed since the last
+// successful load. A failed load, including a certificate or key file that
+// cannot be read, is reported once per change of the files.
+func (r *CertReloader) reload() (bool, error) {
+	certMod, certErr := modTime(r.certFile)
+	keyMod, keyErr := modTime(r.keyFile)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if certErr == nil && keyErr == nil && r.cert != nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return false, nil
+	}
+	if r.failed && certMod.Equal(r.failedAt[0]) && keyMod.Equal(r.failedAt[1]) {
+		return false, nil
+	}
+
+	err := certErr
+	if err == nil {
+		err = keyErr
+	}
+	var cert tls.Certificate
+	if err == nil {
+		cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			err = fmt.Errorf("error loading certificate %q: %w", r.certFile, err)
+		}
+	}
+	if err != nil {
+		r.failed = true
+		r.failedAt = [2]time.Time{certMod, keyMod}
+		return false, err
+	}
+
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+	r.failed = false
+	r.failedAt = [2]time.Time{}
+	return true, nil
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading certificate: %w", err)
+	}
+	return info.ModTime(), nil
+}
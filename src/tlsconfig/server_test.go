@@ -0,0 +1,137 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func leafName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+// replaceCert overwrites dst with the certificate and key in src and moves
+// their modification times forward.
+func replaceCert(t *testing.T, srcCert, srcKey, dstCert, dstKey string, mod time.Time) {
+	t.Helper()
+
+	for src, dst := range map[string]string{srcCert: dstCert, srcKey: dstKey} {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, data, 0o600))
+		require.NoError(t, os.Chtimes(dst, mod, mod))
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "admin.example.com")
+
+	t.Run("server certificate", func(t *testing.T) {
+		cfg, err := Server{CertFile: certFile, KeyFile: keyFile}.Config(nil)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+		assert.Equal(t, tls.NoClientCert, cfg.ClientAuth)
+
+		cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		assert.Equal(t, "admin.example.com", leafName(t, cert))
+	})
+
+	t.Run("client certificates", func(t *testing.T) {
+		cfg, err := Server{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}.Config(nil)
+		require.NoError(t, err)
+		assert.NotNil(t, cfg.ClientCAs)
+		assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := Server{CertFile: certFile}.Config(nil)
+		assert.ErrorContains(t, err, "key_file")
+
+		_, err = Server{CertFile: certFile, KeyFile: certFile}.Config(nil)
+		assert.Error(t, err)
+
+		_, err = Server{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}.Config(nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "old.example.com")
+	newCert, newKey := writeCert(t, dir, "new.example.com")
+
+	var reloadErrs []error
+	r, err := NewCertReloader(certFile, keyFile, func(err error) {
+		reloadErrs = append(reloadErrs, err)
+	})
+	require.NoError(t, err)
+
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "old.example.com", leafName(t, cert))
+
+	// A broken certificate is reported once and the old one stays in use.
+	mod := time.Now().Add(time.Minute)
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	require.NoError(t, os.Chtimes(certFile, mod, mod))
+	for range 2 {
+		cert, err = r.GetCertificate(nil)
+		require.NoError(t, err)
+		assert.Equal(t, "old.example.com", leafName(t, cert))
+	}
+	assert.Len(t, reloadErrs, 1)
+
+	replaceCert(t, newCert, newKey, certFile, keyFile, mod.Add(time.Minute))
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "new.example.com", leafName(t, cert))
+	assert.Len(t, reloadErrs, 1)
+
+	// A missing file is reported once as well.
+	require.NoError(t, os.Remove(keyFile))
+	for range 2 {
+		cert, err = r.GetCertificate(nil)
+		require.NoError(t, err)
+		assert.Equal(t, "new.example.com", leafName(t, cert))
+	}
+	require.Len(t, reloadErrs, 2)
+	assert.ErrorContains(t, reloadErrs[1], "error reading certificate")
+
+	// Restoring the file with the time of the loaded one is not a change.
+	replaceCert(t, newCert, newKey, certFile, keyFile, mod.Add(time.Minute))
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "new.example.com", leafName(t, cert))
+	assert.Len(t, reloadErrs, 2)
+
+	_, err = NewCertReloader(filepath.Join(dir, "missing.crt"), keyFile, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,241 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package units converts Ecowitt readings, which are always uploaded in
+// imperial units, into other units, and maps them to the unit system a
+// consumer asks for.
+//
+// Only the MQTT and InfluxDB sinks take a unit system. The proxy has no JSON
+// API that returns readings: /status and /metrics report counters and the
+// rewrite dry run echoes raw form fields, so they keep the Ecowitt units.
+package units
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"hass-ecowitt-proxy/ecowitt"
+)
+
+// Units the Ecowitt protocol does not use.
+const (
+	Celsius      = "°C"
+	HPa          = "hPa"
+	KPa          = "kPa"
+	MMHg         = "mmHg"
+	Millimeters  = "mm"
+	MMPerHour    = "mm/h"
+	KMPerHour    = "km/h"
+	MetersPerSec = "m/s"
+	Knots        = "kn"
+	Lux          = "lx"
+	Miles        = "mi"
+	MilligramsM3 = "mg/m³"
+	Kelvin       = "K"
+	Centimeters  = "cm"
+)
+
+// luxPerWm2 is the factor Ecowitt gateways use to show solar radiation in
+// lux. It is an approximation for daylight.
+const luxPerWm2 = 126.7
+
+type conversion struct {
+	from, to string
+}
+
+// conversions converts from one unit to another. Conversions in the other
+// direction are derived.
+var conversions = map[conversion]func(float64) float64{
+	{ecowitt.UnitFahrenheit, Celsius}: func(v float64) float64 { return (v - 32) * 5 / 9 },
+	{ecowitt.UnitFahrenheit, Kelvin}:  func(v float64) float64 { return (v-32)*5/9 + 273.15 },
+	{Celsius, Kelvin}:                 func(v float64) float64 { return v + 273.15 },
+
+	{ecowitt.UnitInHg, HPa}:  func(v float64) float64 { return v * 33.8638866667 },
+	{ecowitt.UnitInHg, KPa}:  func(v float64) float64 { return v * 3.38638866667 },
+	{ecowitt.UnitInHg, MMHg}: func(v float64) float64 { return v * 25.4 },
+	{HPa, KPa}:               func(v float64) float64 { return v / 10 },
+
+	{ecowitt.UnitInches, Millimeters}:  func(v float64) float64 { return v * 25.4 },
+	{ecowitt.UnitInches, Centimeters}:  func(v float64) float64 { return v * 2.54 },
+	{ecowitt.UnitInPerHour, MMPerHour}: func(v float64) float64 { return v * 25.4 },
+
+	{ecowitt.UnitMPH, KMPerHour}:    func(v float64) float64 { return v * 1.609344 },
+	{ecowitt.UnitMPH, MetersPerSec}: func(v float64) float64 { return v * 0.44704 },
+	{ecowitt.UnitMPH, Knots}:        func(v float64) float64 { return v * 0.868976 },
+	{KMPerHour, MetersPerSec}:       func(v float64) float64 { return v / 3.6 },
+
+	{ecowitt.UnitWm2, Lux}: func(v float64) float64 { return v * luxPerWm2 },
+
+	{ecowitt.UnitUgm3, MilligramsM3}: func(v float64) float64 { return v / 1000 },
+
+	{ecowitt.UnitKm, Miles}: func(v float64) float64 { return v / 1.609344 },
+}
+
+// inverse returns the reverse of a linear or affine conversion by sampling
+// it at two points.
+func inverse(fn func(float64) float64) func(float64) float64 {
+	offset := fn(0)
+	scale := fn(1) - offset
+	return func(v float64) float64 { return (v - offset) / scale }
+}
+
+// Convert converts a value between two units. It reports false when there is
+// no conversion between them.
+func Convert(v float64, from, to string) (float64, bool) {
+	if from == to {
+		return v, true
+	}
+	if fn, ok := conversions[conversion{from, to}]; ok {
+		return fn(v), true
+	}
+	if fn, ok := conversions[conversion{to, from}]; ok {
+		return inverse(fn)(v), true
+	}
+	return v, false
+}
+
+// System is the set of units a consumer wants readings in.
+type System uint8
+
+const (
+	// Imperial keeps the units of the Ecowitt protocol.
+	Imperial System = iota
+	// Metric uses °C, hPa, mm and km/h.
+	Metric
+	// MetricWindMS is Metric with wind speeds in m/s.
+	MetricWindMS
+	InvalidSystem
+)
+
+var systemNames = map[System]string{
+	Imperial:     "imperial",
+	Metric:       "metric",
+	MetricWindMS: "metric_wind_ms",
+}
+
+func (s System) String() string {
+	return systemNames[s]
+}
+
+func SystemNames() []string {
+	return []string{Imperial.String(), Metric.String(), MetricWindMS.String()}
+}
+
+// SystemFromStr parses a system name. The empty string is Imperial.
+func SystemFromStr(name string) (System, error) {
+	switch strings.ToLower(name) {
+	case "", "imperial":
+		return Imperial, nil
+	case "metric":
+		return Metric, nil
+	case "metric_wind_ms":
+		return MetricWindMS, nil
+	default:
+		return InvalidSystem, fmt.Errorf("invalid unit system %q", name)
+	}
+}
+
+// metricUnits maps Ecowitt units to their metric equivalents. Units that are
+// already metric, e.g. W/m², µg/m³ and km, are kept.
+var metricUnits = map[string]string{
+	ecowitt.UnitFahrenheit: Celsius,
+	ecowitt.UnitInHg:       HPa,
+	ecowitt.UnitInches:     Millimeters,
+	ecowitt.UnitInPerHour:  MMPerHour,
+	ecowitt.UnitMPH:        KMPerHour,
+}
+
+// decimals is the precision converted readings are rounded to, so that they
+// are not more precise than the original reading.
+var decimals = map[string]int{
+	Celsius:      2,
+	HPa:          2,
+	Millimeters:  2,
+	MMPerHour:    2,
+	KMPerHour:    2,
+	MetersPerSec: 2,
+}
+
+// Unit returns the unit a reading in the given Ecowitt unit is reported in.
+func (s System) Unit(unit string) string {
+	if s == Imperial {
+		return unit
+	}
+	if s == MetricWindMS && unit == ecowitt.UnitMPH {
+		return MetersPerSec
+	}
+	if to, ok := metricUnits[unit]; ok {
+		return to
+	}
+	return unit
+}
+
+// Convert converts a reading described by info into the system. It returns
+// the converted value and its unit.
+func (s System) Convert(info ecowitt.Info, v float64) (float64, string) {
+	to := s.Unit(info.Unit)
+	if to == info.Unit {
+		return v, to
+	}
+
+	converted, ok := Convert(v, info.Unit, to)
+	if !ok {
+		return v, info.Unit
+	}
+	scale := math.Pow10(decimals[to])
+	return math.Round(converted*scale) / scale, to
+}
+
+// imperialSuffixes are the unit suffixes of Ecowitt field names, e.g. the f
+// of tempf.
+var imperialSuffixes = map[string]string{
+	ecowitt.UnitFahrenheit: "f",
+	ecowitt.UnitInHg:       "in",
+	ecowitt.UnitInches:     "in",
+	ecowitt.UnitInPerHour:  "in",
+	ecowitt.UnitMPH:        "mph",
+}
+
+// metricSuffixes replace the imperial suffix of converted readings.
+var metricSuffixes = map[string]string{
+	Celsius:      "c",
+	HPa:          "hpa",
+	Millimeters:  "mm",
+	MMPerHour:    "mmh",
+	KMPerHour:    "kmh",
+	MetersPerSec: "ms",
+}
+
+// FieldName returns the name of a reading converted to unit. Converted
+// readings get a name of their own, so that consumers never see one name in
+// two units: the imperial suffix is replaced, e.g. tempf becomes tempc and
+// windspeedmph becomes windspeedkmh, and names without one get the metric
+// suffix appended, e.g. maxdailygust_kmh. The in of vpdin means indoor, so
+// vapour pressures always get the suffix appended.
+func FieldName(name string, info ecowitt.Info, unit string) string {
+	suffix, ok := metricSuffixes[unit]
+	if unit == info.Unit || !ok {
+		return name
+	}
+
+	imperial := imperialSuffixes[info.Unit]
+	if info.Kind != ecowitt.KindVaporPressure && strings.HasSuffix(name, imperial) {
+		return strings.TrimSuffix(name, imperial) + suffix
+	}
+	return name + "_" + suffix
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package units
+
+import (
+	"testing"
+
+	"hass-ecowitt-proxy/ecowitt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name     string
+		v        float64
+		from, to string
+		want     float64
+	}{
+		{name: "freezing", v: 32, from: ecowitt.UnitFahrenheit, to: Celsius, want: 0},
+		{name: "boiling", v: 212, from: ecowitt.UnitFahrenheit, to: Celsius, want: 100},
+		{name: "celsius to fahrenheit", v: -40, from: Celsius, to: ecowitt.UnitFahrenheit, want: -40},
+		{name: "kelvin", v: 32, from: ecowitt.UnitFahrenheit, to: Kelvin, want: 273.15},
+		{name: "pressure", v: 29.92, from: ecowitt.UnitInHg, to: HPa, want: 1013.207},
+		{name: "pressure back", v: 1013.25, from: HPa, to: ecowitt.UnitInHg, want: 29.921},
+		{name: "mmHg", v: 29.92, from: ecowitt.UnitInHg, to: MMHg, want: 759.968},
+		{name: "rain", v: 1, from: ecowitt.UnitInches, to: Millimeters, want: 25.4},
+		{name: "rain rate", v: 0.5, from: ecowitt.UnitInPerHour, to: MMPerHour, want: 12.7},
+		{name: "wind km/h", v: 10, from: ecowitt.UnitMPH, to: KMPerHour, want: 16.093},
+		{name: "wind m/s", v: 10, from: ecowitt.UnitMPH, to: MetersPerSec, want: 4.470},
+		{name: "wind knots", v: 10, from: ecowitt.UnitMPH, to: Knots, want: 8.690},
+		{name: "km/h to mph", v: 100, from: KMPerHour, to: ecowitt.UnitMPH, want: 62.137},
+		{name: "solar", v: 100, from: ecowitt.UnitWm2, to: Lux, want: 12670},
+		{name: "lux", v: 12670, from: Lux, to: ecowitt.UnitWm2, want: 100},
+		{name: "pm", v: 35, from: ecowitt.UnitUgm3, to: MilligramsM3, want: 0.035},
+		{name: "distance", v: 16.09344, from: ecowitt.UnitKm, to: Miles, want: 10},
+		{name: "same unit", v: 61, from: ecowitt.UnitPercent, to: ecowitt.UnitPercent, want: 61},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := Convert(test.v, test.from, test.to)
+			require.True(t, ok)
+			assert.InDelta(t, test.want, got, 0.001)
+		})
+	}
+
+	_, ok := Convert(1, ecowitt.UnitFahrenheit, HPa)
+	assert.False(t, ok)
+}
+
+func TestSystemConvert(t *testing.T) {
+	tests := []struct {
+		field    string
+		v        float64
+		system   System
+		want     float64
+		wantUnit string
+	}{
+		{field: "tempf", v: 45.5, system: Imperial, want: 45.5, wantUnit: ecowitt.UnitFahrenheit},
+		{field: "tempf", v: 45.6, system: Metric, want: 7.56, wantUnit: Celsius},
+		{field: "temp3f", v: 68, system: MetricWindMS, want: 20, wantUnit: Celsius},
+		{field: "baromrelin", v: 29.858, system: Metric, want: 1011.11, wantUnit: HPa},
+		{field: "vpd", v: 0.123, system: Metric, want: 4.17, wantUnit: HPa},
+		{field: "dailyrainin", v: 0.12, system: Metric, want: 3.05, wantUnit: Millimeters},
+		{field: "rainratein", v: 0.12, system: Metric, want: 3.05, wantUnit: MMPerHour},
+		{field: "windspeedmph", v: 10, system: Metric, want: 16.09, wantUnit: KMPerHour},
+		{field: "windgustmph", v: 10, system: MetricWindMS, want: 4.47, wantUnit: MetersPerSec},
+		{field: "solarradiation", v: 512.3, system: Metric, want: 512.3, wantUnit: ecowitt.UnitWm2},
+		{field: "pm25_ch1", v: 12.5, system: Metric, want: 12.5, wantUnit: ecowitt.UnitUgm3},
+		{field: "lightning", v: 12, system: Metric, want: 12, wantUnit: ecowitt.UnitKm},
+		{field: "humidity", v: 61, system: MetricWindMS, want: 61, wantUnit: ecowitt.UnitPercent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.system.String()+" "+test.field, func(t *testing.T) {
+			info, ok := ecowitt.FieldInfo(test.field)
+			require.True(t, ok)
+
+			got, unit := test.system.Convert(info, test.v)
+			assert.Equal(t, test.want, got)
+			assert.Equal(t, test.wantUnit, unit)
+		})
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	tests := []struct {
+		field  string
+		system System
+		want   string
+	}{
+		{field: "tempf", system: Imperial, want: "tempf"},
+		{field: "tempf", system: Metric, want: "tempc"},
+		{field: "baromrelin", system: Metric, want: "baromrelhpa"},
+		{field: "rainratein", system: Metric, want: "rainratemmh"},
+		{field: "windspeedmph", system: Metric, want: "windspeedkmh"},
+		{field: "windgustmph", system: MetricWindMS, want: "windgustms"},
+		{field: "vpd", system: Metric, want: "vpd_hpa"},
+		{field: "humidity", system: Metric, want: "humidity"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.system.String()+" "+test.field, func(t *testing.T) {
+			info, ok := ecowitt.FieldInfo(test.field)
+			require.True(t, ok)
+
+			_, unit := test.system.Convert(info, 1)
+			assert.Equal(t, test.want, FieldName(test.field, info, unit))
+		})
+	}
+}
+
+func TestSystemFromStr(t *testing.T) {
+	for _, name := range SystemNames() {
+		s, err := SystemFromStr(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, s.String())
+	}
+
+	s, err := SystemFromStr("")
+	require.NoError(t, err)
+	assert.Equal(t, Imperial, s)
+
+	_, err = SystemFromStr("nautical")
+	assert.ErrorContains(t, err, `invalid unit system "nautical"`)
+}
@@ -0,0 +1,146 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package wunderground speaks the Weather Underground personal weather
+// station upload protocol, a GET request to updateweatherstation.php with
+// the readings in imperial units as query parameters. Many other services,
+// e.g. PWSWeather, accept the same protocol.
+package wunderground
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+)
+
+// Query parameters of the protocol that are not readings.
+const (
+	ParamID           = "ID"
+	ParamPassword     = "PASSWORD"
+	ParamDateUTC      = "dateutc"
+	ParamAction       = "action"
+	ParamSoftwareType = "softwaretype"
+
+	ActionUpdateRaw = "updateraw"
+	SoftwareType    = "hass-ecowitt-proxy"
+)
+
+// fieldMap pairs Ecowitt field names with their Weather Underground
+// equivalents. Both protocols use the same units. The first WH31 channels
+// become the additional outdoor temperatures temp2f to temp4f.
+var fieldMap = []struct {
+	ecowitt string
+	wu      string
+}{
+	{"tempf", "tempf"},
+	{"humidity", "humidity"},
+	{"tempinf", "indoortempf"},
+	{"humidityin", "indoorhumidity"},
+	{"baromrelin", "baromin"},
+	{"baromabsin", "absbaromin"},
+	{"winddir", "winddir"},
+	{"windspeedmph", "windspeedmph"},
+	{"windgustmph", "windgustmph"},
+	{"hourlyrainin", "rainin"},
+	{"dailyrainin", "dailyrainin"},
+	{"weeklyrainin", "weeklyrainin"},
+	{"monthlyrainin", "monthlyrainin"},
+	{"yearlyrainin", "yearlyrainin"},
+	{"solarradiation", "solarradiation"},
+	{"uv", "UV"},
+	{"soilmoisture1", "soilmoisture"},
+	{"soilmoisture2", "soilmoisture2"},
+	{"soilmoisture3", "soilmoisture3"},
+	{"soilmoisture4", "soilmoisture4"},
+	{"pm25_ch1", "AqPM2.5"},
+	{"pm10_co2", "AqPM10"},
+	{"temp1f", "temp2f"},
+	{"temp2f", "temp3f"},
+	{"temp3f", "temp4f"},
+}
+
+// FromEcowitt converts an Ecowitt upload into Weather Underground query
+// parameters for the given station. Readings without a Weather Underground
+// equivalent are left out. The time of the upload is receivedAt unless the
+// gateway sent a valid time of its own.
+func FromEcowitt(payload *ecowitt.Payload, receivedAt time.Time, stationID string, stationKey string) url.Values {
+	when, err := payload.Station.Time()
+	if err != nil {
+		when = receivedAt.UTC()
+	}
+
+	values := url.Values{
+		ParamID:           {stationID},
+		ParamPassword:     {stationKey},
+		ParamAction:       {ActionUpdateRaw},
+		ParamSoftwareType: {SoftwareType},
+		ParamDateUTC:      {when.Format(ecowitt.DateFormat)},
+	}
+
+	for _, f := range fieldMap {
+		if v, ok := payload.Get(f.ecowitt); ok {
+			values.Set(f.wu, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+
+	return values
+}
+
+// wuAliases maps Weather Underground parameters that carry the same reading
+// as a parameter in fieldMap to the Ecowitt field. They are only used when
+// the primary parameter is missing.
+var wuAliases = map[string]string{
+	"windspdmph_avg2m": "windspeedmph",
+	"winddir_avg2m":    "winddir",
+	"windgustmph_10m":  "windgustmph",
+}
+
+// ToEcowitt converts a Weather Underground upload into Ecowitt form data, so
+// that it can be handled like an upload from an Ecowitt gateway. The station
+// ID takes the place of the PASSKEY and the password is dropped. Readings
+// without an Ecowitt equivalent, e.g. dewptf, are dropped as well.
+func ToEcowitt(query url.Values, receivedAt time.Time) url.Values {
+	values := url.Values{}
+
+	if id := query.Get(ParamID); id != "" {
+		values.Set(ecowitt.FieldPasskey, id)
+	}
+	if software := query.Get(ParamSoftwareType); software != "" {
+		values.Set(ecowitt.FieldStationType, software)
+	}
+
+	dateUTC := query.Get(ParamDateUTC)
+	if _, err := time.Parse(ecowitt.DateFormat, dateUTC); err != nil {
+		dateUTC = receivedAt.UTC().Format(ecowitt.DateFormat)
+	}
+	values.Set(ecowitt.FieldDateUTC, dateUTC)
+
+	for _, f := range fieldMap {
+		if v := query.Get(f.wu); v != "" {
+			values.Set(f.ecowitt, v)
+		}
+	}
+	for alias, field := range wuAliases {
+		if v := query.Get(alias); v != "" && values.Get(field) == "" {
+			values.Set(field, v)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,166 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package wunderground
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+)
+
+// Upload endpoints of services that accept the protocol.
+const (
+	WundergroundURL = "https://weatherstation.wunderground.com/weatherstation/updateweatherstation.php"
+	PWSWeatherURL   = "https://www.pwsweather.com/pwsupdate/pwsupdate.php"
+)
+
+const DefaultTimeout = 10 * time.Second
+
+// Service is a Weather Underground compatible service that uploads are
+// relayed to.
+type Service struct {
+	Name       string
+	URL        string
+	StationID  string
+	StationKey string
+
+	// Passkey limits the relay to uploads from the gateway with this
+	// PASSKEY. All uploads are relayed when it is empty.
+	Passkey string
+
+	Timeout time.Duration
+}
+
+func (s Service) Validate() error {
+	missing := []string{}
+	if s.URL == "" {
+		missing = append(missing, "url")
+	}
+	if s.StationID == "" {
+		missing = append(missing, "station_id")
+	}
+	if s.StationKey == "" {
+		missing = append(missing, "station_key")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("relay %q is missing: %s", s.Name, strings.Join(missing, ", "))
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("relay %q has a negative timeout", s.Name)
+	}
+	return nil
+}
+
+// ValidateServices checks every service and makes sure names are unique.
+func ValidateServices(services []Service) error {
+	seen := map[string]bool{}
+	for _, s := range services {
+		if s.Name == "" {
+			return errors.New("every relay needs a name")
+		}
+		if seen[s.Name] {
+			return fmt.Errorf("duplicate relay name %q", s.Name)
+		}
+		seen[s.Name] = true
+
+		if err := s.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Option func(*Relay)
+
+func WithHTTPClient(client *http.Client) Option {
+	return func(r *Relay) {
+		r.client = client
+	}
+}
+
+// Relay is a controller.Sink that re-uploads Ecowitt uploads to a single
+// Weather Underground compatible service.
+type Relay struct {
+	service Service
+	client  *http.Client
+}
+
+func NewRelay(service Service, opts ...Option) (*Relay, error) {
+	if err := service.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := &Relay{service: service, client: &http.Client{}}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
+}
+
+// Name returns the service name with a relay/ prefix, so that a relay cannot
+// share its name with the MQTT or InfluxDB sink.
+func (r *Relay) Name() string {
+	return "relay/" + r.service.Name
+}
+
+// Publish sends the upload to the service. Uploads from other gateways than
+// the one the service is limited to are skipped.
+func (r *Relay) Publish(ctx context.Context, receivedAt time.Time, payload *ecowitt.Payload) error {
+	if r.service.Passkey != "" && !strings.EqualFold(r.service.Passkey, payload.Station.Passkey) {
+		return nil
+	}
+
+	timeout := r.service.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	values := FromEcowitt(payload, receivedAt, r.service.StationID, r.service.StationKey)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.service.URL+"?"+values.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		// The URL contains the station key.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("error relaying to %s: %w", r.service.Name, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := strings.TrimSpace(string(body))
+
+	// Weather Underground reports bad credentials in the body.
+	if resp.StatusCode/100 != 2 || strings.HasPrefix(msg, "INVALID") {
+		return fmt.Errorf("%s rejected upload with status %d: %s", r.service.Name, resp.StatusCode, msg)
+	}
+	return nil
+}
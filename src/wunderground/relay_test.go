@@ -0,0 +1,247 @@
+/*
+Copyright © 2023-2024 Sean Laurent <o r g a n i c v e g g i e @ Google Mail>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package wunderground
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"hass-ecowitt-proxy/ecowitt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var receivedAt = time.Date(2024, 3, 1, 17, 5, 0, 0, time.UTC)
+
+func TestFromEcowitt(t *testing.T) {
+	tests := []struct {
+		name   string
+		values url.Values
+		want   url.Values
+	}{
+		{
+			name: "readings are renamed",
+			values: url.Values{
+				"PASSKEY":        {"AAAA"},
+				"dateutc":        {"2024-03-01 17:03:22"},
+				"tempf":          {"45.50"},
+				"tempinf":        {"71.78"},
+				"baromrelin":     {"29.858"},
+				"hourlyrainin":   {"0.01"},
+				"dailyrainin":    {"0.12"},
+				"uv":             {"2"},
+				"temp1f":         {"68"},
+				"pm25_ch1":       {"6"},
+				"soilmoisture1":  {"32"},
+				"lightning_num":  {"3"},
+				"unknown":        {"1"},
+				"solarradiation": {"312.66"},
+			},
+			want: url.Values{
+				"ID":             {"KSTATION1"},
+				"PASSWORD":       {"key"},
+				"action":         {"updateraw"},
+				"softwaretype":   {"hass-ecowitt-proxy"},
+				"dateutc":        {"2024-03-01 17:03:22"},
+				"tempf":          {"45.5"},
+				"indoortempf":    {"71.78"},
+				"baromin":        {"29.858"},
+				"rainin":         {"0.01"},
+				"dailyrainin":    {"0.12"},
+				"UV":             {"2"},
+				"temp2f":         {"68"},
+				"AqPM2.5":        {"6"},
+				"soilmoisture":   {"32"},
+				"solarradiation": {"312.66"},
+			},
+		},
+		{
+			name:   "gateway without a clock",
+			values: url.Values{"dateutc": {"now"}, "humidity": {"61"}},
+			want: url.Values{
+				"ID":           {"KSTATION1"},
+				"PASSWORD":     {"key"},
+				"action":       {"updateraw"},
+				"softwaretype": {"hass-ecowitt-proxy"},
+				"dateutc":      {"2024-03-01 17:05:00"},
+				"humidity":     {"61"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := FromEcowitt(ecowitt.Parse(test.values), receivedAt, "KSTATION1", "key")
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestToEcowitt(t *testing.T) {
+	tests := []struct {
+		name  string
+		query url.Values
+		want  url.Values
+	}{
+		{
+			name: "readings are renamed",
+			query: url.Values{
+				"ID":             {"KSTATION1"},
+				"PASSWORD":       {"key"},
+				"action":         {"updateraw"},
+				"softwaretype":   {"EasyWeatherPro_V5.1.6"},
+				"dateutc":        {"2024-03-01 17:03:22"},
+				"tempf":          {"45.5"},
+				"indoortempf":    {"71.78"},
+				"baromin":        {"29.858"},
+				"rainin":         {"0.01"},
+				"UV":             {"2"},
+				"temp2f":         {"68"},
+				"dewptf":         {"33.1"},
+				"solarradiation": {"312.66"},
+			},
+			want: url.Values{
+				"PASSKEY":        {"KSTATION1"},
+				"stationtype":    {"EasyWeatherPro_V5.1.6"},
+				"dateutc":        {"2024-03-01 17:03:22"},
+				"tempf":          {"45.5"},
+				"tempinf":        {"71.78"},
+				"baromrelin":     {"29.858"},
+				"hourlyrainin":   {"0.01"},
+				"uv":             {"2"},
+				"temp1f":         {"68"},
+				"solarradiation": {"312.66"},
+			},
+		},
+		{
+			name: "averages fill in for missing readings",
+			query: url.Values{
+				"ID":               {"KSTATION1"},
+				"dateutc":          {"now"},
+				"windspeedmph":     {"3.8"},
+				"windspdmph_avg2m": {"4.1"},
+				"winddir_avg2m":    {"250"},
+			},
+			want: url.Values{
+				"PASSKEY":      {"KSTATION1"},
+				"dateutc":      {"2024-03-01 17:05:00"},
+				"windspeedmph": {"3.8"},
+				"winddir":      {"250"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, ToEcowitt(test.query, receivedAt))
+		})
+	}
+}
+
+func TestRelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		passkey  string
+		status   int
+		body     string
+		wantSent bool
+		wantErr  bool
+	}{
+		{
+			name:     "success",
+			status:   http.StatusOK,
+			body:     "success\n",
+			wantSent: true,
+		},
+		{
+			name:     "matching passkey",
+			passkey:  "aaaa",
+			status:   http.StatusOK,
+			body:     "success\n",
+			wantSent: true,
+		},
+		{
+			name:    "other station",
+			passkey: "BBBB",
+		},
+		{
+			name:     "bad credentials",
+			status:   http.StatusOK,
+			body:     "INVALIDPASSWORDID|Password or key and/or id are incorrect\n",
+			wantSent: true,
+			wantErr:  true,
+		},
+		{
+			name:     "server error",
+			status:   http.StatusInternalServerError,
+			wantSent: true,
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got url.Values
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodGet, r.Method)
+				got = r.URL.Query()
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer srv.Close()
+
+			relay, err := NewRelay(Service{
+				Name:       "wunderground",
+				URL:        srv.URL + "/weatherstation/updateweatherstation.php",
+				StationID:  "KSTATION1",
+				StationKey: "key",
+				Passkey:    test.passkey,
+			})
+			require.NoError(t, err)
+
+			payload := ecowitt.Parse(url.Values{"PASSKEY": {"AAAA"}, "tempf": {"45.5"}})
+			err = relay.Publish(context.Background(), receivedAt, payload)
+			if test.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			if test.wantSent {
+				assert.Equal(t, "KSTATION1", got.Get("ID"))
+				assert.Equal(t, "45.5", got.Get("tempf"))
+			} else {
+				assert.Nil(t, got)
+			}
+		})
+	}
+}
+
+func TestValidateServices(t *testing.T) {
+	valid := Service{Name: "wu", URL: WundergroundURL, StationID: "id", StationKey: "key"}
+	assert.NoError(t, ValidateServices([]Service{valid}))
+
+	assert.Error(t, ValidateServices([]Service{valid, valid}))
+	assert.Error(t, ValidateServices([]Service{{URL: WundergroundURL, StationID: "id", StationKey: "key"}}))
+	assert.Error(t, ValidateServices([]Service{{Name: "pws", URL: PWSWeatherURL, StationID: "id"}}))
+}